@@ -2,46 +2,101 @@ package main
 
 import (
 	"fmt"
+	"math"
+	"net"
 	"os"
+	"path"
+	"regexp"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/pkg/errors"
 
 	"github.com/jet/damon/container"
 	"github.com/jet/damon/log"
+	"github.com/jet/damon/win32"
 )
 
 const DefaultLogMaxSizeMB = 10
 const DefaultLogMaxFiles = 5
 const DefaultMetricsEndpoint = "/metrics"
+const DefaultMetricsNamespace = "damon"
+const DefaultMetricsFileInterval = 15 * time.Second
+const DefaultEventLogSource = "damon"
 
 const (
-	EnvDamonLogMaxSizeMB   = "DAMON_LOG_MAX_SIZE"
-	EnvDamonLogMaxFiles    = "DAMON_LOG_MAX_FILES"
-	EnvDamonLogDir         = "DAMON_LOG_DIR"
-	EnvDamonLogName        = "DAMON_LOG_NAME"
-	EnvDamonNomadLogSuffix = "DAMON_NOMAD_LOG_SUFFIX"
-	EnvNomadAllocDir       = "NOMAD_ALLOC_DIR"
-	EnvNomadTaskName       = "NOMAD_TASK_NAME"
-	EnvNomadAllocID        = "NOMAD_ALLOC_ID"
-	EnvNomadAllocIndex     = "NOMAD_ALLOC_INDEX"
-	EnvNomadGroupName      = "NOMAD_GROUP_NAME"
-	EnvNomadJobName        = "NOMAD_JOB_NAME"
-	EnvNomadDC             = "NOMAD_DC"
-	EnvNomadRegion         = "NOMAD_REGION"
-	EnvNomadDamonAddress   = "NOMAD_ADDR_damon"
-
-	EnvDamonEnforceCPULimit    = "DAMON_ENFORCE_CPU_LIMIT"
-	EnvDamonEnforceMemoryLimit = "DAMON_ENFORCE_MEMORY_LIMIT"
-	EnvDamonCPULimit           = "DAMON_CPU_LIMIT"
-	EnvNomadCPULimit           = "NOMAD_CPU_LIMIT"
-	EnvDamonMemoryLimit        = "DAMON_MEMORY_LIMIT"
-	EnvNomadMemoryLimit        = "NOMAD_MEMORY_LIMIT"
-	EnvDamonRestrictedToken    = "DAMON_RESTRICTED_TOKEN"
-	EnvDamonAddress            = "DAMON_ADDR"
-	EnvDamonMetricsEndpoint    = "DAMON_METRICS_ENDPOINT"
+	CPUEnforceModeHardCap = "hard_cap"
+	CPUEnforceModeWeight  = "weight"
+)
+
+const (
+	ShutdownSignalCtrlBreak = "ctrl_break"
+	ShutdownSignalCtrlC     = "ctrl_c"
+)
+
+const (
+	EnvDamonLogMaxSizeMB      = "DAMON_LOG_MAX_SIZE"
+	EnvDamonLogMaxFiles       = "DAMON_LOG_MAX_FILES"
+	EnvDamonLogDir            = "DAMON_LOG_DIR"
+	EnvDamonLogName           = "DAMON_LOG_NAME"
+	EnvDamonNomadLogSuffix    = "DAMON_NOMAD_LOG_SUFFIX"
+	EnvDamonLogEventLog       = "DAMON_LOG_EVENTLOG"
+	EnvDamonLogEventLogSource = "DAMON_LOG_EVENTLOG_SOURCE"
+	EnvNomadAllocDir          = "NOMAD_ALLOC_DIR"
+	EnvNomadTaskName          = "NOMAD_TASK_NAME"
+	EnvNomadAllocID           = "NOMAD_ALLOC_ID"
+	EnvNomadAllocIndex        = "NOMAD_ALLOC_INDEX"
+	EnvNomadGroupName         = "NOMAD_GROUP_NAME"
+	EnvNomadJobName           = "NOMAD_JOB_NAME"
+	EnvNomadDC                = "NOMAD_DC"
+	EnvNomadRegion            = "NOMAD_REGION"
+	EnvNomadDamonAddress      = "NOMAD_ADDR_damon"
+
+	EnvDamonEnforceCPULimit     = "DAMON_ENFORCE_CPU_LIMIT"
+	EnvDamonEnforceMemoryLimit  = "DAMON_ENFORCE_MEMORY_LIMIT"
+	EnvDamonEnforceIOLimit      = "DAMON_ENFORCE_IO_LIMIT"
+	EnvDamonIOMaxIOPS           = "DAMON_IO_MAX_IOPS"
+	EnvDamonIOMaxBandwidth      = "DAMON_IO_MAX_BANDWIDTH"
+	EnvDamonIOBaseSize          = "DAMON_IO_BASE_SIZE"
+	EnvDamonEnforceNetLimit     = "DAMON_ENFORCE_NETWORK_LIMIT"
+	EnvDamonNetMaxBandwidth     = "DAMON_NETWORK_MAX_BANDWIDTH"
+	EnvDamonCPUEnforceMode      = "DAMON_CPU_ENFORCE_MODE"
+	EnvDamonStrictCPULimit      = "DAMON_STRICT_CPU_LIMIT"
+	EnvDamonShutdownSignal      = "DAMON_SHUTDOWN_SIGNAL"
+	EnvDamonKillGracePeriod     = "DAMON_KILL_GRACE_PERIOD"
+	EnvDamonShutdownTimeout     = "DAMON_SHUTDOWN_TIMEOUT"
+	EnvDamonStartTimeout        = "DAMON_START_TIMEOUT"
+	EnvDamonNotificationBuffer  = "DAMON_NOTIFICATION_BUFFER"
+	EnvDamonPIDFile             = "DAMON_PID_FILE"
+	EnvDamonConsoleCodePage     = "DAMON_CONSOLE_CODE_PAGE"
+	EnvDamonCPULimit            = "DAMON_CPU_LIMIT"
+	EnvDamonCPULimitPercent     = "DAMON_CPU_LIMIT_PERCENT"
+	EnvDamonCPUCores            = "DAMON_CPU_CORES"
+	EnvDamonSchedulingClass     = "DAMON_SCHEDULING_CLASS"
+	EnvNomadCPUCores            = "NOMAD_CPU_CORES"
+	EnvNomadCPULimit            = "NOMAD_CPU_LIMIT"
+	EnvDamonMemoryLimit         = "DAMON_MEMORY_LIMIT"
+	EnvNomadMemoryLimit         = "NOMAD_MEMORY_LIMIT"
+	EnvDamonMinWorkingSet       = "DAMON_MIN_WORKING_SET"
+	EnvDamonMaxWorkingSet       = "DAMON_MAX_WORKING_SET"
+	EnvDamonRestrictedToken     = "DAMON_RESTRICTED_TOKEN"
+	EnvDamonEnvAllow            = "DAMON_ENV_ALLOW"
+	EnvDamonEnvDeny             = "DAMON_ENV_DENY"
+	EnvDamonAllowBreakaway      = "DAMON_ALLOW_BREAKAWAY"
+	EnvDamonAllowSilentBreak    = "DAMON_ALLOW_SILENT_BREAKAWAY"
+	EnvDamonDieOnException      = "DAMON_DIE_ON_UNHANDLED_EXCEPTION"
+	EnvDamonAddress             = "DAMON_ADDR"
+	EnvDamonMetricsLocalhost    = "DAMON_METRICS_LOCALHOST_ONLY"
+	EnvDamonMetricsEndpoint     = "DAMON_METRICS_ENDPOINT"
+	EnvDamonMetricsNamespace    = "DAMON_METRICS_NAMESPACE"
+	EnvDamonMetricsTCPConns     = "DAMON_METRICS_TCP_CONNECTIONS"
+	EnvDamonMetricsFile         = "DAMON_METRICS_FILE"
+	EnvDamonMetricsFileInterval = "DAMON_METRICS_FILE_INTERVAL"
+	EnvDamonCPUSmoothing        = "DAMON_CPU_SMOOTHING"
+	EnvDamonContainerName       = "DAMON_CONTAINER_NAME"
+	EnvDamonWorkingDir          = "DAMON_WORKING_DIR"
 )
 
 func LogConfigFromEnvironment() log.LogConfig {
@@ -65,6 +120,12 @@ func LogConfigFromEnvironment() log.LogConfig {
 			cfg.MaxLogFiles = int(i)
 		}
 	}
+	if envToBool(EnvDamonLogEventLog, false) {
+		cfg.EventLogSource = DefaultEventLogSource
+		if src := os.Getenv(EnvDamonLogEventLogSource); src != "" {
+			cfg.EventLogSource = src
+		}
+	}
 	return cfg
 }
 
@@ -118,16 +179,275 @@ func envToInt(def int64, envs ...string) (int64, error) {
 	return def, nil
 }
 
-func ListenAddress() string {
-	if env := os.Getenv(EnvDamonAddress); env != "" {
-		return env
+func envToDuration(def time.Duration, envs ...string) (time.Duration, error) {
+	for _, e := range envs {
+		if env := os.Getenv(e); env != "" {
+			d, err := time.ParseDuration(env)
+			if err != nil {
+				return 0, fmt.Errorf("error parsing environment %s=%s as duration: %v", e, env, err)
+			}
+			return d, nil
+		}
 	}
-	if env := os.Getenv(EnvNomadDamonAddress); env != "" {
-		return env
+	return def, nil
+}
+
+// memoryUnits are the suffixes accepted in a memory limit, in MB. Longer suffixes come first so they are matched first
+var memoryUnits = []struct {
+	suffix string
+	mb     float64
+}{
+	{suffix: "GB", mb: 1024},
+	{suffix: "MB", mb: 1},
+	{suffix: "G", mb: 1024},
+	{suffix: "M", mb: 1},
+}
+
+// parseMemoryMB parses a memory size such as "512", "512MB", "2GB" or "25%" into MB.
+// A bare number is in MB, and a percentage is resolved against totalKB, the physical memory of the machine
+func parseMemoryMB(s string, totalKB float64) (int64, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	if strings.HasSuffix(s, "%") {
+		p, err := strconv.ParseFloat(strings.TrimSpace(strings.TrimSuffix(s, "%")), 64)
+		if err != nil {
+			return 0, err
+		}
+		if p <= 0 || p > 100 {
+			return 0, errors.Errorf("percentage must be more than 0 and at most 100")
+		}
+		if totalKB <= 0 {
+			return 0, errors.Errorf("unable to determine the physical memory of the machine")
+		}
+		return int64(totalKB / 1024.0 * p / 100.0), nil
+	}
+	mb := 1.0
+	for _, u := range memoryUnits {
+		if strings.HasSuffix(s, u.suffix) {
+			s = strings.TrimSpace(strings.TrimSuffix(s, u.suffix))
+			mb = u.mb
+			break
+		}
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, err
+	}
+	if v < 0 {
+		return 0, errors.Errorf("size can't be negative")
+	}
+	return int64(v * mb), nil
+}
+
+// envToMemoryMB parses the first set memory size in MB. See parseMemoryMB for the accepted formats
+func envToMemoryMB(def int64, envs ...string) (int64, error) {
+	for _, e := range envs {
+		if env := os.Getenv(e); env != "" {
+			var totalKB float64
+			if strings.HasSuffix(strings.TrimSpace(env), "%") {
+				totalKB = win32.GetSystemResources().MemoryTotalPhysicalKB
+			}
+			mb, err := parseMemoryMB(env, totalKB)
+			if err != nil {
+				return 0, fmt.Errorf("error parsing environment %s=%s as a memory size: %v", e, env, err)
+			}
+			return mb, nil
+		}
+	}
+	return def, nil
+}
+
+// envToAffinityMask parses the first set core list, such as "0-3,6", into an affinity mask.
+// It returns 0, which doesn't pin the process, when none is set
+func envToAffinityMask(envs ...string) (win32.AffinityMask, error) {
+	for _, e := range envs {
+		if env := os.Getenv(e); env != "" {
+			cores, err := win32.ParseCoreList(env)
+			if err != nil {
+				return 0, fmt.Errorf("error parsing environment %s=%s as a core list: %v", e, env, err)
+			}
+			for _, c := range cores {
+				if c >= win32.MaxAffinityCores {
+					return 0, fmt.Errorf("error parsing environment %s=%s as a core list: core %d is above the maximum of %d", e, env, c, win32.MaxAffinityCores-1)
+				}
+			}
+			return win32.CoresToAffinityMask(cores), nil
+		}
+	}
+	return 0, nil
+}
+
+// envToPatterns splits the comma separated environment variable name patterns of env, such as "NOMAD_*,PATH".
+// It returns nil when env is unset
+func envToPatterns(env string) ([]string, error) {
+	var patterns []string
+	for _, p := range strings.Split(os.Getenv(env), ",") {
+		if p = strings.TrimSpace(p); p == "" {
+			continue
+		}
+		if _, err := path.Match(p, ""); err != nil {
+			return nil, fmt.Errorf("error parsing environment %s: invalid pattern %q: %v", env, p, err)
+		}
+		patterns = append(patterns, p)
+	}
+	return patterns, nil
+}
+
+// ShutdownTimeout returns how long to wait for the process to exit gracefully from DAMON_SHUTDOWN_TIMEOUT.
+// When it is unset, invalid or not positive, the default is returned, along with the parse error if any
+func ShutdownTimeout() (time.Duration, error) {
+	d, err := envToDuration(win32.DefaultExitTimeout, EnvDamonShutdownTimeout)
+	if err != nil {
+		return win32.DefaultExitTimeout, err
+	}
+	if d <= 0 {
+		return win32.DefaultExitTimeout, errors.Errorf("invalid %s=%v. It must be positive", EnvDamonShutdownTimeout, d)
+	}
+	return d, nil
+}
+
+// WorkingDir returns the directory to run the process in from DAMON_WORKING_DIR, or "" to use damon's.
+// It returns an error when the directory doesn't exist or can't be opened
+func WorkingDir() (string, error) {
+	dir := os.Getenv(EnvDamonWorkingDir)
+	if dir == "" {
+		return "", nil
+	}
+	stat, err := os.Stat(dir)
+	if err != nil {
+		return "", errors.Wrapf(err, "invalid %s", EnvDamonWorkingDir)
+	}
+	if !stat.IsDir() {
+		return "", errors.Errorf("invalid %s=%s. It isn't a directory", EnvDamonWorkingDir, dir)
+	}
+	f, err := os.Open(dir)
+	if err != nil {
+		return "", errors.Wrapf(err, "invalid %s", EnvDamonWorkingDir)
+	}
+	f.Close()
+	return dir, nil
+}
+
+// ContainerName returns the name of the container from DAMON_CONTAINER_NAME.
+// When unset, it is derived from the nomad task name and allocation ID.
+func ContainerName() string {
+	if name := os.Getenv(EnvDamonContainerName); name != "" {
+		return name
+	}
+	task := os.Getenv(EnvNomadTaskName)
+	alloc := os.Getenv(EnvNomadAllocID)
+	if task != "" && alloc != "" {
+		return fmt.Sprintf("%s-%s", task, alloc)
 	}
 	return ""
 }
 
+// cpuLimitHz is the CPU limit applied to the container in Hz, or 0 when CPU isn't limited
+func cpuLimitHz(cfg container.Config, resources win32.SystemResources) float64 {
+	if !cfg.EnforceCPU {
+		return 0
+	}
+	if cfg.CPUMinPercent > 0 && cfg.CPUMaxPercent > 0 {
+		return resources.CPUTotalTicks * 1000000.0 * cfg.CPUMaxPercent / 100.0
+	}
+	if cfg.CPULimitPercent > 0 {
+		return resources.CPUTotalTicks * 1000000.0 * cfg.CPULimitPercent / 100.0
+	}
+	return float64(cfg.CPUMHzLimit) * 1000000.0
+}
+
+// memoryLimitBytes is the memory limit applied to the container in bytes, or 0 when memory isn't limited
+func memoryLimitBytes(cfg container.Config) float64 {
+	if !cfg.EnforceMemory {
+		return 0
+	}
+	return float64(uint64(cfg.MemoryMBLimit) * container.MBToBytes)
+}
+
+// ioLimitIOPS is the IOPS limit applied to the container, or 0 when IO isn't limited
+func ioLimitIOPS(cfg container.Config) float64 {
+	if !cfg.EnforceIO {
+		return 0
+	}
+	return float64(cfg.IOMaxIOPS)
+}
+
+// ioLimitBandwidthBytes is the IO bandwidth limit applied to the container, or 0 when IO isn't limited
+func ioLimitBandwidthBytes(cfg container.Config) float64 {
+	if !cfg.EnforceIO {
+		return 0
+	}
+	return float64(cfg.IOMaxBandwidth)
+}
+
+// netLimitBandwidthBytes is the network bandwidth limit applied to the container, or 0 when the network isn't limited
+func netLimitBandwidthBytes(cfg container.Config) float64 {
+	if !cfg.EnforceNetwork {
+		return 0
+	}
+	return float64(cfg.NetMaxBandwidth)
+}
+
+// MetricsTCPConnections enables counting the TCP connections of the container on each scrape
+func MetricsTCPConnections() bool {
+	return envToBool(EnvDamonMetricsTCPConns, false)
+}
+
+// CPUSmoothing returns the weight of the latest sample in the moving average of the cpu percent metrics from DAMON_CPU_SMOOTHING.
+// It returns 0, which disables smoothing, when unset
+func CPUSmoothing() (float64, error) {
+	env := os.Getenv(EnvDamonCPUSmoothing)
+	if env == "" {
+		return 0, nil
+	}
+	alpha, err := strconv.ParseFloat(strings.TrimSpace(env), 64)
+	if err != nil {
+		return 0, errors.Errorf("error parsing environment %s=%s as a number: %v", EnvDamonCPUSmoothing, env, err)
+	}
+	if alpha < 0 || alpha > 1 {
+		return 0, errors.Errorf("invalid %s=%v. It must be between 0 and 1", EnvDamonCPUSmoothing, alpha)
+	}
+	return alpha, nil
+}
+
+// ListenAddress returns the address of the metrics server from DAMON_ADDR or NOMAD_ADDR_damon, or "" when neither is set.
+// With DAMON_METRICS_LOCALHOST_ONLY, an address without a host, e.g. ":8080", listens on the loopback interface only
+func ListenAddress() string {
+	addr := os.Getenv(EnvDamonAddress)
+	if addr == "" {
+		addr = os.Getenv(EnvNomadDamonAddress)
+	}
+	if addr != "" && envToBool(EnvDamonMetricsLocalhost, false) {
+		return localhostAddress(addr)
+	}
+	return addr
+}
+
+// localhostAddress binds addr to 127.0.0.1 when it has no host, which would listen on all interfaces.
+// An explicit host is kept as is
+func localhostAddress(addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || host != "" {
+		return addr
+	}
+	return net.JoinHostPort("127.0.0.1", port)
+}
+
+// metricNameRE matches valid prometheus metric name parts
+var metricNameRE = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// MetricsNamespace returns the prefix of the metric names from DAMON_METRICS_NAMESPACE, or "damon" when unset.
+// Prometheus would reject the metrics of an invalid namespace, so it is an error
+func MetricsNamespace() (string, error) {
+	ns := os.Getenv(EnvDamonMetricsNamespace)
+	if ns == "" {
+		return DefaultMetricsNamespace, nil
+	}
+	if !metricNameRE.MatchString(ns) {
+		return "", errors.Errorf("invalid %s=%s. It must match %s", EnvDamonMetricsNamespace, ns, metricNameRE)
+	}
+	return ns, nil
+}
+
 func MetricsEndpoint() string {
 	if env := os.Getenv(EnvDamonMetricsEndpoint); env != "" {
 		return env
@@ -135,6 +455,24 @@ func MetricsEndpoint() string {
 	return DefaultMetricsEndpoint
 }
 
+// MetricsFile returns the path the metrics are periodically written to from DAMON_METRICS_FILE, or "" when unset
+func MetricsFile() string {
+	return os.Getenv(EnvDamonMetricsFile)
+}
+
+// MetricsFileInterval returns how often the metrics file is written from DAMON_METRICS_FILE_INTERVAL.
+// When it is unset, invalid or not positive, the default is returned, along with the parse error if any
+func MetricsFileInterval() (time.Duration, error) {
+	d, err := envToDuration(DefaultMetricsFileInterval, EnvDamonMetricsFileInterval)
+	if err != nil {
+		return DefaultMetricsFileInterval, err
+	}
+	if d <= 0 {
+		return DefaultMetricsFileInterval, errors.Errorf("invalid %s=%v. It must be positive", EnvDamonMetricsFileInterval, d)
+	}
+	return d, nil
+}
+
 func LoadContainerConfigFromEnvironment() (container.Config, error) {
 	var cfg container.Config
 	cpu, err := envToInt(0, EnvDamonCPULimit, EnvNomadCPULimit)
@@ -145,7 +483,41 @@ func LoadContainerConfigFromEnvironment() (container.Config, error) {
 		cfg.EnforceCPU = envToBool(EnvDamonEnforceCPULimit, true)
 		cfg.CPUMHzLimit = int(cpu)
 	}
-	mem, err := envToInt(0, EnvDamonMemoryLimit, EnvNomadMemoryLimit)
+	// a limit in percent takes precedence over one in MHz, which nomad always sets
+	if env := os.Getenv(EnvDamonCPULimitPercent); env != "" {
+		p, err := strconv.ParseFloat(env, 64)
+		if err != nil {
+			return cfg, fmt.Errorf("error parsing environment %s=%s as a number: %v", EnvDamonCPULimitPercent, env, err)
+		}
+		if p <= 0 || p > 100 {
+			return cfg, errors.Errorf("invalid %s=%s. It must be more than 0 and at most 100", EnvDamonCPULimitPercent, env)
+		}
+		cfg.EnforceCPU = envToBool(EnvDamonEnforceCPULimit, true)
+		cfg.CPULimitPercent = p
+	}
+	switch mode := strings.ToLower(strings.TrimSpace(os.Getenv(EnvDamonCPUEnforceMode))); mode {
+	case "", CPUEnforceModeHardCap:
+		cfg.CPUHardCap = true
+	case CPUEnforceModeWeight:
+		cfg.CPUHardCap = false
+	default:
+		return cfg, errors.Errorf("invalid %s=%s. Expected '%s' or '%s'", EnvDamonCPUEnforceMode, mode, CPUEnforceModeHardCap, CPUEnforceModeWeight)
+	}
+	if cfg.CPUAffinityMask, err = envToAffinityMask(EnvDamonCPUCores, EnvNomadCPUCores); err != nil {
+		return cfg, err
+	}
+	if os.Getenv(EnvDamonSchedulingClass) != "" {
+		class, err := envToInt(0, EnvDamonSchedulingClass)
+		if err != nil {
+			return cfg, err
+		}
+		if class < 0 || class > 9 {
+			return cfg, errors.Errorf("invalid %s=%d. It must be between 0 and 9", EnvDamonSchedulingClass, class)
+		}
+		sc := uint(class)
+		cfg.SchedulingClass = &sc
+	}
+	mem, err := envToMemoryMB(0, EnvDamonMemoryLimit, EnvNomadMemoryLimit)
 	if err != nil {
 		return cfg, err
 	}
@@ -153,10 +525,101 @@ func LoadContainerConfigFromEnvironment() (container.Config, error) {
 		cfg.EnforceMemory = envToBool(EnvDamonEnforceMemoryLimit, true)
 		cfg.MemoryMBLimit = int(mem)
 	}
+	minws, err := envToInt(0, EnvDamonMinWorkingSet)
+	if err != nil {
+		return cfg, err
+	}
+	maxws, err := envToInt(0, EnvDamonMaxWorkingSet)
+	if err != nil {
+		return cfg, err
+	}
+	cfg.MinWorkingSetMB = int(minws)
+	cfg.MaxWorkingSetMB = int(maxws)
+	iops, err := envToInt(0, EnvDamonIOMaxIOPS)
+	if err != nil {
+		return cfg, err
+	}
+	iobw, err := envToInt(0, EnvDamonIOMaxBandwidth)
+	if err != nil {
+		return cfg, err
+	}
+	iobase, err := envToInt(0, EnvDamonIOBaseSize)
+	if err != nil {
+		return cfg, err
+	}
+	if iops < 0 || iobw < 0 || iobase < 0 || iobase > math.MaxUint32 {
+		return cfg, errors.Errorf("invalid IO limits %s=%d %s=%d %s=%d. Limits can't be negative", EnvDamonIOMaxIOPS, iops, EnvDamonIOMaxBandwidth, iobw, EnvDamonIOBaseSize, iobase)
+	}
+	if iops > 0 || iobw > 0 {
+		cfg.EnforceIO = envToBool(EnvDamonEnforceIOLimit, true)
+		cfg.IOMaxIOPS = iops
+		cfg.IOMaxBandwidth = iobw
+		cfg.IOBaseSize = uint32(iobase)
+	}
+	netbw, err := envToInt(0, EnvDamonNetMaxBandwidth)
+	if err != nil {
+		return cfg, err
+	}
+	if netbw < 0 {
+		return cfg, errors.Errorf("invalid %s=%d. Limits can't be negative", EnvDamonNetMaxBandwidth, netbw)
+	}
+	if netbw > 0 {
+		cfg.EnforceNetwork = envToBool(EnvDamonEnforceNetLimit, true)
+		cfg.NetMaxBandwidth = uint64(netbw)
+	}
+	switch sig := strings.ToLower(strings.TrimSpace(os.Getenv(EnvDamonShutdownSignal))); sig {
+	case "", ShutdownSignalCtrlBreak:
+		cfg.ShutdownSignal = win32.CtrlBreakEvent
+	case ShutdownSignalCtrlC:
+		cfg.ShutdownSignal = win32.CtrlCEvent
+	default:
+		return cfg, errors.Errorf("invalid %s=%s. Expected '%s' or '%s'", EnvDamonShutdownSignal, sig, ShutdownSignalCtrlBreak, ShutdownSignalCtrlC)
+	}
+	if cfg.KillGracePeriod, err = envToDuration(0, EnvDamonKillGracePeriod); err != nil {
+		return cfg, err
+	}
+	if cfg.StartTimeout, err = envToDuration(0, EnvDamonStartTimeout); err != nil {
+		return cfg, err
+	}
+	buffer, err := envToInt(0, EnvDamonNotificationBuffer)
+	if err != nil {
+		return cfg, err
+	}
+	if buffer < 0 {
+		return cfg, errors.Errorf("invalid %s=%d. It can't be negative", EnvDamonNotificationBuffer, buffer)
+	}
+	cfg.NotificationBufferSize = int(buffer)
+	cfg.PIDFile = os.Getenv(EnvDamonPIDFile)
+	cp, err := envToInt(0, EnvDamonConsoleCodePage)
+	if err != nil {
+		return cfg, err
+	}
+	if cp < 0 || cp > 65535 {
+		return cfg, errors.Errorf("invalid %s=%d. Code pages are between 0 and 65535", EnvDamonConsoleCodePage, cp)
+	}
+	cfg.ConsoleCodePage = uint32(cp)
 	cfg.RestrictedToken = envToBool(EnvDamonRestrictedToken, false)
+	if cfg.EnvAllowlist, err = envToPatterns(EnvDamonEnvAllow); err != nil {
+		return cfg, err
+	}
+	if cfg.EnvDenylist, err = envToPatterns(EnvDamonEnvDeny); err != nil {
+		return cfg, err
+	}
+	cfg.AllowBreakaway = envToBool(EnvDamonAllowBreakaway, false)
+	cfg.AllowSilentBreakaway = envToBool(EnvDamonAllowSilentBreak, false)
+	// there is nobody to close the error reporting dialog of a crashed task
+	cfg.DieOnUnhandledException = envToBool(EnvDamonDieOnException, true)
 
-	if cfg.EnforceCPU && cfg.CPUMHzLimit < container.MinimumCPUMHz {
+	// a limit in percent doesn't need a limit in MHz, Config.Validate checks it instead
+	if cfg.EnforceCPU && cfg.CPULimitPercent == 0 && !(cfg.CPUMinPercent > 0 && cfg.CPUMaxPercent > 0) && cfg.CPUMHzLimit < container.MinimumCPUMHz {
 		return cfg, errors.Errorf("CPU limit is too low. Minimum CPU MHz is %d - got %d", container.MinimumCPUMHz, cfg.CPUMHzLimit)
 	}
+	// the container warns about a limit above the system's CPU when it isn't strict
+	cfg.StrictCPULimit = envToBool(EnvDamonStrictCPULimit, false)
+	if cfg.StrictCPULimit {
+		if err := cfg.CheckCPULimit(win32.GetSystemResources().CPUTotalTicks); err != nil {
+			return cfg, err
+		}
+	}
 	return cfg, nil
 }
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/jet/damon/container"
+	"github.com/jet/damon/log"
+	"github.com/jet/damon/win32"
+)
+
+// ConfigEndpoint is the path of the endpoint that serves the effective container configuration
+const ConfigEndpoint = "/config"
+
+type configStatus struct {
+	Container container.Config      `json:"container"`
+	System    win32.SystemResources `json:"system"`
+}
+
+// configHandler responds with the container configuration and the system resources it was resolved against.
+// win32.UserLogin never serializes its password
+func configHandler(c *container.Container, resources win32.SystemResources, logger log.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(configStatus{
+			Container: c.Config,
+			System:    resources,
+		}); err != nil {
+			logger.Error(err, "unable to write container configuration")
+		}
+	})
+}
@@ -0,0 +1,154 @@
+// +build windows
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadContainerConfigMalformedEnvironment(t *testing.T) {
+	tests := []struct {
+		env   string
+		value string
+	}{
+		{env: EnvDamonMemoryLimit, value: "512XB"},
+		{env: EnvDamonMemoryLimit, value: "-1"},
+		{env: EnvDamonCPULimit, value: "fast"},
+		{env: EnvDamonCPULimitPercent, value: "200"},
+		{env: EnvDamonIOMaxIOPS, value: "-5"},
+		{env: EnvDamonCPUEnforceMode, value: "soft"},
+		{env: EnvDamonSchedulingClass, value: "-1"},
+		{env: EnvDamonSchedulingClass, value: "12"},
+		{env: EnvDamonNotificationBuffer, value: "-1"},
+	}
+	for _, test := range tests {
+		old, ok := os.LookupEnv(test.env)
+		os.Setenv(test.env, test.value)
+		cfg, err := LoadContainerConfigFromEnvironment()
+		if ok {
+			os.Setenv(test.env, old)
+		} else {
+			os.Unsetenv(test.env)
+		}
+		if err == nil {
+			t.Errorf("%s=%s: expected an error - got %+v", test.env, test.value, cfg)
+		}
+	}
+}
+
+func TestParseMemoryMB(t *testing.T) {
+	tests := []struct {
+		value string
+		mb    int64
+	}{
+		{value: "512", mb: 512},
+		{value: "512MB", mb: 512},
+		{value: "2gb", mb: 2048},
+		{value: "1.5G", mb: 1536},
+		{value: "25%", mb: 4096},
+	}
+	for _, test := range tests {
+		mb, err := parseMemoryMB(test.value, 16*1024*1024)
+		if err != nil {
+			t.Errorf("%s: %v", test.value, err)
+		} else if mb != test.mb {
+			t.Errorf("%s: expected %d MB - got %d", test.value, test.mb, mb)
+		}
+	}
+}
+
+func TestLoadContainerConfigCPULimitPercent(t *testing.T) {
+	for env, value := range map[string]string{
+		EnvDamonCPULimit:        "",
+		EnvNomadCPULimit:        "",
+		EnvDamonCPULimitPercent: "25",
+	} {
+		old, ok := os.LookupEnv(env)
+		os.Setenv(env, value)
+		if ok {
+			defer os.Setenv(env, old)
+		} else {
+			defer os.Unsetenv(env)
+		}
+	}
+	cfg, err := LoadContainerConfigFromEnvironment()
+	if err != nil {
+		t.Fatalf("a limit in percent without a limit in MHz: %v", err)
+	}
+	if !cfg.EnforceCPU || cfg.CPULimitPercent != 25 || cfg.CPUMHzLimit != 0 {
+		t.Fatalf("expected an enforced limit of 25%% - got %+v", cfg)
+	}
+	if err = cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoadContainerConfigLowestSchedulingClass(t *testing.T) {
+	old, ok := os.LookupEnv(EnvDamonSchedulingClass)
+	os.Setenv(EnvDamonSchedulingClass, "0")
+	if ok {
+		defer os.Setenv(EnvDamonSchedulingClass, old)
+	} else {
+		defer os.Unsetenv(EnvDamonSchedulingClass)
+	}
+	cfg, err := LoadContainerConfigFromEnvironment()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.SchedulingClass == nil || *cfg.SchedulingClass != 0 {
+		t.Fatalf("expected scheduling class 0 - got %v", cfg.SchedulingClass)
+	}
+}
+
+func TestWorkingDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "damon-workdir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "file")
+	if err = ioutil.WriteFile(file, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Unsetenv(EnvDamonWorkingDir)
+	tests := []struct {
+		value string
+		valid bool
+	}{
+		{value: "", valid: true},
+		{value: dir, valid: true},
+		{value: file, valid: false},
+		{value: filepath.Join(dir, "missing"), valid: false},
+	}
+	for _, test := range tests {
+		os.Setenv(EnvDamonWorkingDir, test.value)
+		wd, err := WorkingDir()
+		if valid := err == nil; valid != test.valid {
+			t.Errorf("WorkingDir() with %s=%s = %v; expected valid=%t", EnvDamonWorkingDir, test.value, err, test.valid)
+		}
+		if err == nil && wd != test.value {
+			t.Errorf("WorkingDir() = %s; expected %s", wd, test.value)
+		}
+	}
+}
+
+func TestLocalhostAddress(t *testing.T) {
+	tests := []struct {
+		addr     string
+		expected string
+	}{
+		{addr: ":8080", expected: "127.0.0.1:8080"},
+		{addr: "0.0.0.0:8080", expected: "0.0.0.0:8080"},
+		{addr: "10.0.0.5:8080", expected: "10.0.0.5:8080"},
+		{addr: "[::1]:8080", expected: "[::1]:8080"},
+		{addr: "8080", expected: "8080"},
+	}
+	for _, test := range tests {
+		if addr := localhostAddress(test.addr); addr != test.expected {
+			t.Errorf("localhostAddress(%q) = %q; expected %q", test.addr, addr, test.expected)
+		}
+	}
+}
@@ -1,11 +1,16 @@
 package container
 
 import (
+	"crypto/rand"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"os/exec"
-	"runtime"
+	"path"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/jet/damon/log"
@@ -19,31 +24,137 @@ type Config struct {
 	// EnforceMemory if set to true will enable memory quota
 	EnforceMemory bool
 	// RestrictedToken will run the process with restricted privileges
+	// When RunAs is set, the restrictions are applied to the RunAs user's token
 	RestrictedToken bool
+	// AllowBreakaway lets the processes of the job create child processes outside of it
+	// by passing CREATE_BREAKAWAY_FROM_JOB to CreateProcess.
+	// Processes that break away escape every limit of the container and outlive it
+	AllowBreakaway bool
+	// AllowSilentBreakaway makes every child process of the job's processes start outside of it,
+	// as if they had passed CREATE_BREAKAWAY_FROM_JOB. They escape every limit of the container and outlive it
+	AllowSilentBreakaway bool
+	// DieOnUnhandledException terminates processes of the job that crash right away,
+	// instead of leaving them hanging on a Windows Error Reporting dialog nobody will close
+	DieOnUnhandledException bool
+	// RunAs runs the process as this user instead of the user running damon.
+	// The user must have the "Log on as a batch job" right
+	RunAs *win32.UserLogin
+	// EnvAllowlist and EnvDenylist filter the environment variables of the process by name, with path.Match
+	// patterns such as "NOMAD_*" compared case-insensitively. When EnvAllowlist is set, only the variables
+	// it matches are kept, and the variables matched by EnvDenylist are always removed.
+	// The filtered environment is Command.Env when set, or else the RunAs user's environment block
+	// or damon's own environment
+	EnvAllowlist []string
+	EnvDenylist  []string
 	// MemoryMBLimit is the maximum committed memory that the container will allow.
 	// Going over this limit will cause the program to crash with a memory allocation error.
 	MemoryMBLimit int
+	// MinWorkingSetMB and MaxWorkingSetMB bound the physical memory each process of the job keeps resident.
+	// Unlike MemoryMBLimit, pages above the maximum are trimmed to the page file instead of failing allocations.
+	// Both must be set, with MaxWorkingSetMB greater than MinWorkingSetMB. 0 leaves the working set unlimited
+	MinWorkingSetMB int
+	MaxWorkingSetMB int
 	// CPUMHzLimit is the cpu time constraint that when fully enforced
 	CPUMHzLimit int
 	// CPUHardCap enforces a hard cap on the CPU time this process can get
 	// If set to false, then it uses a weight
 	CPUHardCap bool
+	// StrictCPULimit makes Start fail when CPUMHzLimit exceeds the CPU of the system, which wouldn't limit anything.
+	// Otherwise a warning is logged
+	StrictCPULimit bool
+	// CPUMinPercent is the percentage (0-100) of total system CPU reserved for the process.
+	// When EnforceCPU is set and both CPUMinPercent and CPUMaxPercent are set,
+	// min/max rate enforcement is used instead of CPUMHzLimit
+	CPUMinPercent float64
+	// CPUMaxPercent is the percentage (0-100) of total system CPU the process is capped at.
+	CPUMaxPercent float64
+	// CPULimitPercent is the CPU limit as a percentage (0-100) of total system CPU.
+	// Unlike CPUMHzLimit, it doesn't depend on the clock speed of the machine.
+	// It takes precedence over CPUMHzLimit, but not over CPUMinPercent and CPUMaxPercent
+	CPULimitPercent float64
+	// SchedulingClass (0-9) sets the relative time slice the job's processes get
+	// compared to other jobs. nil leaves the system default (5)
+	SchedulingClass *uint
+	// CPUAffinityMask pins the job's processes to the logical processors set in the mask.
+	// 0 lets the processes run on any processor
+	CPUAffinityMask win32.AffinityMask
+	// ShutdownSignal is the console control event sent to the process to request a graceful exit.
+	// Defaults to CTRL_BREAK_EVENT
+	ShutdownSignal win32.ConsoleCtrlEvent
+	// ShutdownTimeout is how long to wait for the process to exit after the ShutdownSignal is sent,
+	// before it is killed. Defaults to win32.DefaultExitTimeout
+	ShutdownTimeout time.Duration
+	// KillGracePeriod is how long to wait for the process to terminate after it has been killed
+	// because it didn't exit gracefully. Defaults to win32.DefaultKillGracePeriod
+	KillGracePeriod time.Duration
+	// StartTimeout is the maximum time to wait for the main thread of the suspended process to run once resumed.
+	// If it elapses, the process is killed along with the job and Start returns an error.
+	// 0 resumes the process without checking that it runs
+	StartTimeout time.Duration
+	// NotificationBufferSize is how many job notifications, such as limit violations, are buffered until they're handled.
+	// 0 uses win32.DefaultNotificationBufferSize
+	NotificationBufferSize int
+	// EnforceIO if set to true will enable IO rate control on the job
+	EnforceIO bool
+	// IOMaxIOPS is the maximum number of IO operations per second. 0 is unlimited
+	IOMaxIOPS int64
+	// IOMaxBandwidth is the maximum IO bandwidth in bytes per second. 0 is unlimited
+	IOMaxBandwidth int64
+	// IOBaseSize is the size, in bytes, of the normalized IO unit that IOMaxIOPS is counted in:
+	// an operation of n * IOBaseSize bytes counts as n operations.
+	// It must be a power of 2 no smaller than MinIOBaseSize. 0 uses the system default
+	IOBaseSize uint32
+	// EnforceNetwork if set to true will enable outgoing network rate control on the job
+	EnforceNetwork bool
+	// NetMaxBandwidth is the maximum outgoing network bandwidth in bytes per second. 0 is unlimited
+	NetMaxBandwidth uint64
+	// ConsoleCodePage sets the input and output code page of the console shared with the process
+	// (e.g. 65001 for UTF-8). It is restored when the process exits. 0 keeps the current code page
+	ConsoleCodePage uint32
+	// PIDFile is the path of a file to write the process ID and the job object name to, one per line.
+	// It is written once the process has started and removed after it exits
+	PIDFile string
+	// UIRestrictions denies the job's processes access to parts of the user interface,
+	// such as the clipboard or the desktop. nil leaves the UI unrestricted
+	UIRestrictions *win32.UIRestrictions
 }
 
 const MBToBytes uint64 = 1024 * 1024
 const MinimumCPUMHz = 100
 
+// MinIOBaseSize is the smallest normalized IO unit, in bytes
+const MinIOBaseSize = 4096
+
 type Container struct {
+	// Name is the name of the job object. A unique name is generated by Start when it is empty
 	Name string
+	// Labels are attached to the job object and logged with its errors, e.g. the nomad job and task names
+	Labels map[string]string
 	Config
 	Logger      log.Logger
 	Command     *exec.Cmd
 	OnStats     OnStatsFn
 	OnViolation OnViolationFn
-	exitCh      <-chan struct{}
-	doneCh      <-chan struct{}
-	job         *win32.JobObject
-	proc        *win32.Process
+	// OnStart is called with the time it took from Start being called to the process running
+	OnStart OnStartFn
+	// OnProcessEvent is called when a process enters or leaves the job and when the job becomes empty
+	OnProcessEvent OnProcessEventFn
+
+	exitCh       chan struct{}
+	doneCh       chan struct{}
+	emptyCh      chan struct{}
+	pollDoneCh   chan struct{}
+	job          *win32.JobObject
+	proc         *win32.Process
+	resumeFn     func(p *win32.Process) error
+	pollFn       func() (*win32.JobObjectNotification, error)
+	prevCP       *win32.ConsoleCodePages
+	startLatency time.Duration
+	ioBaseSize   uint32
+	jobOnce      sync.Once
+	// lastMemory is the memory usage of the process the last time its stats were polled, reported again once it exits
+	lastMemory *MemoryStats
+	statsMu    sync.Mutex
 }
 
 type Result struct {
@@ -53,8 +164,15 @@ type Result struct {
 }
 
 type LimitViolation struct {
-	Type    string
+	Type string
+	// Message describes the violation for humans
 	Message string
+	// Measured and Limit are the measured value and the limit that it exceeded.
+	// For rate violations, they are tolerance levels rather than rates
+	Measured uint64
+	Limit    uint64
+	// Tolerance is the tolerance level that was exceeded for rate violations, 0 otherwise
+	Tolerance win32.JobObjectRateControlTolerance
 }
 
 const (
@@ -63,6 +181,20 @@ const (
 	IOLimitViolation     = "IO"
 )
 
+// ProcessEvent is a change to the set of processes in the container's job object
+type ProcessEvent struct {
+	Type string
+	// PID is the process that started or exited, 0 for JobEmptyEvent
+	PID int
+}
+
+const (
+	ProcessStartedEvent      = "ProcessStarted"
+	ProcessExitedEvent       = "ProcessExited"
+	ProcessAbnormalExitEvent = "ProcessAbnormalExit"
+	JobEmptyEvent            = "JobEmpty"
+)
+
 type ProcessStats struct {
 	CPUStats
 	MemoryStats
@@ -72,7 +204,8 @@ type ProcessStats struct {
 type MemoryStats struct {
 	WorkingSetSizeBytes uint64
 	PrivateUsageBytes   uint64
-	PageFaultCount uint64
+	PagefileUsageBytes  uint64
+	PageFaultCount      uint64
 }
 
 type CPUStats struct {
@@ -80,6 +213,10 @@ type CPUStats struct {
 	TotalCPUTime    time.Duration
 	TotalKernelTime time.Duration
 	TotalUserTime   time.Duration
+	// ThisPeriodKernelTime and ThisPeriodUserTime are the CPU times since the last ResetAccountingPeriod
+	ThisPeriodKernelTime time.Duration
+	ThisPeriodUserTime   time.Duration
+	SchedulingClass      uint
 }
 
 type IOStats struct {
@@ -91,97 +228,189 @@ type IOStats struct {
 	TotalTxReadBytes       uint64
 	TotalTxWrittenBytes    uint64
 	TotalTxOtherBytes      uint64
+	// BaseSizeBytes is the effective normalized IO unit of the IOPS limit, 0 when IO isn't limited
+	BaseSizeBytes uint64
 }
 
 type OnStatsFn func(s ProcessStats)
 type OnViolationFn func(v LimitViolation)
+type OnStartFn func(latency time.Duration)
+type OnProcessEventFn func(e ProcessEvent)
 
 func (c *Container) Start() error {
-	job, err := win32.CreateJobObject(c.Name)
+	begin := time.Now()
+	if err := c.Config.Validate(); err != nil {
+		return errors.Wrapf(err, "container: invalid configuration")
+	}
+	if c.Name == "" {
+		c.Name = uniqueName()
+		c.Logger.Logf("container: no name set, using %s", c.Name)
+	}
+	job, err := win32.CreateBufferedJobObject(c.Name, c.Labels, c.Config.NotificationBufferSize)
 	if err != nil {
 		return errors.Wrapf(err, "unable to get create win32.JobObject")
 	}
 	c.job = job
-	token, err := win32.CurrentProcessToken()
+	token, err := c.processToken()
 	if err != nil {
-		return errors.Wrapf(err, "unable to get current process token")
-	}
-	if c.Config.RestrictedToken {
-		c.Logger.Logln("creating restricted token")
-		rt, err := token.CreateRestrictedToken(win32.TokenRestrictions{
-			DisableMaxPrivilege: true,
-			LUAToken:            true,
-			DisableSIDs: []string{
-				"BUILTIN\\Administrator",
-			},
-		})
-		c.closeLogError(token, "couldn't closed process token")
-		if err != nil {
-			return errors.Wrapf(err, "unable to create restricted token")
-		}
-		token = rt
+		c.releaseJob()
+		return err
 	}
 	defer c.closeLogError(token, "couldn't closed process token")
 
-	// Link up standard in/out
-	c.Command.Stderr = os.Stderr
-	c.Command.Stdout = os.Stdout
-	c.Command.Stdin = os.Stdin
+	if err = c.filterEnvironment(token); err != nil {
+		c.releaseJob()
+		return err
+	}
+	if c.Config.ConsoleCodePage != 0 {
+		c.setConsoleCodePage()
+	}
+	// Link up standard in/out, unless the caller provided them
+	if c.Command.Stderr == nil {
+		c.Command.Stderr = os.Stderr
+	}
+	if c.Command.Stdout == nil {
+		c.Command.Stdout = os.Stdout
+	}
+	if c.Command.Stdin == nil {
+		c.Command.Stdin = os.Stdin
+	}
 
 	proc, err := win32.CreateProcessWithToken(c.Command, token)
 	if err != nil {
+		c.releaseJob()
 		return errors.Wrapf(err, "unable to get create process")
 	}
 	c.proc = proc
+	c.proc.ShutdownEvent = c.Config.ShutdownSignal
+	if c.Config.ShutdownTimeout > 0 {
+		c.proc.ExitTimeout = c.Config.ShutdownTimeout
+	}
+	if c.Config.KillGracePeriod > 0 {
+		c.proc.KillGracePeriod = c.Config.KillGracePeriod
+	}
 	if err = c.proc.StartSuspended(); err != nil {
+		c.releaseJob()
 		return err
 	}
 	if err = job.Assign(proc); err != nil {
 		c.Logger.Error(proc.Kill(), "unable to kill child process")
+		c.releaseJob()
 		return err
 	}
 	eli := &win32.ExtendedLimitInformation{
-		KillOnJobClose: true,
+		KillOnJobClose:          true,
+		BreakawayOK:             c.Config.AllowBreakaway,
+		SilentBreakawayOK:       c.Config.AllowSilentBreakaway,
+		DieOnUnhandledException: c.Config.DieOnUnhandledException,
 	}
 	if c.Config.EnforceMemory {
 		eli.JobMemoryLimit = MBToBytes * uint64(c.Config.MemoryMBLimit)
 	}
+	eli.Basic, err = c.Config.basicLimitInformation()
+	if err = c.killOnError(err); err != nil {
+		c.releaseJob()
+		return errors.Wrapf(err, "container: invalid basic limit configuration")
+	}
 	if err = c.killOnError(job.SetInformation(eli)); err != nil {
-		c.closeLogError(job, "failed to close JobObject")
+		c.releaseJob()
 		return errors.Wrapf(err, "container: Could not set basic limit information")
 	}
+	if c.Config.SchedulingClass != nil {
+		bli := &win32.BasicLimitInformation{}
+		if err := job.GetInformation(bli); err != nil {
+			c.Logger.Error(err, "container: unable to read back scheduling class")
+		} else {
+			c.Logger.Logf("container: scheduling class requested=%d effective=%d", *c.Config.SchedulingClass, bli.SchedulingClass)
+		}
+	}
 	if c.Config.EnforceCPU {
-		if c.Config.CPUMHzLimit < MinimumCPUMHz {
-			return errors.Errorf("CPUMHzLimit is too low. Minimum is %d", MinimumCPUMHz)
+		if err := c.Config.CheckCPULimit(win32.GetSystemResources().CPUTotalTicks); err != nil {
+			if !c.Config.StrictCPULimit {
+				c.Logger.Logf("container: warning: %v", err)
+			} else if err = c.killOnError(err); err != nil {
+				c.releaseJob()
+				return errors.Wrapf(err, "container: invalid cpu rate configuration")
+			}
 		}
-		nli := &win32.NotificationLimitInformation{
-			CPURateLimit: &win32.NotificationRateLimitTolerance{
-				Level: win32.ToleranceLow,
-				Interval: win32.ToleranceIntervalLong,
-			},
+		crci, err := c.Config.cpuRateControlInformation()
+		if err = c.killOnError(err); err != nil {
+			c.releaseJob()
+			return errors.Wrapf(err, "container: invalid cpu rate configuration")
 		}
-		crci := &win32.CPURateControlInformation{
-			Rate: &win32.CPUMaxRateInformation{
-				HardCap: true,
-				Rate: win32.MHzToCPURate(uint64(c.Config.CPUMHzLimit)),
-			},
-			Notify: true,	
+		if err = c.Config.checkCPUClamp(win32.GetSystemResources().CPUTotalTicks); err != nil {
+			c.Logger.Logf("container: warning: %v", err)
 		}
-		if err = c.killOnError(job.SetInformation(nli)); err != nil {
-			c.closeLogError(job, "failed to close JobObject")
-			return errors.Wrapf(err, "container: Could not set cpu notification limits")
+		// rate tolerance notifications are relative to a max rate, so they don't apply to weights
+		if crci.Weight == 0 {
+			nli := &win32.NotificationLimitInformation{
+				CPURateLimit: &win32.NotificationRateLimitTolerance{
+					Level:    win32.ToleranceLow,
+					Interval: win32.ToleranceIntervalLong,
+				},
+			}
+			if err = c.killOnError(job.SetInformation(nli)); err != nil {
+				c.releaseJob()
+				return errors.Wrapf(err, "container: Could not set cpu notification limits")
+			}
 		}
 		if err = c.killOnError(job.SetInformation(crci)); err != nil {
-			c.closeLogError(job, "failed to close JobObject")
+			c.releaseJob()
 			return errors.Wrapf(err, "container: Could not set cpu rate limits")
 		}
 	}
-	if err = c.killOnError(proc.Resume()); err != nil {
-		c.closeLogError(job, "failed to close JobObject")
+	if c.Config.EnforceIO {
+		iorc, err := c.Config.ioRateControlInformation()
+		if err = c.killOnError(err); err != nil {
+			c.releaseJob()
+			return errors.Wrapf(err, "container: invalid io rate configuration")
+		}
+		if err = c.killOnError(job.SetInformation(iorc)); err != nil {
+			c.releaseJob()
+			return errors.Wrapf(err, "container: Could not set io rate limits")
+		}
+		if infos, err := win32.GetIORateControlInformations(job, ""); err != nil {
+			c.Logger.Error(err, "container: unable to read back io rate limits")
+		} else if len(infos) > 0 {
+			c.ioBaseSize = infos[0].BaseIOSize
+			c.Logger.Logf("container: io base size requested=%d effective=%d", c.Config.IOBaseSize, c.ioBaseSize)
+		}
+	}
+	if c.Config.EnforceNetwork {
+		nrc := &win32.NetRateControlInformation{
+			MaxBandwidth: c.Config.NetMaxBandwidth,
+		}
+		if err = c.killOnError(job.SetInformation(nrc)); err != nil {
+			c.releaseJob()
+			return errors.Wrapf(err, "container: Could not set network rate limits")
+		}
+	}
+	if c.Config.UIRestrictions != nil {
+		if err = c.killOnError(job.SetInformation(c.Config.UIRestrictions)); err != nil {
+			c.releaseJob()
+			return errors.Wrapf(err, "container: Could not set UI restrictions")
+		}
+	}
+	if c.Config.PIDFile != "" {
+		if err = c.killOnError(c.writePIDFile()); err != nil {
+			c.releaseJob()
+			return errors.Wrapf(err, "container: Could not write pid file %s", c.Config.PIDFile)
+		}
+	}
+	if err = c.killOnError(c.resume()); err != nil {
+		c.removePIDFile()
+		c.releaseJob()
 		return errors.Wrapf(err, "container: Could not resume process main thread")
 	}
+	c.startLatency = time.Since(begin)
+	c.Logger.Logf("container: process started in %v", c.startLatency)
+	if c.OnStart != nil {
+		c.OnStart(c.startLatency)
+	}
 	c.exitCh = make(chan struct{})
 	c.doneCh = make(chan struct{})
+	c.emptyCh = make(chan struct{})
+	c.pollDoneCh = make(chan struct{})
 	if c.OnStats != nil {
 		go c.pollStats()
 	}
@@ -189,7 +418,473 @@ func (c *Container) Start() error {
 	return nil
 }
 
+// uniqueName returns a job object name that no other damon process uses
+func uniqueName() string {
+	var b [4]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		// the process id alone is unique among running damon processes
+		return fmt.Sprintf("damon-%d", os.Getpid())
+	}
+	return fmt.Sprintf("damon-%d-%x", os.Getpid(), b)
+}
+
+// processToken returns the access token to create the process with.
+// It is the RunAs user's token or the current process token, restricted when RestrictedToken is set
+func (c *Container) processToken() (*win32.Token, error) {
+	var token *win32.Token
+	var err error
+	if login := c.Config.RunAs; login != nil {
+		if login.Username == "" || login.Password == nil {
+			return nil, errors.Errorf("container: RunAs requires a username and password")
+		}
+		c.Logger.Logf("creating batch user token for %s\\%s", login.Domain, login.Username)
+		if token, err = win32.CreateBatchUserToken(*login); err != nil {
+			return nil, errors.Wrapf(err, "unable to log on as %s\\%s", login.Domain, login.Username)
+		}
+	} else if token, err = win32.CurrentProcessToken(); err != nil {
+		return nil, errors.Wrapf(err, "unable to get current process token")
+	}
+	if !c.Config.RestrictedToken {
+		return token, nil
+	}
+	c.Logger.Logln("creating restricted token")
+	rt, err := token.CreateRestrictedToken(win32.TokenRestrictions{
+		DisableMaxPrivilege: true,
+		LUAToken:            true,
+		DisableSIDs: []string{
+			"BUILTIN\\Administrator",
+		},
+	})
+	c.closeLogError(token, "couldn't closed process token")
+	if err != nil {
+		if login := c.Config.RunAs; login != nil {
+			return nil, errors.Wrapf(err, "unable to create restricted token from the token of RunAs user %s\\%s", login.Domain, login.Username)
+		}
+		return nil, errors.Wrapf(err, "unable to create restricted token")
+	}
+	return rt, nil
+}
+
+// filterEnvironment applies EnvAllowlist and EnvDenylist to the environment of the command
+func (c *Container) filterEnvironment(token *win32.Token) error {
+	if len(c.Config.EnvAllowlist) == 0 && len(c.Config.EnvDenylist) == 0 {
+		return nil
+	}
+	env := c.Command.Env
+	if env == nil {
+		if c.Config.RunAs != nil {
+			var err error
+			if env, err = token.Environment(false); err != nil {
+				return errors.Wrapf(err, "unable to get the environment of RunAs user %s\\%s", c.Config.RunAs.Domain, c.Config.RunAs.Username)
+			}
+		} else {
+			env = os.Environ()
+		}
+	}
+	filtered, err := filterEnv(env, c.Config.EnvAllowlist, c.Config.EnvDenylist)
+	if err != nil {
+		return err
+	}
+	c.Logger.Logf("container: passing %d of %d environment variables", len(filtered), len(env))
+	c.Command.Env = filtered
+	return nil
+}
+
+// filterEnv returns the KEY=value pairs of env whose key matches a pattern of allow, when it isn't empty,
+// and no pattern of deny
+func filterEnv(env []string, allow []string, deny []string) ([]string, error) {
+	filtered := []string{}
+	for _, kv := range env {
+		if kv == "" {
+			continue
+		}
+		key := kv
+		if i := strings.Index(kv[1:], "="); i >= 0 {
+			// variables such as "=C:" hold the current directory of each drive and start with '='
+			key = kv[:i+1]
+		}
+		allowed, err := matchEnv(key, allow)
+		if err != nil {
+			return nil, err
+		}
+		if len(allow) > 0 && !allowed {
+			continue
+		}
+		denied, err := matchEnv(key, deny)
+		if err != nil {
+			return nil, err
+		}
+		if !denied {
+			filtered = append(filtered, kv)
+		}
+	}
+	return filtered, nil
+}
+
+// matchEnv returns true when the environment variable name matches one of the patterns, ignoring case
+func matchEnv(name string, patterns []string) (bool, error) {
+	for _, p := range patterns {
+		ok, err := path.Match(strings.ToUpper(p), strings.ToUpper(name))
+		if err != nil {
+			return false, errors.Wrapf(err, "invalid environment variable pattern %q", p)
+		}
+		if ok {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// setConsoleCodePage sets the code page of damon's console, which the process inherits.
+// Failures are logged because damon may run without a console
+func (c *Container) setConsoleCodePage() {
+	prev, err := win32.GetConsoleCodePages()
+	if err != nil {
+		c.Logger.Error(err, "container: unable to get console code page")
+		return
+	}
+	cp := c.Config.ConsoleCodePage
+	if err = win32.SetConsoleCodePages(win32.ConsoleCodePages{Input: cp, Output: cp}); err != nil {
+		c.Logger.Error(err, "container: unable to set console code page")
+		return
+	}
+	c.Logger.Logf("container: console code page set to %d (was %d/%d)", cp, prev.Input, prev.Output)
+	c.prevCP = &prev
+}
+
+func (c *Container) restoreConsoleCodePage() {
+	if c.prevCP == nil {
+		return
+	}
+	if err := win32.SetConsoleCodePages(*c.prevCP); err != nil {
+		c.Logger.Error(err, "container: unable to restore console code page")
+	}
+	c.prevCP = nil
+}
+
+// writePIDFile atomically writes the process ID and job object name to PIDFile
+func (c *Container) writePIDFile() error {
+	tmp := c.Config.PIDFile + ".tmp"
+	data := fmt.Sprintf("%d\n%s\n", c.proc.Pid(), c.Name)
+	if err := ioutil.WriteFile(tmp, []byte(data), 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, c.Config.PIDFile); err != nil {
+		if rerr := os.Remove(tmp); rerr != nil {
+			c.Logger.Error(rerr, "container: failed to remove temporary pid file")
+		}
+		return err
+	}
+	return nil
+}
+
+func (c *Container) removePIDFile() {
+	if c.Config.PIDFile == "" {
+		return
+	}
+	if err := os.Remove(c.Config.PIDFile); err != nil && !os.IsNotExist(err) {
+		c.Logger.Error(err, "container: failed to remove pid file")
+	}
+}
+
+// resume resumes the suspended process main thread.
+// With a StartTimeout, it then waits for the main thread to run, since resuming can succeed on another thread
+func (c *Container) resume() error {
+	resumeFn := c.resumeFn
+	if resumeFn == nil {
+		resumeFn = (*win32.Process).Resume
+	}
+	if err := resumeFn(c.proc); err != nil {
+		return err
+	}
+	if c.Config.StartTimeout <= 0 {
+		return nil
+	}
+	return c.waitRunning(c.Config.StartTimeout)
+}
+
+// startPollInterval is how often waitRunning checks the main thread of the process
+const startPollInterval = 10 * time.Millisecond
+
+// waitRunning waits for the main thread of the process to be no longer suspended, giving up after timeout.
+// A process that already exited ran
+func (c *Container) waitRunning(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		suspended, err := c.proc.MainThreadSuspended()
+		if err == nil && !suspended {
+			return nil
+		}
+		if err != nil {
+			if pt, terr := c.proc.Times(); terr == nil && !pt.ExitTime.IsZero() {
+				return nil
+			}
+		}
+		if time.Now().After(deadline) {
+			if err != nil {
+				return errors.Wrapf(err, "process did not start within %v", timeout)
+			}
+			return errors.Errorf("process did not start within %v: its main thread is still suspended", timeout)
+		}
+		time.Sleep(startPollInterval)
+	}
+}
+
+// cpuRateControlInformation builds the CPU rate control settings for the job object.
+// Min/max rate enforcement takes precedence when both percentages are set,
+// otherwise CPUMHzLimit is converted to a hard-capped max rate when CPUHardCap is set,
+// or to a relative weight when it isn't.
+func (cfg Config) cpuRateControlInformation() (*win32.CPURateControlInformation, error) {
+	if cfg.CPUMinPercent > 0 && cfg.CPUMaxPercent > 0 {
+		if cfg.CPUMaxPercent > 100 {
+			return nil, errors.Errorf("CPUMaxPercent must be <= 100 - got %.2f", cfg.CPUMaxPercent)
+		}
+		if cfg.CPUMinPercent > cfg.CPUMaxPercent {
+			return nil, errors.Errorf("CPUMinPercent (%.2f) must be <= CPUMaxPercent (%.2f)", cfg.CPUMinPercent, cfg.CPUMaxPercent)
+		}
+		return &win32.CPURateControlInformation{
+			MinMax: &win32.CPURateMinMaxInformation{
+				MinRate: int(percentToCPURate(cfg.CPUMinPercent)),
+				MaxRate: int(percentToCPURate(cfg.CPUMaxPercent)),
+			},
+			Notify: true,
+		}, nil
+	}
+	if cfg.CPULimitPercent > 0 {
+		if cfg.CPULimitPercent > 100 {
+			return nil, errors.Errorf("CPULimitPercent must be <= 100 - got %.2f", cfg.CPULimitPercent)
+		}
+		if !cfg.CPUHardCap {
+			return &win32.CPURateControlInformation{
+				Weight: percentToWeight(cfg.CPULimitPercent),
+			}, nil
+		}
+		return &win32.CPURateControlInformation{
+			Rate: &win32.CPUMaxRateInformation{
+				HardCap: true,
+				Rate:    percentToCPURate(cfg.CPULimitPercent),
+			},
+			Notify: true,
+		}, nil
+	}
+	if cfg.CPUMHzLimit < MinimumCPUMHz {
+		return nil, errors.Errorf("CPUMHzLimit is too low. Minimum is %d", MinimumCPUMHz)
+	}
+	if !cfg.CPUHardCap {
+		return &win32.CPURateControlInformation{
+			Weight: win32.MHzToWeight(uint64(cfg.CPUMHzLimit)),
+		}, nil
+	}
+	return &win32.CPURateControlInformation{
+		Rate: &win32.CPUMaxRateInformation{
+			HardCap: true,
+			Rate:    win32.MHzToCPURate(uint64(cfg.CPUMHzLimit)),
+		},
+		Notify: true,
+	}, nil
+}
+
+// CheckCPULimit returns an error when the CPUMHzLimit is enforced but exceeds totalMHz, the CPU of the whole system,
+// in which case the process is effectively unlimited. It doesn't check a limit in percent, nor an unknown total
+func (cfg Config) CheckCPULimit(totalMHz float64) error {
+	if !cfg.EnforceCPU || (cfg.CPUMinPercent > 0 && cfg.CPUMaxPercent > 0) || cfg.CPULimitPercent > 0 || totalMHz <= 0 {
+		return nil
+	}
+	if float64(cfg.CPUMHzLimit) > totalMHz {
+		return errors.Errorf("CPU limit of %d MHz exceeds the %.0f MHz of the system and won't limit the process", cfg.CPUMHzLimit, totalMHz)
+	}
+	return nil
+}
+
+// checkCPUClamp returns an error when the CPU limit is below the lowest rate or weight of the job object,
+// in which case the process runs with a higher limit than the one configured. totalMHz is the CPU of the whole system.
+// Min/max percentages and a limit in MHz with an unknown total aren't checked
+func (cfg Config) checkCPUClamp(totalMHz float64) error {
+	var requested string
+	var share float64 // the configured share of the system cpu
+	switch {
+	case cfg.CPUMinPercent > 0 && cfg.CPUMaxPercent > 0:
+		return nil
+	case cfg.CPULimitPercent > 0:
+		requested = fmt.Sprintf("%.2f%%", cfg.CPULimitPercent)
+		share = cfg.CPULimitPercent / 100
+	case cfg.CPUMHzLimit > 0 && totalMHz > 0:
+		requested = fmt.Sprintf("%d MHz", cfg.CPUMHzLimit)
+		share = float64(cfg.CPUMHzLimit) / totalMHz
+	default:
+		return nil
+	}
+	if cfg.CPUHardCap {
+		if share*float64(win32.MaxCPURate) < float64(win32.MinCPURate) {
+			return errors.Errorf("CPU limit of %s is below the minimum cpu rate and is raised to %.2f%% of the system", requested, cpuRateToPercent(win32.MinCPURate))
+		}
+		return nil
+	}
+	if share*float64(win32.MaxWeight) < float64(win32.MinWeight) {
+		return errors.Errorf("CPU limit of %s is below the minimum cpu weight and is raised to a weight of %d out of %d", requested, win32.MinWeight, win32.MaxWeight)
+	}
+	return nil
+}
+
+// ConfigErrors lists every problem found by Config.Validate
+type ConfigErrors []error
+
+func (e ConfigErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// Validate checks the configuration against its invariants and the resources of the system.
+// It returns ConfigErrors with every problem found, or nil
+func (cfg Config) Validate() error {
+	return cfg.validate(win32.GetSystemResources())
+}
+
+func (cfg Config) validate(resources win32.SystemResources) error {
+	var errs ConfigErrors
+	if cfg.EnforceCPU {
+		minMax := cfg.CPUMinPercent > 0 || cfg.CPUMaxPercent > 0
+		if minMax && (cfg.CPUMinPercent <= 0 || cfg.CPUMaxPercent <= 0) {
+			errs = append(errs, errors.Errorf("CPUMinPercent and CPUMaxPercent must be set together - got %.2f and %.2f", cfg.CPUMinPercent, cfg.CPUMaxPercent))
+		}
+		if minMax && cfg.CPULimitPercent > 0 {
+			errs = append(errs, errors.Errorf("CPULimitPercent can't be set with CPUMinPercent and CPUMaxPercent"))
+		}
+		if _, err := cfg.cpuRateControlInformation(); err != nil {
+			errs = append(errs, err)
+		}
+		if cfg.StrictCPULimit {
+			if err := cfg.CheckCPULimit(resources.CPUTotalTicks); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	if cfg.EnforceMemory && cfg.MemoryMBLimit <= 0 {
+		errs = append(errs, errors.Errorf("MemoryMBLimit must be > 0 when memory is enforced - got %d", cfg.MemoryMBLimit))
+	}
+	if _, err := cfg.basicLimitInformation(); err != nil {
+		errs = append(errs, err)
+	}
+	if cfg.SchedulingClass != nil && *cfg.SchedulingClass > 9 {
+		errs = append(errs, errors.Errorf("SchedulingClass must be <= 9 - got %d", *cfg.SchedulingClass))
+	}
+	if resources.CPUNumCores > 0 {
+		for _, core := range cfg.CPUAffinityMask.Cores() {
+			if core >= resources.CPUNumCores {
+				errs = append(errs, errors.Errorf("CPU core %d doesn't exist, the system has %d cores", core, resources.CPUNumCores))
+			}
+		}
+	}
+	if cfg.EnforceIO {
+		if _, err := cfg.ioRateControlInformation(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+// basicLimitInformation returns the basic limits of the job, nil when none is set
+func (cfg Config) basicLimitInformation() (*win32.BasicLimitInformation, error) {
+	if cfg.MinWorkingSetMB < 0 || cfg.MaxWorkingSetMB < 0 {
+		return nil, errors.Errorf("working set limits can't be negative - got min=%d max=%d", cfg.MinWorkingSetMB, cfg.MaxWorkingSetMB)
+	}
+	if (cfg.MinWorkingSetMB != 0 || cfg.MaxWorkingSetMB != 0) && (cfg.MinWorkingSetMB == 0 || cfg.MaxWorkingSetMB <= cfg.MinWorkingSetMB) {
+		return nil, errors.Errorf("MaxWorkingSetMB (%d) must be > MinWorkingSetMB (%d) > 0", cfg.MaxWorkingSetMB, cfg.MinWorkingSetMB)
+	}
+	if cfg.SchedulingClass == nil && cfg.CPUAffinityMask == 0 && cfg.MaxWorkingSetMB == 0 {
+		return nil, nil
+	}
+	// sizes in MB are always page aligned
+	bli := &win32.BasicLimitInformation{
+		ProcessorAffinity: uint64(cfg.CPUAffinityMask),
+		MinWorkingSetSize: int64(cfg.MinWorkingSetMB) * int64(MBToBytes),
+		MaxWorkingSetSize: int64(cfg.MaxWorkingSetMB) * int64(MBToBytes),
+	}
+	if cfg.SchedulingClass != nil {
+		bli.SchedulingClass = *cfg.SchedulingClass
+		bli.LimitSchedulingClass = true
+	}
+	return bli, nil
+}
+
+// ioRateControlInformation builds the IO rate control settings for the job object
+func (cfg Config) ioRateControlInformation() (*win32.IORateControlInformation, error) {
+	if b := cfg.IOBaseSize; b != 0 && (b < MinIOBaseSize || b&(b-1) != 0) {
+		return nil, errors.Errorf("IOBaseSize must be a power of 2 >= %d - got %d", MinIOBaseSize, b)
+	}
+	return &win32.IORateControlInformation{
+		MaxIOPS:      cfg.IOMaxIOPS,
+		MaxBandwidth: cfg.IOMaxBandwidth,
+		BaseIOSize:   cfg.IOBaseSize,
+	}, nil
+}
+
+// cpuRateToPercent converts a cpu rate, in 1/100ths of a percent, to a percentage
+func cpuRateToPercent(rate uint) float64 {
+	return float64(rate) / 100.0
+}
+
+// percentToCPURate converts a percentage (0-100) to the 1-10000 scale used by the job object cpu rate
+func percentToCPURate(p float64) uint {
+	// compare as a float so a negative percentage doesn't wrap around
+	rate := p * 100.0
+	if rate > float64(win32.MaxCPURate) {
+		return win32.MaxCPURate
+	}
+	if rate < float64(win32.MinCPURate) {
+		return win32.MinCPURate
+	}
+	return uint(rate)
+}
+
+func percentToWeight(p float64) uint {
+	weight := p / 100.0 * float64(win32.MaxWeight)
+	if weight > float64(win32.MaxWeight) {
+		return win32.MaxWeight
+	}
+	if weight < float64(win32.MinWeight) {
+		return win32.MinWeight
+	}
+	return uint(weight)
+}
+
+// MaxPollErrors is how many consecutive errors polling the job notifications takes to stop polling them,
+// since the completion port is then most likely broken for good
+const MaxPollErrors = 10
+
+const (
+	minPollBackoff = 10 * time.Millisecond
+	maxPollBackoff = 1 * time.Second
+)
+
+// pollBackoff is how long to wait before polling again after the given number of consecutive errors.
+// It doubles with each error, up to maxPollBackoff
+func pollBackoff(errCount int) time.Duration {
+	d := minPollBackoff
+	for i := 1; i < errCount && d < maxPollBackoff; i++ {
+		d *= 2
+	}
+	if d > maxPollBackoff {
+		return maxPollBackoff
+	}
+	return d
+}
+
+// pollNotifications reports the job notifications until the container exits.
+// pollDoneCh is closed when it returns, so that waitJobEmpty doesn't wait for a notification that won't be reported
 func (c *Container) pollNotifications() {
+	defer close(c.pollDoneCh)
+	pollFn := c.pollFn
+	if pollFn == nil {
+		pollFn = c.job.PollNotifications
+	}
+	errCount := 0
 	for {
 		select {
 		case <-c.exitCh:
@@ -198,51 +893,118 @@ func (c *Container) pollNotifications() {
 			return
 		default:
 		}
-		info, err := c.job.PollNotifications()
+		info, err := pollFn()
+		if errors.Cause(err) == win32.ErrNotificationsUnavailable {
+			c.Logger.Error(err, "container: limit violations will not be reported")
+			return
+		}
+		if err == win32.ErrJobObjectClosed {
+			return
+		}
 		if err != nil {
+			errCount++
+			if errCount >= MaxPollErrors {
+				c.Logger.Error(err, fmt.Sprintf("container: giving up polling notifications after %d consecutive errors, limit violations will not be reported", errCount))
+				c.job.StopNotifications()
+				return
+			}
 			c.Logger.Error(err, "container: poll notifications error")
+			select {
+			case <-c.exitCh:
+				return
+			case <-c.doneCh:
+				return
+			case <-time.After(pollBackoff(errCount)):
+			}
 			continue
 		}
+		errCount = 0
 		if info.Code == win32.JobObjectMsgNotificationLimit { // Limit violation
-			var violations []LimitViolation
-			if vi := info.LimitViolationInfo; vi != nil {
-				if vi.CPURateViolation != nil {
-					tolerance := ""
-					switch vi.CPURateViolation.Limit {
-					case 1:
-						tolerance = " > 20% of the time"
-					case 2:
-						tolerance = " > 40% of the time"
-					case 3:
-						tolerance = " > 60% of the time"
-					}
-					violations = append(violations, LimitViolation{
-						Type:    CPULimitViolation,
-						Message: fmt.Sprintf("CPU Rate exceeded threshold%s", tolerance),
-					})
-				}
-				if vi.IORateViolation != nil {
-					violations = append(violations, LimitViolation{
-						Type:    IOLimitViolation,
-						Message: fmt.Sprintf("IO Rate exceeded threshold: %d > %d", vi.IORateViolation.Measured, vi.IORateViolation.Limit),
-					})
-				}
-				if vi.HighMemoryViolation != nil {
-					violations = append(violations, LimitViolation{
-						Type:    MemoryLimitViolation,
-						Message: fmt.Sprintf("Memory exceeded threshold: %d > %d", vi.HighMemoryViolation.Measured, vi.HighMemoryViolation.Limit),
-					})
-				}
-			}
+			violations := limitViolations(info.LimitViolationInfo)
 			if c.OnViolation != nil {
 				for _, v := range violations {
 					c.OnViolation(v)
 				}
 			}
+			continue
+		}
+		e, ok := processEvent(info)
+		if !ok {
+			continue
+		}
+		if c.OnProcessEvent != nil {
+			c.OnProcessEvent(e)
+		}
+		if e.Type == JobEmptyEvent {
+			select {
+			case <-c.emptyCh:
+			default:
+				close(c.emptyCh)
+			}
 		}
 	}
 }
 
+// processEvent converts a process notification, ok is false for other notifications
+func processEvent(info *win32.JobObjectNotification) (e ProcessEvent, ok bool) {
+	switch info.Code {
+	case win32.JobObjectMsgNewProcess:
+		return ProcessEvent{Type: ProcessStartedEvent, PID: info.ProcessID}, true
+	case win32.JobObjectMsgExitProcess:
+		return ProcessEvent{Type: ProcessExitedEvent, PID: info.ProcessID}, true
+	case win32.JobObjectMsgAbnormalExitProcess:
+		return ProcessEvent{Type: ProcessAbnormalExitEvent, PID: info.ProcessID}, true
+	case win32.JobObjectMsgActiveProcessZero:
+		return ProcessEvent{Type: JobEmptyEvent}, true
+	}
+	return ProcessEvent{}, false
+}
+
+// limitViolations converts the violations of a limit notification
+func limitViolations(vi *win32.LimitViolationInfo) []LimitViolation {
+	var violations []LimitViolation
+	if vi == nil {
+		return violations
+	}
+	if vi.CPURateViolation != nil {
+		level := win32.JobObjectRateControlTolerance(vi.CPURateViolation.Limit)
+		tolerance := ""
+		if level >= win32.ToleranceLow && level <= win32.ToleranceHigh {
+			tolerance = fmt.Sprintf(" > %v of the time", level)
+		}
+		violations = append(violations, LimitViolation{
+			Type:      CPULimitViolation,
+			Message:   fmt.Sprintf("CPU Rate exceeded threshold%s", tolerance),
+			Measured:  vi.CPURateViolation.Measured,
+			Limit:     vi.CPURateViolation.Limit,
+			Tolerance: level,
+		})
+	}
+	if vi.IORateViolation != nil {
+		level := win32.JobObjectRateControlTolerance(vi.IORateViolation.Limit)
+		tolerance := ""
+		if level >= win32.ToleranceLow && level <= win32.ToleranceHigh {
+			tolerance = fmt.Sprintf(" > %v of the time", level)
+		}
+		violations = append(violations, LimitViolation{
+			Type:      IOLimitViolation,
+			Message:   fmt.Sprintf("IO Rate exceeded threshold%s", tolerance),
+			Measured:  vi.IORateViolation.Measured,
+			Limit:     vi.IORateViolation.Limit,
+			Tolerance: level,
+		})
+	}
+	if vi.HighMemoryViolation != nil {
+		violations = append(violations, LimitViolation{
+			Type:     MemoryLimitViolation,
+			Message:  fmt.Sprintf("Memory exceeded threshold: %d > %d", vi.HighMemoryViolation.Measured, vi.HighMemoryViolation.Limit),
+			Measured: vi.HighMemoryViolation.Measured,
+			Limit:    vi.HighMemoryViolation.Limit,
+		})
+	}
+	return violations
+}
+
 func (c *Container) pollStats() {
 	for {
 		select {
@@ -251,40 +1013,13 @@ func (c *Container) pollStats() {
 		case <-c.doneCh:
 			return
 		case <-time.After(10 * time.Second):
-			info := &win32.JobObjectBasicAndIOAccounting{}
-			if err := c.job.GetInformation(info); err != nil {
-				c.Logger.Error(err, "container: get JobObjectBasicAndIOAccounting error")
-				continue
-			}
-			meminfo, err := c.proc.MemoryInfo()
+			stats, err := c.stats(time.Time{})
 			if err != nil {
-				c.Logger.Error(err, "container: get proc.MemoryInfo error")
+				if !isJobClosed(err) {
+					c.Logger.Error(err, "container: get stats error")
+				}
 				continue
 			}
-			procTime := time.Since(c.proc.StartTime())
-			stats := ProcessStats{
-				CPUStats: CPUStats{
-					TotalRunTime:    procTime,
-					TotalCPUTime:    procTime * time.Duration(runtime.NumCPU()),
-					TotalKernelTime: info.Basic.TotalKernelTime,
-					TotalUserTime:   info.Basic.TotalUserTime,
-				},
-				MemoryStats: MemoryStats{
-					WorkingSetSizeBytes: meminfo.WorkingSetSize,
-					PrivateUsageBytes:   meminfo.PrivateUsage,
-					PageFaultCount: uint64(meminfo.PageFaultCount),
-				},
-				IOStats: IOStats{
-					TotalIOOperations:      info.IO.OtherOperationCount + info.IO.ReadOperationCount + info.IO.WriteOperationCount,
-					TotalOtherIOOperations: info.IO.OtherOperationCount,
-					TotalReadIOOperations:  info.IO.ReadOperationCount,
-					TotalWriteIOOperations: info.IO.WriteOperationCount,
-					TotalTxReadBytes:       info.IO.ReadTransferCount,
-					TotalTxWrittenBytes:    info.IO.WriteTransferCount,
-					TotalTxOtherBytes:      info.IO.OtherTransferCount,
-					TotalTxCountBytes:      info.IO.ReadTransferCount + info.IO.WriteTransferCount + info.IO.OtherTransferCount,
-				},
-			}
 			if c.OnStats != nil {
 				c.OnStats(stats)
 			}
@@ -292,12 +1027,251 @@ func (c *Container) pollStats() {
 	}
 }
 
+// stats reads the accounting of the job and the memory usage of the main process.
+// When end is set, the process exited at that time: its memory is released, so the memory stats are the last ones polled
+func (c *Container) stats(end time.Time) (ProcessStats, error) {
+	info := &win32.JobObjectBasicAndIOAccounting{}
+	if err := c.job.GetInformation(info); err != nil {
+		return ProcessStats{}, errors.Wrapf(err, "container: get JobObjectBasicAndIOAccounting error")
+	}
+	var mem MemoryStats
+	if end.IsZero() {
+		meminfo, err := c.proc.MemoryInfo()
+		if err != nil {
+			return ProcessStats{}, errors.Wrapf(err, "container: get proc.MemoryInfo error")
+		}
+		mem = MemoryStats{
+			WorkingSetSizeBytes: meminfo.WorkingSetSize,
+			PrivateUsageBytes:   meminfo.PrivateUsage,
+			PagefileUsageBytes:  meminfo.PagefileUsage,
+			PageFaultCount:      uint64(meminfo.PageFaultCount),
+		}
+		c.statsMu.Lock()
+		c.lastMemory = &mem
+		c.statsMu.Unlock()
+		end = time.Now()
+	} else {
+		mem = c.finalMemoryStats()
+	}
+	limits := &win32.BasicLimitInformation{}
+	if err := c.job.GetInformation(limits); err != nil {
+		c.Logger.Error(err, "container: get BasicLimitInformation error")
+	}
+	procTime := end.Sub(c.proc.StartTime())
+	// damon's own affinity (runtime.NumCPU) may differ from the cores available to the process
+	cores := win32.GetSystemResources().CPUNumCores
+	return ProcessStats{
+		CPUStats: CPUStats{
+			TotalRunTime:         procTime,
+			TotalCPUTime:         procTime * time.Duration(cores),
+			TotalKernelTime:      info.Basic.TotalKernelTime,
+			TotalUserTime:        info.Basic.TotalUserTime,
+			ThisPeriodKernelTime: info.Basic.ThisPeriodTotalKernelTime,
+			ThisPeriodUserTime:   info.Basic.ThisPeriodTotalUserTime,
+			SchedulingClass:      limits.SchedulingClass,
+		},
+		MemoryStats: mem,
+		IOStats: IOStats{
+			TotalIOOperations:      info.IO.OtherOperationCount + info.IO.ReadOperationCount + info.IO.WriteOperationCount,
+			TotalOtherIOOperations: info.IO.OtherOperationCount,
+			TotalReadIOOperations:  info.IO.ReadOperationCount,
+			TotalWriteIOOperations: info.IO.WriteOperationCount,
+			TotalTxReadBytes:       info.IO.ReadTransferCount,
+			TotalTxWrittenBytes:    info.IO.WriteTransferCount,
+			TotalTxOtherBytes:      info.IO.OtherTransferCount,
+			TotalTxCountBytes:      info.IO.ReadTransferCount + info.IO.WriteTransferCount + info.IO.OtherTransferCount,
+			BaseSizeBytes:          uint64(c.ioBaseSize),
+		},
+	}, nil
+}
+
+// finalMemoryStats returns the memory stats of the process that exited: the last ones polled,
+// or the peak committed memory of the processes of the job when it exited before its stats were polled
+func (c *Container) finalMemoryStats() MemoryStats {
+	c.statsMu.Lock()
+	last := c.lastMemory
+	c.statsMu.Unlock()
+	if last != nil {
+		return *last
+	}
+	peak, _, err := c.job.PeakMemoryUsed()
+	if err != nil {
+		c.Logger.Error(err, "container: unable to read the peak memory of the process")
+		return MemoryStats{}
+	}
+	return MemoryStats{
+		PrivateUsageBytes:  peak,
+		PagefileUsageBytes: peak,
+	}
+}
+
+// flushStats reports the stats at the time the process exited, which the periodic poll would miss
+func (c *Container) flushStats(end time.Time) {
+	if c.OnStats == nil {
+		return
+	}
+	stats, err := c.stats(end)
+	if err != nil {
+		// a killed container has no stats left to read
+		if !isJobClosed(err) {
+			c.Logger.Error(err, "container: unable to read the final stats")
+		}
+		return
+	}
+	c.OnStats(stats)
+}
+
+// AdjustCPUCap changes the CPU cap of the running job by deltaPercent percentage points of total system CPU.
+// The new cap is bounded to the range the job object allows, and never goes below the minimum of a min/max rate.
+// It returns the effective cap, in percent, after the change
+func (c *Container) AdjustCPUCap(deltaPercent float64) (float64, error) {
+	if c.job == nil {
+		return 0, errors.Errorf("container: not started")
+	}
+	crci := &win32.CPURateControlInformation{}
+	if err := c.job.GetInformation(crci); err != nil {
+		return 0, errors.Wrapf(err, "container: could not query cpu rate control information")
+	}
+	switch {
+	case crci.Rate != nil:
+		crci.Rate.Rate = percentToCPURate(cpuRateToPercent(crci.Rate.Rate) + deltaPercent)
+	case crci.MinMax != nil:
+		rate := percentToCPURate(cpuRateToPercent(uint(crci.MinMax.MaxRate)) + deltaPercent)
+		if int(rate) < crci.MinMax.MinRate {
+			rate = uint(crci.MinMax.MinRate)
+		}
+		crci.MinMax.MaxRate = int(rate)
+	case crci.Weight != 0:
+		return 0, errors.Errorf("container: cpu is shared by weight and has no cap to adjust")
+	default:
+		return 0, errors.Errorf("container: cpu rate control is not enabled")
+	}
+	if err := c.job.SetInformation(crci); err != nil {
+		return 0, errors.Wrapf(err, "container: could not set cpu rate control information")
+	}
+	if err := c.job.GetInformation(crci); err != nil {
+		return 0, errors.Wrapf(err, "container: could not query cpu rate control information")
+	}
+	if crci.MinMax != nil {
+		return cpuRateToPercent(uint(crci.MinMax.MaxRate)), nil
+	}
+	if crci.Rate != nil {
+		return cpuRateToPercent(crci.Rate.Rate), nil
+	}
+	return 0, errors.Errorf("container: cpu rate control was disabled")
+}
+
+// ResetAccountingPeriod starts a new accounting period for the job,
+// so CPUStats.ThisPeriodKernelTime and ThisPeriodUserTime count from zero again
+func (c *Container) ResetAccountingPeriod() error {
+	if c.job == nil {
+		return errors.Errorf("container: not started")
+	}
+	return errors.Wrapf(c.job.SetInformation(&win32.AccountingPeriodReset{}), "container: could not reset accounting period")
+}
+
+// ProcessIDs returns the IDs of all the processes running in the container,
+// including the contained process and its children
+func (c *Container) ProcessIDs() ([]uint32, error) {
+	if c.job == nil {
+		return nil, errors.Errorf("container: not started")
+	}
+	return c.job.ProcessIDs()
+}
+
+// ErrSignalNotSupported is returned by Signal for signals that have no equivalent on Windows
+var ErrSignalNotSupported = errors.New("container: signal can't be delivered on Windows")
+
+// Signal delivers sig to the contained process, as far as Windows allows.
+// os.Interrupt sends the ShutdownSignal console control event and returns without waiting.
+// SIGTERM sends the ShutdownSignal event, kills the process if it hasn't exited within its exit timeout,
+// and blocks until it has exited. os.Kill kills the process immediately.
+// Any other signal returns ErrSignalNotSupported
+func (c *Container) Signal(sig os.Signal) error {
+	if c.proc == nil {
+		return errors.Errorf("container: not started")
+	}
+	switch sig {
+	case os.Interrupt:
+		return c.proc.SendConsoleCtrlEvent(c.proc.ShutdownEvent)
+	case syscall.SIGTERM:
+		return c.proc.ShutdownWithGrace(c.proc.ExitTimeout, c.proc.KillGracePeriod)
+	case os.Kill:
+		return c.proc.Kill()
+	}
+	return errors.Wrapf(ErrSignalNotSupported, "%v", sig)
+}
+
+// Suspend pauses every thread of the contained process, e.g. to inspect it, until Resume is called.
+// Child processes keep running
+func (c *Container) Suspend() error {
+	if c.proc == nil {
+		return errors.Errorf("container: not started")
+	}
+	return c.proc.Suspend()
+}
+
+// Resume continues the process paused by Suspend
+func (c *Container) Resume() error {
+	if c.proc == nil {
+		return errors.Errorf("container: not started")
+	}
+	return c.proc.Resume()
+}
+
+// Pid returns the process ID of the contained process
+func (c *Container) Pid() uint32 {
+	if c.proc == nil {
+		return 0
+	}
+	return c.proc.Pid()
+}
+
+// Running returns true when the container has started and its process hasn't exited
+func (c *Container) Running() bool {
+	if c.doneCh == nil {
+		return false
+	}
+	select {
+	case <-c.doneCh:
+		return false
+	default:
+		return true
+	}
+}
+
+// StartLatency returns the time it took from Start being called to the process running
+func (c *Container) StartLatency() time.Duration {
+	return c.startLatency
+}
+
+// Uptime returns the duration that the contained process has been running
+func (c *Container) Uptime() time.Duration {
+	if c.proc == nil {
+		return 0
+	}
+	return c.proc.RunningDuration()
+}
+
 func (c *Container) Wait(exitCh <-chan struct{}) (Result, error) {
 	pr, err := c.proc.Wait(exitCh)
-	c.Logger.Logf("process exited: %d", pr.ExitStatus)
+	select {
+	case <-exitCh:
+		// the main process is gone, but the processes it started may have outlived the kill
+		c.terminateJob()
+	default:
+		c.waitJobEmpty(exitCh)
+	}
+	if pr != nil {
+		c.flushStats(pr.EndTime)
+	}
+	close(c.doneCh)
+	c.removePIDFile()
+	c.restoreConsoleCodePage()
 	if err != nil {
 		return Result{}, err
 	}
+	c.Logger.Logf("process exited: %d", pr.ExitStatus)
 	return Result{
 		Start:    pr.StartTime,
 		End:      pr.EndTime,
@@ -305,13 +1279,116 @@ func (c *Container) Wait(exitCh <-chan struct{}) (Result, error) {
 	}, pr.Err
 }
 
+// waitJobEmpty waits for the processes that outlived the main process, so that the container lives as long as its job.
+// It returns right away when the job can't report that it became empty
+func (c *Container) waitJobEmpty(exitCh <-chan struct{}) {
+	if !c.job.NotificationsAvailable() {
+		return
+	}
+	pids, err := c.job.ProcessIDs()
+	if err != nil {
+		if !isJobClosed(err) {
+			c.Logger.Error(err, "container: unable to list the remaining processes")
+		}
+		return
+	}
+	if len(pids) == 0 {
+		return
+	}
+	c.Logger.Logf("container: waiting for %d remaining processes %v", len(pids), pids)
+	select {
+	case <-c.emptyCh:
+	case <-c.pollDoneCh:
+		// the job becoming empty won't be reported anymore
+		c.waitProcessIDs(exitCh)
+	case <-exitCh:
+		c.terminateJob()
+	}
+}
+
+// jobEmptyPollInterval is how often waitProcessIDs lists the processes of the job
+const jobEmptyPollInterval = 1 * time.Second
+
+// waitProcessIDs waits for the job to have no processes left by listing them,
+// for when the notifications no longer report it
+func (c *Container) waitProcessIDs(exitCh <-chan struct{}) {
+	ticker := time.NewTicker(jobEmptyPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.emptyCh:
+			return
+		case <-exitCh:
+			c.terminateJob()
+			return
+		case <-ticker.C:
+		}
+		pids, err := c.job.ProcessIDs()
+		if err != nil {
+			if !isJobClosed(err) {
+				c.Logger.Error(err, "container: unable to list the remaining processes")
+			}
+			return
+		}
+		if len(pids) == 0 {
+			return
+		}
+	}
+}
+
+// terminateJob kills any process still running in the job
+func (c *Container) terminateJob() {
+	pids, err := c.job.ProcessIDs()
+	if isJobClosed(err) {
+		return
+	}
+	if err != nil {
+		c.Logger.Error(err, "container: unable to list the remaining processes")
+	} else if len(pids) == 0 {
+		return
+	}
+	c.Logger.Logf("container: terminating %d remaining processes %v", len(pids), pids)
+	if err = c.job.Terminate(win32.ExitStatusUnknown); !isJobClosed(err) {
+		c.Logger.Error(err, "container: unable to terminate the job")
+	}
+}
+
+// isJobClosed returns true when err is because the job was closed, e.g. by Kill, which terminated its processes
+func isJobClosed(err error) bool {
+	return errors.Cause(err) == win32.ErrJobObjectClosed
+}
+
+// Kill terminates every process in the container, including the descendants of the main process,
+// and releases the job object. It doesn't wait for the graceful shutdown
+func (c *Container) Kill() error {
+	if c.job == nil {
+		return errors.Errorf("container: not started")
+	}
+	var err error
+	// closing the job waits for the calls using it, such as the stats and Wait, which then see it closed
+	c.jobOnce.Do(func() {
+		if err = c.job.Terminate(win32.ExitStatusUnknown); err != nil {
+			err = errors.Wrapf(err, "container: unable to kill")
+		}
+		c.closeLogError(c.job, "failed to close JobObject")
+	})
+	return err
+}
+
+// killOnError terminates the job, which holds the process once it is assigned
 func (c *Container) killOnError(err error) error {
 	if err != nil {
-		c.Logger.Error(c.proc.Kill(), "unable to kill child process")
+		c.Logger.Error(c.job.Terminate(win32.ExitStatusStartError), "unable to kill child process")
 	}
 	return err
 }
 
+// releaseJob closes the job of a container that failed to start, so that the container is left as if it never started
+func (c *Container) releaseJob() {
+	c.closeLogError(c.job, "failed to close JobObject")
+	c.job = nil
+}
+
 func (c *Container) closeLogError(o io.Closer, msg string) {
 	if err := o.Close(); err != nil {
 		c.Logger.Error(err, msg)
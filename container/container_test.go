@@ -0,0 +1,877 @@
+// +build windows
+
+package container
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/jet/damon/win32"
+	"github.com/pkg/errors"
+)
+
+func SetupTestExe(t *testing.T) string {
+	t.Helper()
+	if exe := os.Getenv("TEST_EXE_PATH"); exe != "" {
+		stat, err := os.Stat(exe)
+		if err != nil {
+			t.Skipf("unable to stat test.exe: %v", err)
+		}
+		if stat.IsDir() {
+			t.Skipf("test.exe is a directory")
+		}
+		abs, err := filepath.Abs(exe)
+		if err != nil {
+			t.Skipf("unable to get absolute path of test.exe: %v", err)
+		}
+		return abs
+	}
+	t.Skip("TEST_EXE_PATH not set")
+	return ""
+}
+
+func TestCPUWeightExceedsShareWhenIdle(t *testing.T) {
+	c := &Container{
+		Name:    "damon-test-cpu-weight",
+		Command: exec.Command(SetupTestExe(t), "cpu", "30s"),
+		Config: Config{
+			EnforceCPU:  true,
+			CPUHardCap:  false,
+			CPUMHzLimit: MinimumCPUMHz,
+		},
+	}
+	if err := c.Start(); err != nil {
+		t.Fatal("Start", err)
+	}
+	exitCh := make(chan struct{})
+	defer func() {
+		close(exitCh)
+		if _, err := c.Wait(exitCh); err != nil {
+			t.Log("Wait", err)
+		}
+	}()
+	wait := 5 * time.Second
+	time.Sleep(wait)
+	info := &win32.JobObjectBasicAndIOAccounting{}
+	if err := c.job.GetInformation(info); err != nil {
+		t.Fatal("JobObjectBasicAndIOAccounting", err)
+	}
+	res := win32.GetSystemResources()
+	share := float64(c.Config.CPUMHzLimit) / res.CPUTotalTicks
+	used := float64(info.Basic.TotalUserTime+info.Basic.TotalKernelTime) / float64(wait*time.Duration(res.CPUNumCores))
+	t.Logf("nominal share=%.4f used=%.4f", share, used)
+	if used <= 2*share {
+		t.Fatalf("expected weight-based process to exceed its nominal CPU share when idle: share=%.4f used=%.4f", share, used)
+	}
+}
+
+func TestStartTimeoutRunning(t *testing.T) {
+	c := &Container{
+		Name:    "damon-test-start-timeout-running",
+		Command: exec.Command(SetupTestExe(t), "wait_nosig", "30s"),
+		Config: Config{
+			StartTimeout: 5 * time.Second,
+		},
+	}
+	if err := c.Start(); err != nil {
+		t.Fatal("Start", err)
+	}
+	defer c.Kill()
+	suspended, err := c.proc.MainThreadSuspended()
+	if err != nil {
+		t.Fatal("MainThreadSuspended", err)
+	}
+	if suspended {
+		t.Fatal("expected the main thread to run once Start returned")
+	}
+}
+
+func TestStartTimeoutResumeFailure(t *testing.T) {
+	tests := []struct {
+		name   string
+		resume func(p *win32.Process) error
+	}{
+		{
+			name: "error",
+			resume: func(p *win32.Process) error {
+				return errors.New("resume failed")
+			},
+		},
+		{
+			name: "suspended",
+			resume: func(p *win32.Process) error {
+				// reports success without resuming the main thread
+				return nil
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := &Container{
+				Name:    "damon-test-start-timeout-" + test.name,
+				Command: exec.Command(SetupTestExe(t), "wait_nosig", "30s"),
+				Config: Config{
+					StartTimeout: 1 * time.Second,
+				},
+				resumeFn: test.resume,
+			}
+			t0 := time.Now()
+			if err := c.Start(); err == nil {
+				t.Fatal("expected Start to fail")
+			} else {
+				t.Log(err)
+			}
+			if d := time.Since(t0); d > 10*time.Second {
+				t.Fatalf("Start took %v; expected it to give up after %v", d, c.Config.StartTimeout)
+			}
+			exited := make(chan struct{})
+			go func() {
+				c.proc.Cmd.Process.Wait()
+				close(exited)
+			}()
+			select {
+			case <-exited:
+			case <-time.After(5 * time.Second):
+				t.Fatal("expected process to be killed")
+			}
+		})
+	}
+}
+
+func TestRunAsRestrictedToken(t *testing.T) {
+	username := os.Getenv("TEST_WIN32_USER_NAME")
+	if username == "" {
+		t.Skip("TEST_WIN32_USER_NAME is empty")
+	}
+	c := &Container{
+		Name:    "damon-test-runas-restricted",
+		Command: exec.Command(SetupTestExe(t)),
+		Config: Config{
+			RestrictedToken: true,
+			RunAs: &win32.UserLogin{
+				Domain:   os.Getenv("TEST_WIN32_USER_DOMAIN"),
+				Username: username,
+				Password: win32.UnsafePasswordString(os.Getenv("TEST_WIN32_USER_PASSWORD")),
+			},
+		},
+	}
+	if err := c.Start(); err != nil {
+		t.Fatal("Start", err)
+	}
+	res, err := c.Wait(nil)
+	if err != nil {
+		t.Fatal("Wait", err)
+	}
+	if res.ExitCode != 0 {
+		t.Fatalf("ExitCode = %d; expected 0", res.ExitCode)
+	}
+}
+
+func TestRunAsRequiresCredentials(t *testing.T) {
+	c := &Container{
+		Config: Config{
+			RestrictedToken: true,
+			RunAs:           &win32.UserLogin{},
+		},
+	}
+	if _, err := c.processToken(); err == nil {
+		t.Fatal("expected an error for RunAs without a username")
+	}
+}
+
+func TestPIDFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "damon-pidfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	pidFile := filepath.Join(dir, "damon.pid")
+	c := &Container{
+		Name:    "damon-test-pidfile",
+		Command: exec.Command(SetupTestExe(t), "wait_nosig", "2s"),
+		Config: Config{
+			PIDFile: pidFile,
+		},
+	}
+	if err := c.Start(); err != nil {
+		t.Fatal("Start", err)
+	}
+	b, err := ioutil.ReadFile(pidFile)
+	if err != nil {
+		t.Fatal("expected pid file to be written", err)
+	}
+	if expected := fmt.Sprintf("%d\n%s\n", c.Pid(), c.Name); string(b) != expected {
+		t.Errorf("pid file = %q; expected %q", b, expected)
+	}
+	if _, err := c.Wait(nil); err != nil {
+		t.Fatal("Wait", err)
+	}
+	if _, err := os.Stat(pidFile); !os.IsNotExist(err) {
+		t.Fatalf("expected pid file to be removed: %v", err)
+	}
+}
+
+func TestAdjustCPUCap(t *testing.T) {
+	c := &Container{
+		Name:    "damon-test-adjust-cpu-cap",
+		Command: exec.Command(SetupTestExe(t), "wait_nosig", "10s"),
+		Config: Config{
+			EnforceCPU:    true,
+			CPUMinPercent: 5,
+			CPUMaxPercent: 20,
+		},
+	}
+	if err := c.Start(); err != nil {
+		t.Fatal("Start", err)
+	}
+	defer func() {
+		if err := c.proc.Kill(); err != nil {
+			t.Log(err)
+		}
+	}()
+	tests := []struct {
+		delta    float64
+		expected float64
+	}{
+		{delta: 10, expected: 30},
+		{delta: -20, expected: 10},
+		// bounded by the min rate
+		{delta: -50, expected: 5},
+		// bounded by 100%
+		{delta: 500, expected: 100},
+	}
+	for _, test := range tests {
+		effective, err := c.AdjustCPUCap(test.delta)
+		if err != nil {
+			t.Fatal("AdjustCPUCap", err)
+		}
+		if math.Abs(effective-test.expected) > 0.01 {
+			t.Fatalf("AdjustCPUCap(%.2f) = %.2f; expected %.2f", test.delta, effective, test.expected)
+		}
+	}
+}
+
+func TestPercentToCPURate(t *testing.T) {
+	tests := []struct {
+		percent float64
+		rate    uint
+	}{
+		{percent: -10, rate: win32.MinCPURate},
+		{percent: 0, rate: win32.MinCPURate},
+		{percent: 12.5, rate: 1250},
+		{percent: 100, rate: win32.MaxCPURate},
+		{percent: 150, rate: win32.MaxCPURate},
+	}
+	for _, test := range tests {
+		if rate := percentToCPURate(test.percent); rate != test.rate {
+			t.Errorf("percentToCPURate(%.2f) = %d; expected %d", test.percent, rate, test.rate)
+		}
+	}
+}
+
+func TestIORateControlInformationBaseSize(t *testing.T) {
+	tests := []struct {
+		baseSize uint32
+		valid    bool
+	}{
+		{baseSize: 0, valid: true},
+		{baseSize: 2048, valid: false},
+		{baseSize: MinIOBaseSize, valid: true},
+		{baseSize: 6144, valid: false},
+		{baseSize: 64 * 1024, valid: true},
+	}
+	for _, test := range tests {
+		cfg := Config{EnforceIO: true, IOMaxIOPS: 100, IOBaseSize: test.baseSize}
+		iorc, err := cfg.ioRateControlInformation()
+		if valid := err == nil; valid != test.valid {
+			t.Errorf("ioRateControlInformation() with IOBaseSize=%d: err=%v; expected valid=%t", test.baseSize, err, test.valid)
+			continue
+		}
+		if err == nil && iorc.BaseIOSize != test.baseSize {
+			t.Errorf("BaseIOSize = %d; expected %d", iorc.BaseIOSize, test.baseSize)
+		}
+	}
+}
+
+func TestSignal(t *testing.T) {
+	c := &Container{
+		Name:    "damon-test-signal",
+		Command: exec.Command(SetupTestExe(t), "wait_nosig", "30s"),
+	}
+	if err := c.Start(); err != nil {
+		t.Fatal("Start", err)
+	}
+	if err := c.Signal(syscall.SIGHUP); errors.Cause(err) != ErrSignalNotSupported {
+		t.Errorf("Signal(SIGHUP) = %v; expected ErrSignalNotSupported", err)
+	}
+	if err := c.Signal(os.Kill); err != nil {
+		t.Fatal("Signal(os.Kill)", err)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if _, err := c.Wait(nil); err != nil {
+			t.Log("Wait", err)
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("expected the process to exit after os.Kill")
+	}
+}
+
+func TestKillTerminatesDescendants(t *testing.T) {
+	dir, err := ioutil.TempDir("", "damon-test-kill")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	pidFile := filepath.Join(dir, "child.pid")
+	c := &Container{
+		Name:    "damon-test-kill",
+		Command: exec.Command(SetupTestExe(t), "spawn", "30s", pidFile),
+	}
+	if err := c.Start(); err != nil {
+		t.Fatal("Start", err)
+	}
+	var childPID int
+	deadline := time.Now().Add(10 * time.Second)
+	for childPID == 0 && time.Now().Before(deadline) {
+		if data, err := ioutil.ReadFile(pidFile); err == nil {
+			fmt.Sscan(string(data), &childPID)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if childPID == 0 {
+		c.Kill()
+		t.Fatal("the grandchild process didn't start")
+	}
+	hChild, err := syscall.OpenProcess(syscall.SYNCHRONIZE, false, uint32(childPID))
+	if err != nil {
+		c.Kill()
+		t.Fatal("OpenProcess", err)
+	}
+	defer syscall.CloseHandle(hChild)
+	if err := c.Kill(); err != nil {
+		t.Fatal("Kill", err)
+	}
+	if _, err := c.Wait(nil); err != nil {
+		t.Log("Wait", err)
+	}
+	ev, err := syscall.WaitForSingleObject(hChild, 10000)
+	if err != nil {
+		t.Fatal("WaitForSingleObject", err)
+	}
+	if ev != syscall.WAIT_OBJECT_0 {
+		t.Fatalf("grandchild process %d is still running after Kill", childPID)
+	}
+}
+
+func TestKillDuringWait(t *testing.T) {
+	c := &Container{
+		Name:    "damon-test-kill-wait",
+		Command: exec.Command(SetupTestExe(t), "spawn", "30s"),
+		OnStats: func(s ProcessStats) {},
+	}
+	if err := c.Start(); err != nil {
+		t.Fatal("Start", err)
+	}
+	done := make(chan struct{})
+	go func() {
+		c.Wait(nil)
+		close(done)
+	}()
+	// the main process exits right away, so Wait is waiting for the grandchild when the job is closed
+	time.Sleep(time.Second)
+	if err := c.Kill(); err != nil {
+		t.Fatal("Kill", err)
+	}
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Wait didn't return after Kill")
+	}
+	if _, err := c.job.ProcessIDs(); err != win32.ErrJobObjectClosed {
+		t.Errorf("ProcessIDs() = %v; expected ErrJobObjectClosed after Kill", err)
+	}
+}
+
+func TestLimitViolations(t *testing.T) {
+	violations := limitViolations(&win32.LimitViolationInfo{
+		CPURateViolation:    &win32.LimitViolation{Measured: 3, Limit: 2},
+		HighMemoryViolation: &win32.LimitViolation{Measured: 2048, Limit: 1024},
+	})
+	if len(violations) != 2 {
+		t.Fatalf("expected 2 violations, got %d", len(violations))
+	}
+	cpu, mem := violations[0], violations[1]
+	if cpu.Type != CPULimitViolation || cpu.Measured != 3 || cpu.Limit != 2 || cpu.Tolerance != win32.ToleranceMedium {
+		t.Errorf("unexpected CPU violation: %+v", cpu)
+	}
+	if mem.Type != MemoryLimitViolation || mem.Measured != 2048 || mem.Limit != 1024 || mem.Tolerance != 0 {
+		t.Errorf("unexpected memory violation: %+v", mem)
+	}
+	if cpu.Message == "" || mem.Message == "" {
+		t.Errorf("expected violation messages to be kept")
+	}
+	if v := limitViolations(nil); len(v) != 0 {
+		t.Errorf("expected no violations without info, got %v", v)
+	}
+}
+
+func TestCPUViolationTolerance(t *testing.T) {
+	tests := []struct {
+		limit   uint64
+		message string
+	}{
+		{limit: 0, message: "CPU Rate exceeded threshold"},
+		{limit: uint64(win32.ToleranceLow), message: "CPU Rate exceeded threshold > 20.00% of the time"},
+		{limit: uint64(win32.ToleranceMedium), message: "CPU Rate exceeded threshold > 40.00% of the time"},
+		{limit: uint64(win32.ToleranceHigh), message: "CPU Rate exceeded threshold > 60.00% of the time"},
+	}
+	for _, test := range tests {
+		violations := limitViolations(&win32.LimitViolationInfo{
+			CPURateViolation: &win32.LimitViolation{Limit: test.limit},
+		})
+		if len(violations) != 1 {
+			t.Fatalf("expected 1 violation, got %d", len(violations))
+		}
+		if m := violations[0].Message; m != test.message {
+			t.Errorf("limit %d: message = %q; expected %q", test.limit, m, test.message)
+		}
+	}
+}
+
+func TestIOViolationTolerance(t *testing.T) {
+	tests := []struct {
+		limit     uint64
+		message   string
+		tolerance win32.JobObjectRateControlTolerance
+	}{
+		{limit: 0, message: "IO Rate exceeded threshold", tolerance: 0},
+		{limit: uint64(win32.ToleranceLow), message: "IO Rate exceeded threshold > 20.00% of the time", tolerance: win32.ToleranceLow},
+		{limit: uint64(win32.ToleranceHigh), message: "IO Rate exceeded threshold > 60.00% of the time", tolerance: win32.ToleranceHigh},
+		{limit: uint64(win32.ToleranceHigh) + 1, message: "IO Rate exceeded threshold", tolerance: win32.ToleranceHigh + 1},
+	}
+	for _, test := range tests {
+		violations := limitViolations(&win32.LimitViolationInfo{
+			IORateViolation: &win32.LimitViolation{Limit: test.limit},
+		})
+		if len(violations) != 1 {
+			t.Fatalf("expected 1 violation, got %d", len(violations))
+		}
+		if v := violations[0]; v.Type != IOLimitViolation || v.Message != test.message || v.Tolerance != test.tolerance {
+			t.Errorf("limit %d: violation = %+v; expected message %q", test.limit, v, test.message)
+		}
+	}
+}
+
+func TestProcessEvent(t *testing.T) {
+	tests := []struct {
+		code  win32.JobObjectMsgCode
+		event ProcessEvent
+		ok    bool
+	}{
+		{code: win32.JobObjectMsgNewProcess, event: ProcessEvent{Type: ProcessStartedEvent, PID: 42}, ok: true},
+		{code: win32.JobObjectMsgExitProcess, event: ProcessEvent{Type: ProcessExitedEvent, PID: 42}, ok: true},
+		{code: win32.JobObjectMsgAbnormalExitProcess, event: ProcessEvent{Type: ProcessAbnormalExitEvent, PID: 42}, ok: true},
+		{code: win32.JobObjectMsgActiveProcessZero, event: ProcessEvent{Type: JobEmptyEvent}, ok: true},
+		{code: win32.JobObjectMsgNotificationLimit, ok: false},
+	}
+	for _, test := range tests {
+		e, ok := processEvent(&win32.JobObjectNotification{Code: test.code, ProcessID: 42})
+		if ok != test.ok || e != test.event {
+			t.Errorf("processEvent(%d) = %+v, %v; expected %+v, %v", test.code, e, ok, test.event, test.ok)
+		}
+	}
+}
+
+func TestWaitOutlivesMainProcess(t *testing.T) {
+	events := make(chan ProcessEvent, 16)
+	c := &Container{
+		Name:    "damon-test-wait-job",
+		Command: exec.Command(SetupTestExe(t), "spawn", "3s"),
+		OnProcessEvent: func(e ProcessEvent) {
+			events <- e
+		},
+	}
+	begin := time.Now()
+	if err := c.Start(); err != nil {
+		t.Fatal("Start", err)
+	}
+	defer c.Kill()
+	if _, err := c.Wait(nil); err != nil {
+		t.Fatal("Wait", err)
+	}
+	if d := time.Since(begin); d < 3*time.Second {
+		t.Errorf("Wait returned after %v, before the grandchild process exited", d)
+	}
+	pids, err := c.job.ProcessIDs()
+	if err != nil {
+		t.Fatal("ProcessIDs", err)
+	}
+	if len(pids) != 0 {
+		t.Errorf("expected an empty job after Wait, got %v", pids)
+	}
+	for {
+		select {
+		case e := <-events:
+			if e.Type == JobEmptyEvent {
+				return
+			}
+		default:
+			t.Fatal("expected a JobEmpty event")
+		}
+	}
+}
+
+func TestBasicLimitInformationWorkingSet(t *testing.T) {
+	tests := []struct {
+		min, max int
+		valid    bool
+	}{
+		{min: 0, max: 0, valid: true},
+		{min: 16, max: 64, valid: true},
+		{min: 0, max: 64, valid: false},
+		{min: 64, max: 64, valid: false},
+		{min: 64, max: 16, valid: false},
+		{min: 16, max: 0, valid: false},
+		{min: -1, max: 64, valid: false},
+	}
+	for _, test := range tests {
+		cfg := Config{MinWorkingSetMB: test.min, MaxWorkingSetMB: test.max}
+		bli, err := cfg.basicLimitInformation()
+		if valid := err == nil; valid != test.valid {
+			t.Errorf("basicLimitInformation() with min=%d max=%d: err=%v; expected valid=%t", test.min, test.max, err, test.valid)
+			continue
+		}
+		if err != nil || test.max == 0 {
+			continue
+		}
+		if bli.MinWorkingSetSize != int64(test.min)*int64(MBToBytes) || bli.MaxWorkingSetSize != int64(test.max)*int64(MBToBytes) {
+			t.Errorf("working set = %d-%d; expected %d-%d MB", bli.MinWorkingSetSize, bli.MaxWorkingSetSize, test.min, test.max)
+		}
+	}
+}
+
+func TestUniqueName(t *testing.T) {
+	prefix := fmt.Sprintf("damon-%d-", os.Getpid())
+	a, b := uniqueName(), uniqueName()
+	if !strings.HasPrefix(a, prefix) || !strings.HasPrefix(b, prefix) {
+		t.Errorf("uniqueName() = %s, %s; expected the prefix %s", a, b, prefix)
+	}
+	if a == b {
+		t.Errorf("uniqueName() returned %s twice", a)
+	}
+}
+
+func TestStartWithoutName(t *testing.T) {
+	c := &Container{
+		Command: exec.Command(SetupTestExe(t), "wait_nosig", "30s"),
+	}
+	if err := c.Start(); err != nil {
+		t.Fatal("Start", err)
+	}
+	defer c.Kill()
+	if c.Name == "" {
+		t.Fatal("expected Start to name the container")
+	}
+	job, err := win32.OpenJobObject(c.Name)
+	if err != nil {
+		t.Fatal("OpenJobObject", err)
+	}
+	defer job.Close()
+}
+
+func TestStartErrorClosesJob(t *testing.T) {
+	c := &Container{
+		Name:    "damon-test-start-error",
+		Command: exec.Command(filepath.Join(os.TempDir(), "damon-test-missing.exe")),
+	}
+	if err := c.Start(); err == nil {
+		c.Kill()
+		t.Fatal("expected Start to fail for a missing executable")
+	}
+	if c.job != nil {
+		t.Error("expected the job to be cleared after Start failed")
+	}
+	if job, err := win32.OpenJobObject(c.Name); err == nil {
+		job.Close()
+		t.Error("expected the job to be closed after Start failed")
+	}
+}
+
+func TestWaitNotStarted(t *testing.T) {
+	proc, err := win32.CreateProcessWithToken(exec.Command(SetupTestExe(t), "wait_nosig", "1s"), nil)
+	if err != nil {
+		t.Fatal("CreateProcessWithToken", err)
+	}
+	job, err := win32.CreateJobObject("damon-test-wait-not-started")
+	if err != nil {
+		t.Fatal("CreateJobObject", err)
+	}
+	defer job.Close()
+	c := &Container{
+		proc:    proc,
+		job:     job,
+		doneCh:  make(chan struct{}),
+		OnStats: func(s ProcessStats) {},
+	}
+	if _, err = c.Wait(nil); errors.Cause(err) != win32.ErrProcessNotStarted {
+		t.Fatalf("Wait() = %v; expected ErrProcessNotStarted", err)
+	}
+}
+
+func TestWaitFlushesStats(t *testing.T) {
+	var stats []ProcessStats
+	c := &Container{
+		Name:    "damon-test-flush-stats",
+		Command: exec.Command(SetupTestExe(t), "wait_nosig", "1s"),
+		OnStats: func(s ProcessStats) {
+			stats = append(stats, s)
+		},
+	}
+	if err := c.Start(); err != nil {
+		t.Fatal("Start", err)
+	}
+	defer c.Kill()
+	if _, err := c.Wait(nil); err != nil {
+		t.Fatal("Wait", err)
+	}
+	// the process exits before the first periodic poll, so only the final stats are reported
+	if len(stats) != 1 {
+		t.Fatalf("expected the final stats once, got %d", len(stats))
+	}
+	if s := stats[0]; s.TotalRunTime < time.Second || s.PrivateUsageBytes == 0 {
+		t.Errorf("unexpected final stats: %+v", s)
+	}
+}
+
+func TestCheckCPULimit(t *testing.T) {
+	tests := []struct {
+		name  string
+		cfg   Config
+		total float64
+		valid bool
+	}{
+		{name: "below total", cfg: Config{EnforceCPU: true, CPUMHzLimit: 2000}, total: 8000, valid: true},
+		{name: "equal to total", cfg: Config{EnforceCPU: true, CPUMHzLimit: 8000}, total: 8000, valid: true},
+		{name: "above total", cfg: Config{EnforceCPU: true, CPUMHzLimit: 9000}, total: 8000, valid: false},
+		{name: "not enforced", cfg: Config{CPUMHzLimit: 9000}, total: 8000, valid: true},
+		{name: "unknown total", cfg: Config{EnforceCPU: true, CPUMHzLimit: 9000}, total: 0, valid: true},
+		{name: "min max percent", cfg: Config{EnforceCPU: true, CPUMHzLimit: 9000, CPUMinPercent: 10, CPUMaxPercent: 50}, total: 8000, valid: true},
+		{name: "limit percent", cfg: Config{EnforceCPU: true, CPUMHzLimit: 9000, CPULimitPercent: 50}, total: 8000, valid: true},
+	}
+	for _, test := range tests {
+		err := test.cfg.CheckCPULimit(test.total)
+		if valid := err == nil; valid != test.valid {
+			t.Errorf("%s: CheckCPULimit(%.0f) = %v; expected valid=%t", test.name, test.total, err, test.valid)
+		}
+	}
+}
+
+func TestCheckCPUClamp(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     Config
+		total   float64
+		clamped bool
+	}{
+		{name: "hard cap", cfg: Config{CPUHardCap: true, CPUMHzLimit: 100}, total: 8000, clamped: false},
+		{name: "hard cap below min rate", cfg: Config{CPUHardCap: true, CPUMHzLimit: 100}, total: 2000000, clamped: true},
+		{name: "weight", cfg: Config{CPUMHzLimit: 2000}, total: 8000, clamped: false},
+		{name: "weight below min", cfg: Config{CPUMHzLimit: 500}, total: 8000, clamped: true},
+		{name: "percent weight below min", cfg: Config{CPULimitPercent: 5}, total: 8000, clamped: true},
+		{name: "percent hard cap", cfg: Config{CPUHardCap: true, CPULimitPercent: 5}, total: 8000, clamped: false},
+		{name: "unknown total", cfg: Config{CPUMHzLimit: 500}, total: 0, clamped: false},
+		{name: "min max percent", cfg: Config{CPUMinPercent: 1, CPUMaxPercent: 2}, total: 8000, clamped: false},
+	}
+	for _, test := range tests {
+		err := test.cfg.checkCPUClamp(test.total)
+		if clamped := err != nil; clamped != test.clamped {
+			t.Errorf("%s: checkCPUClamp(%.0f) = %v; expected clamped=%t", test.name, test.total, err, test.clamped)
+		}
+	}
+}
+
+func TestCPURateControlInformationPercent(t *testing.T) {
+	cfg := Config{EnforceCPU: true, CPUHardCap: true, CPUMHzLimit: 100, CPULimitPercent: 12.5}
+	crci, err := cfg.cpuRateControlInformation()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if crci.Rate == nil || !crci.Rate.HardCap || crci.Rate.Rate != 1250 {
+		t.Errorf("expected a hard cap rate of 1250 - got %+v", crci.Rate)
+	}
+	cfg.CPUHardCap = false
+	if crci, err = cfg.cpuRateControlInformation(); err != nil {
+		t.Fatal(err)
+	}
+	if crci.Rate != nil || crci.Weight != 1 {
+		t.Errorf("expected a weight of 1 - got %+v", crci)
+	}
+	cfg.CPULimitPercent = 150
+	if _, err = cfg.cpuRateControlInformation(); err == nil {
+		t.Error("expected an error for a limit above 100%")
+	}
+}
+
+func TestFilterEnv(t *testing.T) {
+	env := []string{"=C:=C:\\app", "PATH=C:\\Windows", "NOMAD_TASK_NAME=web", "NOMAD_TOKEN=secret", "Secret_Key=x"}
+	filtered, err := filterEnv(env, []string{"nomad_*", "Path"}, []string{"*TOKEN"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"PATH=C:\\Windows", "NOMAD_TASK_NAME=web"}; fmt.Sprint(filtered) != fmt.Sprint(expected) {
+		t.Errorf("filterEnv() = %q; expected %q", filtered, expected)
+	}
+	filtered, err = filterEnv(env, nil, []string{"SECRET_*"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(filtered) != len(env)-1 {
+		t.Errorf("filterEnv() = %q; expected every variable but Secret_Key", filtered)
+	}
+	if _, err = filterEnv(env, []string{"["}, nil); err == nil {
+		t.Error("expected an error for an invalid pattern")
+	}
+}
+
+func TestEnvFilter(t *testing.T) {
+	cmd := exec.Command(SetupTestExe(t), "env", "100ms")
+	cmd.Env = []string{"DAMON_TEST_KEEP=1", "DAMON_TEST_SECRET=2", "OTHER=3", "SYSTEMROOT=" + os.Getenv("SYSTEMROOT")}
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd.Stdout = w
+	c := &Container{
+		Name:    "damon-test-env",
+		Command: cmd,
+		Config: Config{
+			EnvAllowlist: []string{"DAMON_TEST_*", "SYSTEMROOT"},
+			EnvDenylist:  []string{"*SECRET"},
+		},
+	}
+	err = c.Start()
+	if cerr := w.Close(); cerr != nil {
+		t.Error(cerr)
+	}
+	if err != nil {
+		t.Fatal("Start", err)
+	}
+	out, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = c.Wait(nil); err != nil {
+		t.Fatal("Wait", err)
+	}
+	if env := string(out); !strings.Contains(env, "DAMON_TEST_KEEP=1") || strings.Contains(env, "DAMON_TEST_SECRET") || strings.Contains(env, "OTHER=") {
+		t.Errorf("unexpected environment:\n%s", env)
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	resources := win32.SystemResources{CPUNumCores: 4, CPUTotalTicks: 8000}
+	lowestClass, invalidClass := uint(0), uint(10)
+	tests := []struct {
+		name string
+		cfg  Config
+		errs int
+	}{
+		{name: "empty", cfg: Config{}, errs: 0},
+		{name: "valid", cfg: Config{EnforceCPU: true, CPUHardCap: true, CPUMHzLimit: 1000, EnforceMemory: true, MemoryMBLimit: 512, CPUAffinityMask: 0x3}, errs: 0},
+		{name: "cpu too low", cfg: Config{EnforceCPU: true, CPUMHzLimit: 10}, errs: 1},
+		{name: "strict cpu above system", cfg: Config{EnforceCPU: true, CPUMHzLimit: 9000, StrictCPULimit: true}, errs: 1},
+		{name: "cpu modes", cfg: Config{EnforceCPU: true, CPUMinPercent: 10, CPUMaxPercent: 20, CPULimitPercent: 50}, errs: 1},
+		{name: "half min max", cfg: Config{EnforceCPU: true, CPUMHzLimit: 1000, CPUMaxPercent: 20}, errs: 1},
+		{name: "memory", cfg: Config{EnforceMemory: true}, errs: 1},
+		{name: "affinity", cfg: Config{CPUAffinityMask: 0x30}, errs: 2},
+		{name: "lowest scheduling class", cfg: Config{SchedulingClass: &lowestClass}, errs: 0},
+		{name: "everything", cfg: Config{EnforceCPU: true, CPUMHzLimit: 10, EnforceMemory: true, SchedulingClass: &invalidClass, MinWorkingSetMB: 10}, errs: 4},
+	}
+	for _, test := range tests {
+		err := test.cfg.validate(resources)
+		var errs ConfigErrors
+		if err != nil {
+			errs = err.(ConfigErrors)
+		}
+		if len(errs) != test.errs {
+			t.Errorf("%s: validate() = %v; expected %d errors", test.name, err, test.errs)
+		}
+	}
+}
+
+func TestPollNotificationsErrors(t *testing.T) {
+	calls := 0
+	c := &Container{
+		doneCh:     make(chan struct{}),
+		pollDoneCh: make(chan struct{}),
+		job:        &win32.JobObject{},
+		pollFn: func() (*win32.JobObjectNotification, error) {
+			calls++
+			return nil, errors.New("completion port is broken")
+		},
+	}
+	go c.pollNotifications()
+	select {
+	case <-c.pollDoneCh:
+	case <-time.After(30 * time.Second):
+		t.Fatal("expected pollNotifications to give up")
+	}
+	if calls != MaxPollErrors {
+		t.Errorf("polled %d times; expected to give up after %d errors", calls, MaxPollErrors)
+	}
+	for errCount, expected := range map[int]time.Duration{1: 10 * time.Millisecond, 2: 20 * time.Millisecond, 4: 80 * time.Millisecond, 20: time.Second} {
+		if d := pollBackoff(errCount); d != expected {
+			t.Errorf("pollBackoff(%d) = %v; expected %v", errCount, d, expected)
+		}
+	}
+}
+
+func TestWaitJobEmptyAfterPollErrors(t *testing.T) {
+	c := &Container{
+		Name:    "damon-test-wait-poll-errors",
+		Command: exec.Command(SetupTestExe(t), "spawn", "5s"),
+		pollFn: func() (*win32.JobObjectNotification, error) {
+			return nil, errors.New("completion port is broken")
+		},
+	}
+	begin := time.Now()
+	if err := c.Start(); err != nil {
+		t.Fatal("Start", err)
+	}
+	defer c.Kill()
+	done := make(chan struct{})
+	go func() {
+		if _, err := c.Wait(nil); err != nil {
+			t.Error("Wait", err)
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(30 * time.Second):
+		t.Fatal("Wait didn't return after polling the notifications gave up")
+	}
+	if d := time.Since(begin); d < 5*time.Second {
+		t.Errorf("Wait returned after %v, before the grandchild process exited", d)
+	}
+	pids, err := c.job.ProcessIDs()
+	if err != nil {
+		t.Fatal("ProcessIDs", err)
+	}
+	if len(pids) != 0 {
+		t.Errorf("expected an empty job after Wait, got %v", pids)
+	}
+}
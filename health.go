@@ -0,0 +1,36 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/jet/damon/container"
+	"github.com/jet/damon/log"
+)
+
+// HealthEndpoint is the path of the liveness endpoint served next to the metrics endpoint
+const HealthEndpoint = "/healthz"
+
+type healthStatus struct {
+	PID     uint32  `json:"pid"`
+	Running bool    `json:"running"`
+	Uptime  float64 `json:"uptime"`
+}
+
+// healthHandler responds with 200 while the contained process is running, and 503 once it has exited
+func healthHandler(c *container.Container, logger log.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		status := healthStatus{
+			PID:     c.Pid(),
+			Running: c.Running(),
+			Uptime:  c.Uptime().Seconds(),
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if !status.Running {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		if err := json.NewEncoder(w).Encode(status); err != nil {
+			logger.Error(err, "unable to write health status")
+		}
+	})
+}
@@ -0,0 +1,11 @@
+// +build !windows
+
+package log
+
+import (
+	"github.com/pkg/errors"
+)
+
+func openEventLog(source string) (func(msg string) error, error) {
+	return nil, errors.Errorf("the event log is only available on windows")
+}
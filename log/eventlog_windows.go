@@ -0,0 +1,25 @@
+// +build windows
+
+package log
+
+import (
+	"golang.org/x/sys/windows/svc/eventlog"
+)
+
+// eventID is the ID of every event damon reports
+const eventID = 1
+
+// openEventLog opens the Application event log to report errors under source.
+// The source is registered when it doesn't exist yet, which requires administrator rights.
+// Without it the events are still reported, but Event Viewer can't format their message
+func openEventLog(source string) (func(msg string) error, error) {
+	// fails when the source already exists
+	_ = eventlog.InstallAsEventCreate(source, eventlog.Error|eventlog.Warning|eventlog.Info)
+	l, err := eventlog.Open(source)
+	if err != nil {
+		return nil, err
+	}
+	return func(msg string) error {
+		return l.Error(eventID, msg)
+	}, nil
+}
@@ -2,8 +2,10 @@ package log
 
 import (
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"strings"
 
 	"github.com/natefinch/lumberjack"
 	"github.com/pkg/errors"
@@ -21,6 +23,9 @@ type LogConfig struct {
 	NomadAllocDir  string
 	NomadTaskName  string
 	NomadLogSuffix string
+	// EventLogSource also reports the errors to the Windows Application event log under this source name.
+	// Empty disables it
+	EventLogSource string
 }
 
 func (c LogConfig) Dir() (string, error) {
@@ -98,13 +103,40 @@ func NewLogger(cfg LogConfig) (Logger, error) {
 	if err != nil {
 		return Logger{}, errors.Wrapf(err, "unable to get log directory")
 	}
-	logOut := &lumberjack.Logger{
+	var logOut io.Writer = &lumberjack.Logger{
 		Filename:   filename,
 		MaxSize:    cfg.MaxSizeMB,
 		MaxBackups: cfg.MaxLogFiles,
 	}
+	if cfg.EventLogSource != "" {
+		report, err := openEventLog(cfg.EventLogSource)
+		if err != nil {
+			return Logger{}, errors.Wrapf(err, "unable to open the event log for source %s", cfg.EventLogSource)
+		}
+		logOut = zerolog.MultiLevelWriter(logOut, eventLogWriter{report: report})
+	}
 	logger := zerolog.New(logOut).With().Timestamp().Logger()
 	return Logger{
 		zl: logger,
 	}, nil
 }
+
+// eventLogWriter reports the error entries of the log to the event log, where Windows administrators look first.
+// The other entries are only written to the log file
+type eventLogWriter struct {
+	report func(msg string) error
+}
+
+func (w eventLogWriter) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+func (w eventLogWriter) WriteLevel(level zerolog.Level, p []byte) (int, error) {
+	if level < zerolog.ErrorLevel {
+		return len(p), nil
+	}
+	if err := w.report(strings.TrimSpace(string(p))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
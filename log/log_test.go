@@ -1,10 +1,15 @@
 package log
 
 import (
+	goerrors "errors"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
+
+	"github.com/rs/zerolog"
 )
 
 func TestLogConfig(t *testing.T) {
@@ -109,3 +114,21 @@ func TestLogConfig(t *testing.T) {
 		})
 	}
 }
+
+func TestEventLogWriter(t *testing.T) {
+	var reported []string
+	w := eventLogWriter{report: func(msg string) error {
+		reported = append(reported, msg)
+		return nil
+	}}
+	l := Logger{zl: zerolog.New(zerolog.MultiLevelWriter(ioutil.Discard, w))}
+	l.Logf("starting %s", "app.exe")
+	l.Error(nil, "not an error")
+	l.Error(goerrors.New("access denied"), "unable to start")
+	if len(reported) != 1 {
+		t.Fatalf("reported %q; expected only the error", reported)
+	}
+	if !strings.Contains(reported[0], `"error":"access denied"`) || !strings.Contains(reported[0], `"message":"unable to start"`) {
+		t.Fatalf("reported %q; expected the error entry", reported[0])
+	}
+}
@@ -2,11 +2,13 @@ package main
 
 import (
 	"fmt"
+	"net"
 	"net/http"
 	"os"
 	"os/exec"
 	"os/signal"
 	"runtime"
+	"time"
 
 	"github.com/jet/damon/container"
 	"github.com/jet/damon/log"
@@ -25,20 +27,63 @@ func main() {
 		fmt.Println(vinfo.FullString(true))
 		os.Exit(0)
 	}
-
-	var cmd *exec.Cmd
-	if len(os.Args) > 2 {
-		cmd = exec.Command(os.Args[1], os.Args[2:]...)
-	} else {
-		cmd = exec.Command(os.Args[1])
+	if os.Args[1] == NetstatFlag {
+		if len(os.Args) != 3 {
+			fmt.Printf("usage: %s %s <container name>\n", os.Args[0], NetstatFlag)
+			os.Exit(2)
+		}
+		if err := printConnections(os.Stdout, os.Args[2]); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	if os.Args[1] == StatsFlag {
+		if len(os.Args) != 3 {
+			fmt.Printf("usage: %s %s <container name>\n", os.Args[0], StatsFlag)
+			os.Exit(2)
+		}
+		if err := printStats(os.Stdout, os.Args[2]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	if os.Args[1] == ServiceFlag {
+		if len(os.Args) < 3 {
+			fmt.Printf("usage: %s %s <command> [args...]\n", os.Args[0], ServiceFlag)
+			os.Exit(2)
+		}
+		os.Exit(runService(os.Args[2:]))
+	}
+	if os.Args[1] == ValidateFlag {
+		problems := validateEnvironment(os.Stdout)
+		for _, err := range problems {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		if len(problems) > 0 {
+			os.Exit(1)
+		}
+		os.Exit(0)
 	}
 
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh)
+	os.Exit(run(os.Args[1:], sigCh))
+}
+
+// run starts the command in args in a container and waits for it to exit. It returns the exit code of damon.
+// A signal received on sigCh shuts the process down, and a second one kills it
+func run(args []string, sigCh <-chan os.Signal) int {
+	vinfo := version.GetInfo()
+	cmd := exec.Command(args[0], args[1:]...)
+
 	lcfg := LogConfigFromEnvironment()
 	fields := NomadLogFields()
 	logger, err := log.NewLogger(lcfg)
 	if err != nil {
 		fmt.Println(err)
-		os.Exit(1)
+		return 1
 	}
 	logger = logger.WithFields(fields)
 	logger.WithFields(map[string]interface{}{
@@ -53,24 +98,52 @@ func main() {
 	})
 	ccfg, err := LoadContainerConfigFromEnvironment()
 	if err != nil {
+		// running with a partial configuration could leave the process without the limits it asked for
 		logger.Error(err, "unable to load container configuration from environment variables")
+		return 1
+	}
+	if cmd.Dir, err = WorkingDir(); err != nil {
+		logger.Error(err, "invalid working directory")
+		return 1
+	}
+	timeout, err := ShutdownTimeout()
+	if err != nil {
+		logger.Error(err, "invalid shutdown timeout, using the default")
+	}
+	ccfg.ShutdownTimeout = timeout
+	logger.Logf("shutdown timeout: %v", timeout)
+	smoothing, err := CPUSmoothing()
+	if err != nil {
+		logger.Error(err, "invalid cpu smoothing, exporting raw cpu percentages")
+	}
+	namespace, err := MetricsNamespace()
+	if err != nil {
+		logger.Error(err, "invalid metrics configuration")
+		return 1
 	}
 	win32.SetLogger(logger)
 	resources := win32.GetSystemResources()
+	name := ContainerName()
 	labels := make(map[string]string)
 	for k, v := range fields {
 		labels[k] = fmt.Sprintf("%v", v)
 	}
 	m := metrics.Metrics{
-		Cores:            resources.CPUNumCores,
-		MHzPerCore:       resources.CPUMhzPercore,
-		CPULimitHz:       float64(ccfg.CPUMHzLimit * 1000000),
-		MemoryLimitBytes: float64(ccfg.MemoryMBLimit * 1024 * 1024),
-		Namespace:        "damon",
-		Labels:           labels,
-	}
-	m.Init()
+		Cores:                  resources.CPUNumCores,
+		MHzPerCore:             resources.CPUMhzPercore,
+		CPULimitHz:             cpuLimitHz(ccfg, resources),
+		MemoryLimitBytes:       memoryLimitBytes(ccfg),
+		IOLimitIOPS:            ioLimitIOPS(ccfg),
+		IOLimitBandwidthBytes:  ioLimitBandwidthBytes(ccfg),
+		NetLimitBandwidthBytes: netLimitBandwidthBytes(ccfg),
+		CPUSmoothing:           smoothing,
+		Namespace:              namespace,
+		Labels:                 labels,
+		ContainerName:          name,
+	}
 	c := container.Container{
+		Name:    name,
+		Labels:  labels,
 		Command: cmd,
 		Config:  ccfg,
 		Logger:  clogger,
@@ -80,30 +153,86 @@ func main() {
 		OnViolation: func(v container.LimitViolation) {
 			m.OnViolation(v)
 		},
+		OnStart: func(d time.Duration) {
+			m.OnStart(d)
+		},
+	}
+	if MetricsTCPConnections() {
+		m.ConnectionPIDs = c.ProcessIDs
+	}
+	// the process runs without metrics rather than not at all
+	metricsEnabled := true
+	if err := m.Init(); err != nil {
+		logger.Error(err, "unable to initialize metrics, they are disabled")
+		metricsEnabled = false
+		c.OnStats = nil
+		c.OnViolation = nil
+		c.OnStart = nil
 	}
 	if err := c.Start(); err != nil {
 		logger.Error(err, "damon startup error")
-		os.Exit(1)
+		return 1
 	}
 	exitCh := make(chan struct{})
-	sigCh := make(chan os.Signal)
-	signal.Notify(sigCh)
 	go func() {
-		<-sigCh
-		close(exitCh)
+		stopping := false
+		for sig := range sigCh {
+			// the ctrl_c shutdown signal reaches every process of the console, damon included
+			if sig == os.Interrupt && win32.ConsumeSentCtrlC() {
+				logger.Logf("ignoring the %v sent to the process", sig)
+				continue
+			}
+			// Windows only raises interrupt and terminate, and both stop the process
+			if stopping {
+				logger.Logf("received %v while shutting down, killing", sig)
+				logger.Error(c.Kill(), "unable to kill container")
+				return
+			}
+			logger.Logf("received %v, shutting down", sig)
+			stopping = true
+			close(exitCh)
+		}
 	}()
 	if addr := ListenAddress(); addr != "" {
-		go func() {
-			endpoint := MetricsEndpoint()
-			mux := http.NewServeMux()
+		endpoint := MetricsEndpoint()
+		mux := http.NewServeMux()
+		if metricsEnabled {
 			mux.Handle(endpoint, m.Handler())
-			srv := &http.Server{
-				Addr:    addr,
-				Handler: mux,
+		}
+		mux.Handle(HealthEndpoint, healthHandler(&c, logger))
+		mux.Handle(ConfigEndpoint, configHandler(&c, resources, logger))
+		srv := &http.Server{
+			Addr:    addr,
+			Handler: mux,
+		}
+		// listen before serving, so that a port in use is reported at startup rather than lost in a goroutine.
+		// The process keeps running without the endpoints
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			logger.WithFields(map[string]interface{}{
+				"addr": addr,
+			}).Error(err, fmt.Sprintf("unable to listen on %s, metrics, health and config endpoints are NOT available", addr))
+		} else {
+			logger.Logf("metrics on http://%s%s", l.Addr(), endpoint)
+			go func() {
+				logger.Error(srv.Serve(l), fmt.Sprintf("http server on %s stopped, metrics are no longer available", l.Addr()))
+			}()
+		}
+	}
+	metricsFile := MetricsFile()
+	if metricsEnabled && metricsFile != "" {
+		interval, err := MetricsFileInterval()
+		if err != nil {
+			logger.Error(err, "invalid metrics file interval, using the default")
+		}
+		go func() {
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+			for range ticker.C {
+				logger.Error(m.WriteToFile(metricsFile), "unable to write metrics file")
 			}
-			logger.Logf("metrics on http://%s/%s", addr, endpoint)
-			logger.Error(srv.ListenAndServe(), "error closing http server")
 		}()
+		logger.Logf("metrics written to %s every %v", metricsFile, interval)
 	}
 	pr, err := c.Wait(exitCh)
 	if err != nil {
@@ -113,6 +242,13 @@ func main() {
 			"cmdline":  os.Args,
 		}).Error(err, "process exited with an error")
 	}
+	if metricsEnabled {
+		m.OnExit(pr, pr.End.Sub(pr.Start))
+		if metricsFile != "" {
+			// the exit code and run time would be lost until the next tick
+			logger.Error(m.WriteToFile(metricsFile), "unable to write metrics file")
+		}
+	}
 
 	logger.WithFields(map[string]interface{}{
 		"version":     vinfo,
@@ -123,5 +259,5 @@ func main() {
 		"run_time":    pr.End.Sub(pr.Start),
 		"exit_status": pr.ExitCode,
 	}).Logln("damon exiting")
-	os.Exit(pr.ExitCode)
+	return pr.ExitCode
 }
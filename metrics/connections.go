@@ -0,0 +1,67 @@
+package metrics
+
+import (
+	"github.com/jet/damon/win32"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// ProcessIDsFn returns the IDs of the processes to count connections for
+type ProcessIDsFn func() ([]uint32, error)
+
+// TCPConnectionsCollector counts the TCP connections owned by a set of processes, by state.
+// The whole IPv4 and IPv6 TCP tables are read on each collection, which is expensive on busy hosts
+type TCPConnectionsCollector struct {
+	ProcessIDs ProcessIDsFn
+	desc       *prometheus.Desc
+}
+
+// NewTCPConnectionsCollector creates a collector for the damon_net_connections gauge
+func NewTCPConnectionsCollector(namespace string, labels prometheus.Labels, pids ProcessIDsFn) *TCPConnectionsCollector {
+	return &TCPConnectionsCollector{
+		ProcessIDs: pids,
+		desc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "net", "connections"),
+			"The number of TCP connections owned by the processes in the container, by state.",
+			[]string{"state"},
+			labels,
+		),
+	}
+}
+
+func (c *TCPConnectionsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c *TCPConnectionsCollector) Collect(ch chan<- prometheus.Metric) {
+	pids, err := c.ProcessIDs()
+	if err != nil {
+		ch <- prometheus.NewInvalidMetric(c.desc, err)
+		return
+	}
+	counts, err := countTCPConnections(pids)
+	if err != nil {
+		ch <- prometheus.NewInvalidMetric(c.desc, err)
+		return
+	}
+	for state, n := range counts {
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, float64(n), state.String())
+	}
+}
+
+func countTCPConnections(pids []uint32) (map[win32.TCPState]int, error) {
+	ipids := make([]int, 0, len(pids))
+	for _, pid := range pids {
+		ipids = append(ipids, int(pid))
+	}
+	byPID, err := win32.CountConnectionsByPID(ipids)
+	if err != nil {
+		return nil, err
+	}
+	counts := make(map[win32.TCPState]int)
+	for _, states := range byPID {
+		for state, n := range states {
+			counts[state] += n
+		}
+	}
+	return counts, nil
+}
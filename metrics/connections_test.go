@@ -0,0 +1,24 @@
+package metrics
+
+import (
+	"net"
+	"os"
+	"testing"
+
+	"github.com/jet/damon/win32"
+)
+
+func TestCountTCPConnections(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	counts, err := countTCPConnections([]uint32{uint32(os.Getpid())})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if counts[win32.TcpListen] < 1 {
+		t.Fatalf("expected the test listener to be counted: %v", counts)
+	}
+}
@@ -1,22 +1,40 @@
 package metrics
 
 import (
+	"io/ioutil"
 	"net/http"
+	"os"
+	"path/filepath"
 	"sync"
 	"time"
 
 	"github.com/jet/damon/container"
+	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/common/expfmt"
 )
 
 type Metrics struct {
-	Namespace        string
-	Labels           map[string]string
+	Namespace string
+	Labels    map[string]string
+	// ContainerName is added to Labels as the "container" label, unless it is empty
+	ContainerName string
+	// ConnectionPIDs enables the net_connections gauge when set.
+	// It returns the processes whose TCP connections are counted on each scrape
+	ConnectionPIDs   ProcessIDsFn
 	MHzPerCore       float64
 	Cores            int
 	CPULimitHz       float64
 	MemoryLimitBytes float64
+	// IOLimitIOPS, IOLimitBandwidthBytes and NetLimitBandwidthBytes are the configured IO and network caps.
+	// 0 means no limit is enforced
+	IOLimitIOPS            float64
+	IOLimitBandwidthBytes  float64
+	NetLimitBandwidthBytes float64
+	// CPUSmoothing is the weight (0-1] of the latest sample in the exponential moving average
+	// of the cpu percent gauges. 0 exports the raw percentages
+	CPUSmoothing float64
 
 	cpuCollector *CPUCollector
 	registry     *prometheus.Registry
@@ -25,6 +43,8 @@ type Metrics struct {
 	// cpu
 	cpuKernelTime    prometheus.Gauge
 	cpuUserTime      prometheus.Gauge
+	cpuPeriodKernel  prometheus.Gauge
+	cpuPeriodUser    prometheus.Gauge
 	cpuKernelPercent prometheus.Gauge
 	cpuUserPercent   prometheus.Gauge
 	cpuKernelHz      prometheus.Gauge
@@ -32,10 +52,12 @@ type Metrics struct {
 	cpuLimitHz       prometheus.Gauge
 	cpuLimitPercent  prometheus.Gauge
 	cpuNotification  prometheus.Counter
+	cpuSchedClass    prometheus.Gauge
 
 	// memory
 	memoryWorkingSet     prometheus.Gauge
 	memoryCommitCharge   prometheus.Gauge
+	memoryPagefile       prometheus.Gauge
 	memoryPageFaultCount prometheus.Gauge
 	memoryLimitBytes     prometheus.Gauge
 	memoryNotification   prometheus.Counter
@@ -50,127 +72,184 @@ type Metrics struct {
 	ioOtherOpsTotal   prometheus.Gauge
 	ioTotalOperations prometheus.Gauge
 	ioNotification    prometheus.Counter
+	ioLimitIOPS       prometheus.Gauge
+	ioLimitBandwidth  prometheus.Gauge
+	ioBaseSize        prometheus.Gauge
+
+	// net
+	netLimitBandwidth prometheus.Gauge
+
+	// process
+	processStartSeconds  prometheus.Gauge
+	processStartDuration prometheus.Histogram
+
+	// task
+	taskExitCode prometheus.Gauge
+	taskRunTime  prometheus.Gauge
 }
 
-func (m *Metrics) Init() {
+// Init creates and registers the metrics.
+// It returns an error when they can't be registered, e.g. because the namespace or a label name is invalid
+func (m *Metrics) Init() error {
 	m.cpuCollector = &CPUCollector{
 		MHzPerCore: m.MHzPerCore,
 		Cores:      m.Cores,
+		Smoothing:  m.CPUSmoothing,
 	}
+	labels := m.constLabels()
 	m.registry = prometheus.NewRegistry()
-	m.handler = promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+	// a collector that fails, such as net_connections, only leaves out its own metrics rather than failing the scrape
+	m.handler = promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{ErrorHandling: promhttp.ContinueOnError})
+	var err error
+	register := func(c prometheus.Collector) {
+		if err == nil {
+			err = m.registry.Register(c)
+		}
+	}
 	m.cpuKernelTime = prometheus.NewGauge(prometheus.GaugeOpts{
 		Namespace:   m.Namespace,
 		Subsystem:   "cpu",
 		Name:        "kernel_seconds",
 		Help:        `The number of seconds the process spent in kernel-mode`,
-		ConstLabels: prometheus.Labels(m.Labels),
+		ConstLabels: labels,
 	})
-	m.registry.MustRegister(m.cpuKernelTime)
+	register(m.cpuKernelTime)
 	m.cpuUserTime = prometheus.NewGauge(prometheus.GaugeOpts{
 		Namespace:   m.Namespace,
 		Subsystem:   "cpu",
 		Name:        "user_seconds",
 		Help:        `The number of seconds the process spent in user-mode`,
-		ConstLabels: prometheus.Labels(m.Labels),
+		ConstLabels: labels,
 	})
-	m.registry.MustRegister(m.cpuUserTime)
+	register(m.cpuUserTime)
+	m.cpuPeriodKernel = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace:   m.Namespace,
+		Subsystem:   "cpu",
+		Name:        "period_kernel_seconds",
+		Help:        `The number of seconds the process spent in kernel-mode since the accounting period was last reset`,
+		ConstLabels: labels,
+	})
+	register(m.cpuPeriodKernel)
+	m.cpuPeriodUser = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace:   m.Namespace,
+		Subsystem:   "cpu",
+		Name:        "period_user_seconds",
+		Help:        `The number of seconds the process spent in user-mode since the accounting period was last reset`,
+		ConstLabels: labels,
+	})
+	register(m.cpuPeriodUser)
 	m.cpuKernelPercent = prometheus.NewGauge(prometheus.GaugeOpts{
 		Namespace:   m.Namespace,
 		Subsystem:   "cpu",
 		Name:        "kernel_percent",
 		Help:        `Percent of the total cpu time this process executed in kernel mode. This is calculated by measuring the total nanoseconds this process spend in kernel mode, and dividing it by the total available cpu time (cores * uptime)`,
-		ConstLabels: prometheus.Labels(m.Labels),
+		ConstLabels: labels,
 	})
-	m.registry.MustRegister(m.cpuKernelPercent)
+	register(m.cpuKernelPercent)
 	m.cpuUserPercent = prometheus.NewGauge(prometheus.GaugeOpts{
 		Namespace:   m.Namespace,
 		Subsystem:   "cpu",
 		Name:        "user_percent",
 		Help:        `Percent of the total cpu time this process executed in user mode.  This is calculated by measuring the total nanoseconds this process spend in user mode, and dividing it by the total available cpu time (cores * uptime)`,
-		ConstLabels: prometheus.Labels(m.Labels),
+		ConstLabels: labels,
 	})
-	m.registry.MustRegister(m.cpuUserPercent)
+	register(m.cpuUserPercent)
 	m.cpuKernelHz = prometheus.NewGauge(prometheus.GaugeOpts{
 		Namespace:   m.Namespace,
 		Subsystem:   "cpu",
 		Name:        "kernel_hz",
 		Help:        `Kernel-mode time converted to Hz. This is calculated by taking the kernel percent and multiplying with the total available CPU hz (cores * hz per core)`,
-		ConstLabels: prometheus.Labels(m.Labels),
+		ConstLabels: labels,
 	})
-	m.registry.MustRegister(m.cpuKernelHz)
+	register(m.cpuKernelHz)
 	m.cpuUserHz = prometheus.NewGauge(prometheus.GaugeOpts{
 		Namespace:   m.Namespace,
 		Subsystem:   "cpu",
 		Name:        "user_hz",
 		Help:        `User-mode time converted to Hz. This is calculated by taking the user percent and multiplying with the total available CPU hz (cores * hz per core)`,
-		ConstLabels: prometheus.Labels(m.Labels),
+		ConstLabels: labels,
 	})
-	m.registry.MustRegister(m.cpuUserHz)
+	register(m.cpuUserHz)
 	m.cpuLimitHz = prometheus.NewGauge(prometheus.GaugeOpts{
 		Namespace:   m.Namespace,
 		Subsystem:   "cpu",
 		Name:        "limit_hz",
 		Help:        "The configured CPU usage limit in Hz.",
-		ConstLabels: prometheus.Labels(m.Labels),
+		ConstLabels: labels,
 	})
-	m.registry.MustRegister(m.cpuLimitHz)
+	register(m.cpuLimitHz)
 	m.cpuLimitPercent = prometheus.NewGauge(prometheus.GaugeOpts{
 		Namespace:   m.Namespace,
 		Subsystem:   "cpu",
 		Name:        "limit_percent",
 		Help:        "The configured CPU usage limit as a percentage of total system Hz available.",
-		ConstLabels: prometheus.Labels(m.Labels),
+		ConstLabels: labels,
 	})
-	m.registry.MustRegister(m.cpuLimitPercent)
+	register(m.cpuLimitPercent)
 	m.cpuNotification = prometheus.NewCounter(prometheus.CounterOpts{
 		Namespace:   m.Namespace,
 		Subsystem:   "cpu",
 		Name:        "notifications_total",
 		Help:        `Total number of CPU limit exceeded notifications.`,
-		ConstLabels: prometheus.Labels(m.Labels),
+		ConstLabels: labels,
+	})
+	register(m.cpuNotification)
+	m.cpuSchedClass = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace:   m.Namespace,
+		Subsystem:   "cpu",
+		Name:        "scheduling_class",
+		Help:        "The scheduling class (0-9) in effect for the job object. The system default is 5.",
+		ConstLabels: labels,
 	})
-	m.registry.MustRegister(m.cpuNotification)
+	register(m.cpuSchedClass)
 	m.memoryWorkingSet = prometheus.NewGauge(prometheus.GaugeOpts{
 		Namespace:   m.Namespace,
 		Subsystem:   "memory",
 		Name:        "working_set_bytes",
-		Help:        `The current working set size, in bytes`,
-		ConstLabels: prometheus.Labels(m.Labels),
+		Help:        `The current working set size, in bytes. The working set is the memory of the process that is resident in physical memory, unlike the commit charge that also counts paged out memory.`,
+		ConstLabels: labels,
 	})
-	m.registry.MustRegister(m.memoryWorkingSet)
+	register(m.memoryWorkingSet)
 	m.memoryCommitCharge = prometheus.NewGauge(prometheus.GaugeOpts{
 		Namespace:   m.Namespace,
 		Subsystem:   "memory",
 		Name:        "commit_charge_bytes",
 		Help:        `The Commit Charge value in bytes for this process. Commit Charge is the total amount of memory that the memory manager has committed for a running process.`,
-		ConstLabels: prometheus.Labels(m.Labels),
+		ConstLabels: labels,
 	})
-	m.registry.MustRegister(m.memoryCommitCharge)
+	register(m.memoryCommitCharge)
+	m.memoryPagefile = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace:   m.Namespace,
+		Subsystem:   "memory",
+		Name:        "pagefile_bytes",
+		Help:        `The Pagefile Usage value in bytes for this process. It is the committed memory that the page file is charged for, which grows with the paging pressure on the process.`,
+		ConstLabels: labels,
+	})
+	register(m.memoryPagefile)
 	m.memoryPageFaultCount = prometheus.NewGauge(prometheus.GaugeOpts{
 		Namespace:   m.Namespace,
 		Subsystem:   "memory",
 		Name:        "page_fault_total",
 		Help:        `The number of page faults.`,
-		ConstLabels: prometheus.Labels(m.Labels),
+		ConstLabels: labels,
 	})
-	m.registry.MustRegister(m.memoryPageFaultCount)
+	register(m.memoryPageFaultCount)
 	m.memoryLimitBytes = prometheus.NewGauge(prometheus.GaugeOpts{
 		Namespace:   m.Namespace,
 		Subsystem:   "memory",
 		Name:        "limit_bytes",
 		Help:        "The configured Memory limit in bytes.",
-		ConstLabels: prometheus.Labels(m.Labels),
+		ConstLabels: labels,
 	})
-	m.registry.MustRegister(m.memoryLimitBytes)
+	register(m.memoryLimitBytes)
 	m.memoryNotification = prometheus.NewCounter(prometheus.CounterOpts{
 		Namespace:   m.Namespace,
 		Subsystem:   "memory",
 		Name:        "notifications_total",
 		Help:        `Total number of Memory limit exceeded notifications.`,
-		ConstLabels: prometheus.Labels(m.Labels),
+		ConstLabels: labels,
 	})
-	m.registry.MustRegister(m.memoryNotification)
+	register(m.memoryNotification)
 
 	// io operations
 	m.ioReadOpsTotal = prometheus.NewGauge(prometheus.GaugeOpts{
@@ -178,95 +257,190 @@ func (m *Metrics) Init() {
 		Subsystem:   "io",
 		Name:        "read_operations_total",
 		Help:        `Total number of read IO operations.`,
-		ConstLabels: prometheus.Labels(m.Labels),
+		ConstLabels: labels,
 	})
-	m.registry.MustRegister(m.ioReadOpsTotal)
+	register(m.ioReadOpsTotal)
 	m.ioWriteOpsTotal = prometheus.NewGauge(prometheus.GaugeOpts{
 		Namespace:   m.Namespace,
 		Subsystem:   "io",
 		Name:        "write_operations_total",
 		Help:        `Total number of write IO operations.`,
-		ConstLabels: prometheus.Labels(m.Labels),
+		ConstLabels: labels,
 	})
-	m.registry.MustRegister(m.ioWriteOpsTotal)
+	register(m.ioWriteOpsTotal)
 	m.ioOtherOpsTotal = prometheus.NewGauge(prometheus.GaugeOpts{
 		Namespace:   m.Namespace,
 		Subsystem:   "io",
 		Name:        "other_operations_total",
 		Help:        `Total number of other IO operations.`,
-		ConstLabels: prometheus.Labels(m.Labels),
+		ConstLabels: labels,
 	})
-	m.registry.MustRegister(m.ioOtherOpsTotal)
+	register(m.ioOtherOpsTotal)
 	m.ioTotalOperations = prometheus.NewGauge(prometheus.GaugeOpts{
 		Namespace:   m.Namespace,
 		Subsystem:   "io",
 		Name:        "operations_total",
 		Help:        `Total number of IO operations.`,
-		ConstLabels: prometheus.Labels(m.Labels),
+		ConstLabels: labels,
 	})
-	m.registry.MustRegister(m.ioTotalOperations)
+	register(m.ioTotalOperations)
 	// io bytes
 	m.ioTxReadBytes = prometheus.NewGauge(prometheus.GaugeOpts{
 		Namespace:   m.Namespace,
 		Subsystem:   "io",
 		Name:        "read_bytes",
 		Help:        `Total number of IO read bytes transferred.`,
-		ConstLabels: prometheus.Labels(m.Labels),
+		ConstLabels: labels,
 	})
-	m.registry.MustRegister(m.ioTxReadBytes)
+	register(m.ioTxReadBytes)
 	m.ioTxWriteBytes = prometheus.NewGauge(prometheus.GaugeOpts{
 		Namespace:   m.Namespace,
 		Subsystem:   "io",
 		Name:        "write_bytes",
 		Help:        `Total number of IO write bytes transferred.`,
-		ConstLabels: prometheus.Labels(m.Labels),
+		ConstLabels: labels,
 	})
-	m.registry.MustRegister(m.ioTxWriteBytes)
+	register(m.ioTxWriteBytes)
 	m.ioTxOtherBytes = prometheus.NewGauge(prometheus.GaugeOpts{
 		Namespace:   m.Namespace,
 		Subsystem:   "io",
 		Name:        "other_bytes",
 		Help:        `Total number of IO other bytes transferred.`,
-		ConstLabels: prometheus.Labels(m.Labels),
+		ConstLabels: labels,
 	})
-	m.registry.MustRegister(m.ioTxOtherBytes)
+	register(m.ioTxOtherBytes)
 	m.ioTxTotalBytes = prometheus.NewGauge(prometheus.GaugeOpts{
 		Namespace:   m.Namespace,
 		Subsystem:   "io",
 		Name:        "total_bytes",
 		Help:        `Total number of IO bytes trasferred.`,
-		ConstLabels: prometheus.Labels(m.Labels),
+		ConstLabels: labels,
 	})
-	m.registry.MustRegister(m.ioTxTotalBytes)
+	register(m.ioTxTotalBytes)
 	// io notifications
 	m.ioNotification = prometheus.NewCounter(prometheus.CounterOpts{
 		Namespace:   m.Namespace,
 		Subsystem:   "io",
 		Name:        "notifications_total",
 		Help:        `Total number of IO limit exceeded notifications.`,
-		ConstLabels: prometheus.Labels(m.Labels),
+		ConstLabels: labels,
+	})
+	register(m.ioNotification)
+	// io limits
+	m.ioLimitIOPS = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace:   m.Namespace,
+		Subsystem:   "io",
+		Name:        "limit_iops",
+		Help:        "The configured IO operations per second limit. 0 when IO isn't limited.",
+		ConstLabels: labels,
+	})
+	register(m.ioLimitIOPS)
+	m.ioLimitBandwidth = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace:   m.Namespace,
+		Subsystem:   "io",
+		Name:        "limit_bandwidth_bytes",
+		Help:        "The configured IO bandwidth limit in bytes per second. 0 when IO isn't limited.",
+		ConstLabels: labels,
+	})
+	register(m.ioLimitBandwidth)
+	m.ioBaseSize = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace:   m.Namespace,
+		Subsystem:   "io",
+		Name:        "base_size_bytes",
+		Help:        "The effective size of the normalized IO unit the IOPS limit is counted in. An operation of n times this size counts as n operations. 0 when IO isn't limited.",
+		ConstLabels: labels,
+	})
+	register(m.ioBaseSize)
+	// net limits
+	m.netLimitBandwidth = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace:   m.Namespace,
+		Subsystem:   "net",
+		Name:        "limit_bandwidth_bytes",
+		Help:        "The configured outgoing network bandwidth limit in bytes per second. 0 when the network isn't limited.",
+		ConstLabels: labels,
+	})
+	register(m.netLimitBandwidth)
+	// process start
+	m.processStartSeconds = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace:   m.Namespace,
+		Subsystem:   "process",
+		Name:        "start_seconds",
+		Help:        "The number of seconds it took to create, limit and resume the most recently started process.",
+		ConstLabels: labels,
+	})
+	register(m.processStartSeconds)
+	m.processStartDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace:   m.Namespace,
+		Subsystem:   "process",
+		Name:        "start_duration_seconds",
+		Help:        "The distribution of the number of seconds it took to create, limit and resume the process, across starts.",
+		Buckets:     StartDurationBuckets,
+		ConstLabels: labels,
+	})
+	register(m.processStartDuration)
+	// task exit
+	m.taskExitCode = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace:   m.Namespace,
+		Subsystem:   "task",
+		Name:        "exit_code",
+		Help:        "The exit code of the process. Only set once the process has exited.",
+		ConstLabels: labels,
+	})
+	register(m.taskExitCode)
+	m.taskRunTime = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace:   m.Namespace,
+		Subsystem:   "task",
+		Name:        "run_time_seconds",
+		Help:        "The number of seconds the process ran for. Only set once the process has exited.",
+		ConstLabels: labels,
 	})
-	m.registry.MustRegister(m.ioNotification)
+	register(m.taskRunTime)
+	register(NewSelfCollector(m.Namespace, labels))
+	if m.ConnectionPIDs != nil {
+		register(NewTCPConnectionsCollector(m.Namespace, labels, m.ConnectionPIDs))
+	}
+	return errors.Wrapf(err, "metrics: unable to register collector")
+}
+
+// ContainerLabel is the name of the label holding the container name
+const ContainerLabel = "container"
+
+func (m *Metrics) constLabels() prometheus.Labels {
+	labels := make(prometheus.Labels, len(m.Labels)+1)
+	for k, v := range m.Labels {
+		labels[k] = v
+	}
+	// an empty label is the same as a missing label to prometheus
+	if m.ContainerName != "" {
+		labels[ContainerLabel] = m.ContainerName
+	}
+	return labels
 }
 
 func (m *Metrics) OnStats(stats container.ProcessStats) {
 	sample := m.cpuCollector.Sample(CPUMeasurement{
-		TotalTime:  stats.CPUStats.TotalCPUTime,
+		TotalTime:  stats.CPUStats.TotalRunTime,
 		UserTime:   stats.CPUStats.TotalUserTime,
 		KernelTime: stats.CPUStats.TotalKernelTime,
 	})
 	// cpu
 	m.cpuUserTime.Set(stats.CPUStats.TotalUserTime.Seconds())
 	m.cpuKernelTime.Set(stats.CPUStats.TotalKernelTime.Seconds())
+	m.cpuPeriodUser.Set(stats.CPUStats.ThisPeriodUserTime.Seconds())
+	m.cpuPeriodKernel.Set(stats.CPUStats.ThisPeriodKernelTime.Seconds())
 	m.cpuKernelHz.Set(float64(sample.KernelHz))
-	m.cpuKernelPercent.Set(sample.KernelPercent)
+	m.cpuKernelPercent.Set(sample.SmoothedKernelPercent)
 	m.cpuUserHz.Set(float64(sample.UserHz))
-	m.cpuUserPercent.Set(sample.UserPercent)
+	m.cpuUserPercent.Set(sample.SmoothedUserPercent)
 	m.cpuLimitHz.Set(m.CPULimitHz)
-	m.cpuLimitPercent.Set(m.CPULimitHz / (m.MHzPerCore * float64(m.Cores) * 1000000.0))
+	if totalHz := m.MHzPerCore * float64(m.Cores) * 1000000.0; totalHz > 0 {
+		m.cpuLimitPercent.Set(m.CPULimitHz / totalHz)
+	}
+	m.cpuSchedClass.Set(float64(stats.CPUStats.SchedulingClass))
 	// memory
 	m.memoryCommitCharge.Set(float64(stats.MemoryStats.PrivateUsageBytes))
 	m.memoryWorkingSet.Set(float64(stats.MemoryStats.WorkingSetSizeBytes))
+	m.memoryPagefile.Set(float64(stats.MemoryStats.PagefileUsageBytes))
 	m.memoryPageFaultCount.Set(float64(stats.MemoryStats.PageFaultCount))
 	m.memoryLimitBytes.Set(m.MemoryLimitBytes)
 	// io
@@ -278,6 +452,42 @@ func (m *Metrics) OnStats(stats container.ProcessStats) {
 	m.ioWriteOpsTotal.Set(float64(stats.IOStats.TotalWriteIOOperations))
 	m.ioOtherOpsTotal.Set(float64(stats.IOStats.TotalOtherIOOperations))
 	m.ioTotalOperations.Set(float64(stats.IOStats.TotalIOOperations))
+	m.ioLimitIOPS.Set(m.IOLimitIOPS)
+	m.ioLimitBandwidth.Set(m.IOLimitBandwidthBytes)
+	m.ioBaseSize.Set(float64(stats.IOStats.BaseSizeBytes))
+	// net
+	m.netLimitBandwidth.Set(m.NetLimitBandwidthBytes)
+}
+
+// Reset forgets the state of the previous process, so that the next OnStats doesn't report the difference
+// between its counters and the new process' counters, which start over at 0.
+// Call it when the process is restarted with the same Metrics. The limits, notification counters
+// and start durations are kept
+func (m *Metrics) Reset() {
+	m.cpuCollector.Reset()
+	for _, g := range []prometheus.Gauge{
+		m.cpuKernelTime, m.cpuUserTime, m.cpuPeriodKernel, m.cpuPeriodUser,
+		m.cpuKernelPercent, m.cpuUserPercent, m.cpuKernelHz, m.cpuUserHz,
+		m.memoryWorkingSet, m.memoryCommitCharge, m.memoryPagefile, m.memoryPageFaultCount,
+		m.ioTxTotalBytes, m.ioTxReadBytes, m.ioTxWriteBytes, m.ioTxOtherBytes,
+		m.ioReadOpsTotal, m.ioWriteOpsTotal, m.ioOtherOpsTotal, m.ioTotalOperations,
+	} {
+		g.Set(0)
+	}
+}
+
+// StartDurationBuckets are the process start histogram buckets, in seconds
+var StartDurationBuckets = []float64{.01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30}
+
+func (m *Metrics) OnStart(latency time.Duration) {
+	m.processStartSeconds.Set(latency.Seconds())
+	m.processStartDuration.Observe(latency.Seconds())
+}
+
+// OnExit records the outcome of the process once it has exited
+func (m *Metrics) OnExit(result container.Result, runTime time.Duration) {
+	m.taskExitCode.Set(float64(result.ExitCode))
+	m.taskRunTime.Set(runTime.Seconds())
 }
 
 func (m *Metrics) OnViolation(v container.LimitViolation) {
@@ -295,16 +505,57 @@ func (m *Metrics) Handler() http.Handler {
 	return m.handler
 }
 
+// WriteToFile writes the current value of the metrics to path in the prometheus text format,
+// e.g. for the textfile collector of node_exporter on hosts that can't be scraped.
+// The metrics are written to a temporary file in the same directory, which then replaces path,
+// so that readers never see a partially written file.
+// When a collector fails, the other metrics are still written and the error is returned
+func (m *Metrics) WriteToFile(path string) error {
+	// the metrics that were gathered are written even when some collector failed, like the handler serves them
+	mfs, gatherErr := m.registry.Gather()
+	// the textfile collector only reads *.prom files, so it ignores the temporary file
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return errors.Wrapf(err, "metrics: unable to create a temporary file for %s", path)
+	}
+	enc := expfmt.NewEncoder(f, expfmt.FmtText)
+	for _, mf := range mfs {
+		if err = enc.Encode(mf); err != nil {
+			break
+		}
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return errors.Wrapf(err, "metrics: unable to write metrics to %s", path)
+	}
+	return errors.Wrapf(gatherErr, "metrics: some metrics written to %s couldn't be gathered", path)
+}
+
 type CPUCollector struct {
 	LastTotalDuration  time.Duration
 	LastUserDuration   time.Duration
 	LastKernelDuration time.Duration
 	Cores              int
 	MHzPerCore         float64
-	lock               sync.Mutex
+	// Smoothing is the weight (0-1] of the latest sample in the exponential moving average of the percentages.
+	// 0 disables smoothing
+	Smoothing float64
+
+	lock          sync.Mutex
+	smoothed      bool
+	kernelPercent float64
+	userPercent   float64
 }
 
 type CPUMeasurement struct {
+	// TotalTime is the wall-clock time the process has been running.
+	// The collector multiplies it by the number of cores to get the available CPU time
 	TotalTime  time.Duration
 	UserTime   time.Duration
 	KernelTime time.Duration
@@ -319,6 +570,22 @@ type CPUSample struct {
 	KernelHz        uint64
 	UserPercent     float64
 	UserHz          uint64
+	// SmoothedKernelPercent and SmoothedUserPercent are the exponential moving averages of the percentages.
+	// They are the raw percentages when smoothing is disabled
+	SmoothedKernelPercent float64
+	SmoothedUserPercent   float64
+}
+
+// Reset clears the previous measurement and the moving averages, so the next sample is a first sample
+func (c *CPUCollector) Reset() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.LastTotalDuration = 0
+	c.LastUserDuration = 0
+	c.LastKernelDuration = 0
+	c.smoothed = false
+	c.kernelPercent = 0
+	c.userPercent = 0
 }
 
 func (c *CPUCollector) Sample(m CPUMeasurement) CPUSample {
@@ -331,25 +598,57 @@ func (c *CPUCollector) Sample(m CPUMeasurement) CPUSample {
 	c.LastUserDuration = m.UserTime
 	c.lock.Unlock()
 
+	// when the number of cores couldn't be determined,
+	// fall back to the percent of a single core's elapsed time
+	cores := c.Cores
+	if cores <= 0 {
+		cores = 1
+	}
 	// total cpu time = total time * num cores
-	ttime := (m.TotalTime - t0) * time.Duration(c.Cores)
-	tmhz := c.MHzPerCore * float64(c.Cores)
+	ttime := (m.TotalTime - t0) * time.Duration(cores)
+	tmhz := c.MHzPerCore * float64(cores)
 
-	kperc := float64(m.KernelTime-k0) / float64(ttime)
-	uperc := float64(m.UserTime-u0) / float64(ttime)
+	// no CPU time was available since the last sample, e.g. on the first sample of a process
+	// that hasn't run yet: the percentages stay 0 instead of NaN, which prometheus can't aggregate
+	var kperc, uperc float64
+	if ttime > 0 {
+		kperc = float64(m.KernelTime-k0) / float64(ttime)
+		uperc = float64(m.UserTime-u0) / float64(ttime)
+	}
 
 	mHzToHz := 1000000.0
 	khz := uint64(kperc * mHzToHz * tmhz)
 	uhz := uint64(uperc * mHzToHz * tmhz)
+	skperc, superc := c.smooth(kperc, uperc)
 
 	return CPUSample{
-		DeltaTotalTime:  m.TotalTime - t0,
-		DeltaKernelTime: m.KernelTime - k0,
-		DeltaUserTime:   m.UserTime - k0,
-		KernelHz:        khz,
-		KernelPercent:   kperc,
-		UserHz:          uhz,
-		UserPercent:     uperc,
-		Measurement:     m,
+		DeltaTotalTime:        m.TotalTime - t0,
+		DeltaKernelTime:       m.KernelTime - k0,
+		DeltaUserTime:         m.UserTime - u0,
+		KernelHz:              khz,
+		KernelPercent:         kperc,
+		UserHz:                uhz,
+		UserPercent:           uperc,
+		SmoothedKernelPercent: skperc,
+		SmoothedUserPercent:   superc,
+		Measurement:           m,
+	}
+}
+
+// smooth adds the percentages to their exponential moving averages and returns them.
+// The first sample starts the averages
+func (c *CPUCollector) smooth(kperc, uperc float64) (float64, float64) {
+	if c.Smoothing <= 0 || c.Smoothing > 1 {
+		return kperc, uperc
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.smoothed {
+		kperc = c.Smoothing*kperc + (1-c.Smoothing)*c.kernelPercent
+		uperc = c.Smoothing*uperc + (1-c.Smoothing)*c.userPercent
 	}
+	c.smoothed = true
+	c.kernelPercent = kperc
+	c.userPercent = uperc
+	return kperc, uperc
 }
@@ -1,12 +1,23 @@
 package metrics
 
 import (
+	"io/ioutil"
 	"math"
 	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"reflect"
+	"strings"
 	"testing"
 	"testing/quick"
 	"time"
+
+	"github.com/jet/damon/container"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
 )
 
 type testSensor struct {
@@ -67,3 +78,440 @@ func TestCPUSampler(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestOnStatsAffinityLimited(t *testing.T) {
+	// the process is limited to 2 of the 8 cores and keeps both of them busy
+	const cores = 8
+	const busyCores = 2
+	m := &Metrics{
+		Cores:      cores,
+		MHzPerCore: 2000,
+	}
+	if err := m.Init(); err != nil {
+		t.Fatal(err)
+	}
+	runTime := 10 * time.Second
+	for i := 1; i <= 2; i++ {
+		wall := time.Duration(i) * runTime
+		m.OnStats(container.ProcessStats{
+			CPUStats: container.CPUStats{
+				TotalRunTime:    wall,
+				TotalCPUTime:    wall * cores,
+				TotalUserTime:   wall * busyCores * 3 / 4,
+				TotalKernelTime: wall * busyCores / 4,
+			},
+		})
+	}
+	user := gaugeValue(t, m.cpuUserPercent)
+	kernel := gaugeValue(t, m.cpuKernelPercent)
+	expected := float64(busyCores) / float64(cores)
+	if total := user + kernel; math.Abs(total-expected) > 0.001 {
+		t.Fatalf("cpu percent = %.5f; expected %.5f", total, expected)
+	}
+	if math.Abs(user-expected*3/4) > 0.001 {
+		t.Fatalf("user percent = %.5f; expected %.5f", user, expected*3/4)
+	}
+}
+
+func gaugeValue(t *testing.T, g prometheus.Gauge) float64 {
+	t.Helper()
+	var pb dto.Metric
+	if err := g.Write(&pb); err != nil {
+		t.Fatal(err)
+	}
+	return pb.GetGauge().GetValue()
+}
+
+func TestContainerLabel(t *testing.T) {
+	tests := []struct {
+		name     string
+		expected bool
+	}{
+		{name: "", expected: false},
+		{name: "web-1234", expected: true},
+	}
+	for _, test := range tests {
+		m := &Metrics{
+			Namespace:     "damon",
+			Labels:        map[string]string{"nomad_task_name": "web"},
+			ContainerName: test.name,
+		}
+		if err := m.Init(); err != nil {
+			t.Fatal(err)
+		}
+		mfs, err := m.registry.Gather()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, mf := range mfs {
+			for _, metric := range mf.GetMetric() {
+				found := false
+				for _, lp := range metric.GetLabel() {
+					if lp.GetName() == ContainerLabel {
+						found = true
+						if lp.GetValue() != test.name {
+							t.Errorf("%s: container label = %q; expected %q", mf.GetName(), lp.GetValue(), test.name)
+						}
+					}
+				}
+				if found != test.expected {
+					t.Errorf("%s: container label present = %v; expected %v", mf.GetName(), found, test.expected)
+				}
+			}
+		}
+	}
+}
+
+func TestCPUSamplerUnknownCores(t *testing.T) {
+	err := quick.Check(func(kernPerc float64, userPerc float64, mhz float64) bool {
+		sensor := testSensor{
+			StartTime:  time.Now(),
+			Cores:      1,
+			TimeScale:  1000.0,
+			KernelPerc: kernPerc,
+			UserPerc:   userPerc,
+		}
+		s := &CPUCollector{
+			Cores:      0,
+			MHzPerCore: mhz,
+		}
+		for i := 0; i < 5; i++ {
+			time.Sleep(1 * time.Millisecond)
+			sample := s.Sample(sensor.MeasureCPU())
+			for _, v := range []float64{sample.UserPercent, sample.KernelPercent} {
+				if math.IsNaN(v) || math.IsInf(v, 0) {
+					t.Errorf("percent is not a number: user=%f, kernel=%f", sample.UserPercent, sample.KernelPercent)
+					return false
+				}
+			}
+			if math.Abs(sample.UserPercent-userPerc) > 0.01 {
+				t.Errorf("user percent expected delta too great: expected=%.5f, actual=%.5f", userPerc, sample.UserPercent)
+				return false
+			}
+		}
+		return true
+	}, &quick.Config{
+		Values: func(v []reflect.Value, r *rand.Rand) {
+			v[0] = reflect.ValueOf(r.Float64())
+			v[1] = reflect.ValueOf(r.Float64())
+			// include an unknown MHz
+			v[2] = reflect.ValueOf(float64(r.Int63n(2)) * (1000 + r.Float64()*2000))
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCPUSamplerNoElapsedTime(t *testing.T) {
+	s := &CPUCollector{Cores: 4, MHzPerCore: 2000}
+	m := CPUMeasurement{TotalTime: time.Second, UserTime: time.Second}
+	s.Sample(m)
+	sample := s.Sample(m)
+	if sample.UserPercent != 0 || sample.KernelPercent != 0 {
+		t.Fatalf("expected 0 percent when no time elapsed: user=%f, kernel=%f", sample.UserPercent, sample.KernelPercent)
+	}
+}
+
+func TestCPUSamplerFirstSample(t *testing.T) {
+	err := quick.Check(func(total, user, kernel time.Duration, cores int64, mhz float64) bool {
+		s := &CPUCollector{
+			Cores:      int(cores),
+			MHzPerCore: mhz,
+			Smoothing:  0.5,
+		}
+		m := CPUMeasurement{TotalTime: total, UserTime: user, KernelTime: kernel}
+		// the first sample has no baseline, the second has no elapsed time
+		for i := 0; i < 2; i++ {
+			sample := s.Sample(m)
+			for _, v := range []float64{sample.UserPercent, sample.KernelPercent, sample.SmoothedUserPercent, sample.SmoothedKernelPercent} {
+				if math.IsNaN(v) || math.IsInf(v, 0) {
+					t.Errorf("sample %d: percent is not a number: %+v", i, sample)
+					return false
+				}
+			}
+		}
+		return true
+	}, &quick.Config{
+		Values: func(v []reflect.Value, r *rand.Rand) {
+			// include a process that hasn't run yet
+			total := time.Duration(r.Int63n(2) * r.Int63n(int64(time.Hour)))
+			v[0] = reflect.ValueOf(total)
+			v[1] = reflect.ValueOf(time.Duration(r.Int63n(int64(total) + 1)))
+			v[2] = reflect.ValueOf(time.Duration(r.Int63n(int64(total) + 1)))
+			v[3] = reflect.ValueOf(r.Int63n(65))
+			v[4] = reflect.ValueOf(float64(r.Int63n(2)) * (1000 + r.Float64()*2000))
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLimitPercent(t *testing.T) {
+	m := &Metrics{
+		Cores:            4,
+		MHzPerCore:       2500,
+		CPULimitHz:       2500 * 1000000,
+		MemoryLimitBytes: 512 * 1024 * 1024,
+	}
+	if err := m.Init(); err != nil {
+		t.Fatal(err)
+	}
+	m.OnStats(container.ProcessStats{})
+	if v := gaugeValue(t, m.cpuLimitHz); v != m.CPULimitHz {
+		t.Errorf("cpu limit_hz = %f; expected %f", v, m.CPULimitHz)
+	}
+	// one of four cores
+	if v := gaugeValue(t, m.cpuLimitPercent); math.Abs(v-0.25) > 0.0001 {
+		t.Errorf("cpu limit_percent = %f; expected %f", v, 0.25)
+	}
+	if v := gaugeValue(t, m.memoryLimitBytes); v != m.MemoryLimitBytes {
+		t.Errorf("memory limit_bytes = %f; expected %f", v, m.MemoryLimitBytes)
+	}
+}
+
+func TestIONetLimits(t *testing.T) {
+	m := &Metrics{
+		IOLimitIOPS:            500,
+		IOLimitBandwidthBytes:  10 * 1024 * 1024,
+		NetLimitBandwidthBytes: 1024 * 1024,
+	}
+	if err := m.Init(); err != nil {
+		t.Fatal(err)
+	}
+	m.OnStats(container.ProcessStats{})
+	if v := gaugeValue(t, m.ioLimitIOPS); v != m.IOLimitIOPS {
+		t.Errorf("io limit_iops = %f; expected %f", v, m.IOLimitIOPS)
+	}
+	if v := gaugeValue(t, m.ioLimitBandwidth); v != m.IOLimitBandwidthBytes {
+		t.Errorf("io limit_bandwidth_bytes = %f; expected %f", v, m.IOLimitBandwidthBytes)
+	}
+	if v := gaugeValue(t, m.netLimitBandwidth); v != m.NetLimitBandwidthBytes {
+		t.Errorf("net limit_bandwidth_bytes = %f; expected %f", v, m.NetLimitBandwidthBytes)
+	}
+}
+
+func TestOnStart(t *testing.T) {
+	m := &Metrics{}
+	if err := m.Init(); err != nil {
+		t.Fatal(err)
+	}
+	m.OnStart(250 * time.Millisecond)
+	m.OnStart(2 * time.Second)
+	if v := gaugeValue(t, m.processStartSeconds); v != 2 {
+		t.Errorf("process start_seconds = %f; expected the latest start of 2", v)
+	}
+	var pb dto.Metric
+	if err := m.processStartDuration.Write(&pb); err != nil {
+		t.Fatal(err)
+	}
+	h := pb.GetHistogram()
+	if h.GetSampleCount() != 2 {
+		t.Errorf("process start_duration_seconds count = %d; expected 2", h.GetSampleCount())
+	}
+	if h.GetSampleSum() != 2.25 {
+		t.Errorf("process start_duration_seconds sum = %f; expected 2.25", h.GetSampleSum())
+	}
+}
+
+func TestOnExit(t *testing.T) {
+	m := &Metrics{}
+	if err := m.Init(); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	m.OnExit(container.Result{Start: start, End: start.Add(90 * time.Second), ExitCode: 3}, 90*time.Second)
+	if v := gaugeValue(t, m.taskExitCode); v != 3 {
+		t.Errorf("task exit_code = %f; expected 3", v)
+	}
+	if v := gaugeValue(t, m.taskRunTime); v != 90 {
+		t.Errorf("task run_time_seconds = %f; expected 90", v)
+	}
+}
+
+func TestCPUSamplerSmoothing(t *testing.T) {
+	s := &CPUCollector{Cores: 1, MHzPerCore: 1000, Smoothing: 0.5}
+	// a square wave alternating between a busy and an idle second
+	var user time.Duration
+	expected := []struct{ raw, smoothed float64 }{
+		{raw: 1, smoothed: 1},
+		{raw: 0, smoothed: 0.5},
+		{raw: 1, smoothed: 0.75},
+		{raw: 0, smoothed: 0.375},
+	}
+	for i, e := range expected {
+		user += time.Duration(e.raw * float64(time.Second))
+		sample := s.Sample(CPUMeasurement{
+			TotalTime: time.Duration(i+1) * time.Second,
+			UserTime:  user,
+		})
+		if sample.UserPercent != e.raw {
+			t.Errorf("sample %d: raw user percent = %f; expected %f", i, sample.UserPercent, e.raw)
+		}
+		if math.Abs(sample.SmoothedUserPercent-e.smoothed) > 0.0001 {
+			t.Errorf("sample %d: smoothed user percent = %f; expected %f", i, sample.SmoothedUserPercent, e.smoothed)
+		}
+	}
+}
+
+func TestCPUSamplerNoSmoothing(t *testing.T) {
+	s := &CPUCollector{Cores: 1, MHzPerCore: 1000}
+	s.Sample(CPUMeasurement{TotalTime: time.Second, UserTime: time.Second})
+	sample := s.Sample(CPUMeasurement{TotalTime: 2 * time.Second, UserTime: time.Second})
+	if sample.SmoothedUserPercent != sample.UserPercent {
+		t.Errorf("smoothed user percent = %f; expected the raw %f", sample.SmoothedUserPercent, sample.UserPercent)
+	}
+}
+
+func TestOnStatsMemory(t *testing.T) {
+	m := &Metrics{Cores: 1, MHzPerCore: 1000}
+	if err := m.Init(); err != nil {
+		t.Fatal(err)
+	}
+	m.OnStats(container.ProcessStats{
+		MemoryStats: container.MemoryStats{
+			WorkingSetSizeBytes: 100,
+			PrivateUsageBytes:   300,
+			PagefileUsageBytes:  200,
+		},
+	})
+	for name, expected := range map[string]struct {
+		g prometheus.Gauge
+		v float64
+	}{
+		"working_set_bytes":   {g: m.memoryWorkingSet, v: 100},
+		"commit_charge_bytes": {g: m.memoryCommitCharge, v: 300},
+		"pagefile_bytes":      {g: m.memoryPagefile, v: 200},
+	} {
+		if v := gaugeValue(t, expected.g); v != expected.v {
+			t.Errorf("memory %s = %f; expected %f", name, v, expected.v)
+		}
+	}
+}
+
+func TestReset(t *testing.T) {
+	m := &Metrics{Cores: 1, MHzPerCore: 1000}
+	if err := m.Init(); err != nil {
+		t.Fatal(err)
+	}
+	m.OnStats(container.ProcessStats{
+		CPUStats: container.CPUStats{
+			TotalRunTime:  time.Hour,
+			TotalUserTime: 30 * time.Minute,
+		},
+		IOStats: container.IOStats{TotalTxCountBytes: 1024},
+	})
+	m.Reset()
+	if v := gaugeValue(t, m.cpuUserTime); v != 0 {
+		t.Errorf("cpu user_seconds = %f after Reset; expected 0", v)
+	}
+	if v := gaugeValue(t, m.ioTxTotalBytes); v != 0 {
+		t.Errorf("io total_bytes = %f after Reset; expected 0", v)
+	}
+	// the restarted process used half of its first 10 seconds,
+	// which would be a negative delta against the previous process
+	m.OnStats(container.ProcessStats{
+		CPUStats: container.CPUStats{
+			TotalRunTime:  10 * time.Second,
+			TotalUserTime: 5 * time.Second,
+		},
+	})
+	if v := gaugeValue(t, m.cpuUserPercent); math.Abs(v-0.5) > 0.0001 {
+		t.Errorf("cpu user_percent = %f after Reset; expected 0.5", v)
+	}
+}
+
+func TestInitError(t *testing.T) {
+	tests := []struct {
+		name string
+		m    *Metrics
+	}{
+		{name: "invalid namespace", m: &Metrics{Namespace: "1damon"}},
+		{name: "invalid label", m: &Metrics{Namespace: "damon", Labels: map[string]string{"not-a-label": "x"}}},
+		{
+			// the connections gauge already has a "state" label
+			name: "duplicate label",
+			m: &Metrics{
+				Namespace:      "damon",
+				Labels:         map[string]string{"state": "x"},
+				ConnectionPIDs: func() ([]uint32, error) { return nil, nil },
+			},
+		},
+	}
+	for _, test := range tests {
+		if err := test.m.Init(); err == nil {
+			t.Errorf("%s: expected Init to return an error", test.name)
+		} else {
+			t.Logf("%s: %v", test.name, err)
+		}
+	}
+}
+
+func TestCollectorErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "damon-metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	m := &Metrics{
+		Namespace: "damon",
+		ConnectionPIDs: func() ([]uint32, error) {
+			return nil, errors.New("job closed")
+		},
+	}
+	if err = m.Init(); err != nil {
+		t.Fatal(err)
+	}
+	m.OnExit(container.Result{ExitCode: 3}, time.Second)
+	rec := httptest.NewRecorder()
+	m.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "damon_task_exit_code 3\n") {
+		t.Errorf("expected the other metrics to be served, got %d:\n%s", rec.Code, rec.Body.String())
+	}
+	path := filepath.Join(dir, "damon.prom")
+	if err = m.WriteToFile(path); err == nil {
+		t.Error("expected WriteToFile to report the failed collector")
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), "damon_task_exit_code 3\n") {
+		t.Errorf("expected the other metrics in the metrics file:\n%s", b)
+	}
+}
+
+func TestWriteToFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "damon-metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	m := &Metrics{Namespace: "damon", MemoryLimitBytes: 1024}
+	if err = m.Init(); err != nil {
+		t.Fatal(err)
+	}
+	m.OnExit(container.Result{ExitCode: 3}, time.Second)
+	path := filepath.Join(dir, "damon.prom")
+	// the second write replaces the first
+	for i := 0; i < 2; i++ {
+		if err = m.WriteToFile(path); err != nil {
+			t.Fatal(err)
+		}
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), "damon_task_exit_code 3\n") {
+		t.Errorf("expected the exit code in the metrics file:\n%s", b)
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Errorf("expected the temporary files to be removed, found %d files", len(files))
+	}
+}
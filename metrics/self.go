@@ -0,0 +1,65 @@
+package metrics
+
+import (
+	"os"
+	"runtime"
+
+	"github.com/jet/damon/win32"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// SelfCollector reports the resources used by damon itself, apart from the process it wraps,
+// so that the cost of supervising a task can be told apart from the task
+type SelfCollector struct {
+	pid        uint32
+	memory     *prometheus.Desc
+	goroutines *prometheus.Desc
+	cpu        *prometheus.Desc
+}
+
+// NewSelfCollector creates a collector for the damon_self_* metrics of the current process
+func NewSelfCollector(namespace string, labels prometheus.Labels) *SelfCollector {
+	return &SelfCollector{
+		pid: uint32(os.Getpid()),
+		memory: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "self", "memory_bytes"),
+			"The working set of damon itself, in bytes. The memory of the wrapped process isn't included.",
+			nil,
+			labels,
+		),
+		goroutines: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "self", "goroutines"),
+			"The number of goroutines of damon.",
+			nil,
+			labels,
+		),
+		cpu: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "self", "cpu_seconds"),
+			"The number of seconds damon itself spent in kernel and user mode. The cpu time of the wrapped process isn't included.",
+			nil,
+			labels,
+		),
+	}
+}
+
+func (c *SelfCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.memory
+	ch <- c.goroutines
+	ch <- c.cpu
+}
+
+// Collect reports a metric that can't be read as invalid.
+// The handler of Metrics continues on errors, so only that metric is left out of the scrape
+func (c *SelfCollector) Collect(ch chan<- prometheus.Metric) {
+	ch <- prometheus.MustNewConstMetric(c.goroutines, prometheus.GaugeValue, float64(runtime.NumGoroutine()))
+	if meminfo, err := win32.ProcessMemoryInfoByPID(c.pid); err != nil {
+		ch <- prometheus.NewInvalidMetric(c.memory, err)
+	} else {
+		ch <- prometheus.MustNewConstMetric(c.memory, prometheus.GaugeValue, float64(meminfo.WorkingSetSize))
+	}
+	if times, err := win32.ProcessTimesByPID(c.pid); err != nil {
+		ch <- prometheus.NewInvalidMetric(c.cpu, err)
+	} else {
+		ch <- prometheus.MustNewConstMetric(c.cpu, prometheus.CounterValue, (times.KernelTime + times.UserTime).Seconds())
+	}
+}
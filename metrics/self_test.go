@@ -0,0 +1,61 @@
+package metrics
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestSelfCollector(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	if err := reg.Register(NewSelfCollector("damon", prometheus.Labels{"container": "test"})); err != nil {
+		t.Fatal(err)
+	}
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := make(map[string]float64)
+	for _, f := range families {
+		m := f.GetMetric()[0]
+		if g := m.GetGauge(); g != nil {
+			values[f.GetName()] = g.GetValue()
+		} else {
+			values[f.GetName()] = m.GetCounter().GetValue()
+		}
+	}
+	for _, name := range []string{"damon_self_memory_bytes", "damon_self_goroutines"} {
+		if values[name] <= 0 {
+			t.Errorf("%s = %v; expected the usage of the test process: %v", name, values[name], values)
+		}
+	}
+	if _, ok := values["damon_self_cpu_seconds"]; !ok {
+		t.Errorf("expected damon_self_cpu_seconds: %v", values)
+	}
+}
+
+func TestSelfCollectorErrors(t *testing.T) {
+	m := &Metrics{Namespace: "damon"}
+	if err := m.Init(); err != nil {
+		t.Fatal(err)
+	}
+	failing := NewSelfCollector("failing", nil)
+	// the idle process can't be opened, so its memory and cpu time can't be read
+	failing.pid = 0
+	m.registry.MustRegister(failing)
+	rec := httptest.NewRecorder()
+	m.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body := rec.Body.String()
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected the scrape to succeed, got %d:\n%s", rec.Code, body)
+	}
+	if !strings.Contains(body, "damon_self_memory_bytes") || !strings.Contains(body, "failing_self_goroutines") {
+		t.Errorf("expected the metrics that could be read:\n%s", body)
+	}
+	if strings.Contains(body, "failing_self_memory_bytes") {
+		t.Errorf("expected the memory that couldn't be read to be left out:\n%s", body)
+	}
+}
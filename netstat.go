@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"text/tabwriter"
+
+	"github.com/jet/damon/win32"
+	"github.com/pkg/errors"
+)
+
+// NetstatFlag is the first argument that makes damon print the connections of a running container instead of starting one.
+// It is followed by the container name, which is also the name of its job object
+const NetstatFlag = "--netstat"
+
+// printConnections writes a netstat-like table of the TCP and UDP endpoints
+// owned by the processes of the job object with the given name
+func printConnections(w io.Writer, name string) error {
+	job, err := win32.OpenJobObject(name)
+	if err != nil {
+		return err
+	}
+	defer job.Close()
+	ids, err := job.ProcessIDs()
+	if err != nil {
+		return errors.Wrapf(err, "unable to list the processes of container %s", name)
+	}
+	pids := make(map[int]bool, len(ids))
+	for _, id := range ids {
+		pids[int(id)] = true
+	}
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "PROTO\tLOCAL ADDRESS\tFOREIGN ADDRESS\tSTATE\tPID\tMODULE")
+	for _, t := range []struct {
+		proto string
+		get   func(bool, win32.TCPTableInclude) ([]win32.TCPOwnerModuleConnection, error)
+	}{
+		{proto: "TCP", get: win32.GetTCPTableIP4OwnerModule},
+		{proto: "TCPv6", get: win32.GetTCPTableIP6OwnerModule},
+	} {
+		table, err := t.get(true, win32.TCPTableAll)
+		if err != nil {
+			return errors.Wrapf(err, "unable to read the %s table", t.proto)
+		}
+		for _, row := range table {
+			if !pids[row.PID] {
+				continue
+			}
+			remote := "*:*"
+			if row.State != win32.TcpListen {
+				remote = hostPort(row.RemoteAddress, row.RemotePort)
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%d\t%s\n", t.proto, hostPort(row.LocalAddress, row.LocalPort), remote, row.State, row.PID, row.ModuleName)
+		}
+	}
+	for _, t := range []struct {
+		proto string
+		get   func(bool) ([]win32.UDPOwnerConnection, error)
+	}{
+		{proto: "UDP", get: win32.GetUDPTableIP4OwnerPID},
+		{proto: "UDPv6", get: win32.GetUDPTableIP6OwnerPID},
+	} {
+		table, err := t.get(true)
+		if err != nil {
+			return errors.Wrapf(err, "unable to read the %s table", t.proto)
+		}
+		for _, row := range table {
+			if !pids[row.PID] {
+				continue
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t\t%d\t\n", t.proto, hostPort(row.LocalAddress, row.LocalPort), "*:*", row.PID)
+		}
+	}
+	return tw.Flush()
+}
+
+func hostPort(ip net.IP, port uint16) string {
+	return net.JoinHostPort(ip.String(), strconv.Itoa(int(port)))
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/jet/damon/win32"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/windows/svc"
+)
+
+// ServiceFlag is the first argument that makes damon run as a Windows service, followed by the command to contain.
+// The service control manager stops the service like an interrupt stops damon in a console
+const ServiceFlag = "--service"
+
+// serviceName is the name damon registers with the service control manager.
+// It is ignored for services that run in their own process, which is how damon is installed
+const serviceName = "damon"
+
+// runService runs the command in args as the process of a Windows service until it exits or the service is stopped.
+// It returns the exit code of damon
+func runService(args []string) int {
+	interactive, err := svc.IsAnInteractiveSession()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, errors.Wrapf(err, "unable to determine if damon runs as a service"))
+		return 1
+	}
+	if interactive {
+		fmt.Fprintf(os.Stderr, "%s must be started by the service control manager, e.g. with sc.exe start\n", ServiceFlag)
+		return 2
+	}
+	// a service has no console, so damon allocates one for the process to share.
+	// Without it, the shutdown signal can't be sent and a stop kills the process
+	if err = win32.AllocConsole(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+	}
+	h := &serviceHandler{args: args}
+	if err = svc.Run(serviceName, h); err != nil {
+		fmt.Fprintln(os.Stderr, errors.Wrapf(err, "unable to run damon as a service"))
+		return 1
+	}
+	return h.exitCode
+}
+
+// serviceHandler runs damon on behalf of the service control manager
+type serviceHandler struct {
+	args     []string
+	exitCode int
+}
+
+func (h *serviceHandler) Execute(_ []string, r <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	status <- svc.Status{State: svc.StartPending}
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh)
+	exitCh := make(chan int, 1)
+	go func() {
+		exitCh <- run(h.args, sigCh)
+	}()
+	accepts := svc.AcceptStop | svc.AcceptShutdown
+	status <- svc.Status{State: svc.Running, Accepts: accepts}
+	for {
+		select {
+		case code := <-exitCh:
+			h.exitCode = code
+			status <- svc.Status{State: svc.StopPending}
+			// a non-zero exit code is reported as a service specific error, so the SCM recovery actions apply
+			return code != 0, uint32(code)
+		case c := <-r:
+			switch c.Cmd {
+			case svc.Interrogate:
+				status <- c.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				// the wait hint tells the SCM not to give up on the service before the process is shut down
+				status <- svc.Status{State: svc.StopPending, Accepts: accepts, WaitHint: uint32(stopWaitHint() / time.Millisecond)}
+				// a second stop kills the process, like a second interrupt in a console
+				select {
+				case sigCh <- syscall.SIGTERM:
+				default:
+				}
+			}
+		}
+	}
+}
+
+// stopWaitHint is how long the service may take to stop: the shutdown timeout, then the kill grace period
+func stopWaitHint() time.Duration {
+	timeout, _ := ShutdownTimeout()
+	grace, err := envToDuration(0, EnvDamonKillGracePeriod)
+	if err != nil || grace <= 0 {
+		grace = win32.DefaultKillGracePeriod
+	}
+	return timeout + grace
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/jet/damon/win32"
+)
+
+// StatsFlag is the first argument that makes damon print the accounting of a running container as JSON and exit.
+// It is followed by the container name, which is also the name of its job object
+const StatsFlag = "--stats"
+
+// jobStats is the JSON snapshot printed by --stats. Fields are only ever added to it, so scripts can rely on it
+type jobStats struct {
+	Name       string         `json:"name"`
+	Time       time.Time      `json:"time"`
+	ProcessIDs []uint32       `json:"process_ids"`
+	Processes  jobProcesses   `json:"processes"`
+	CPU        jobCPUStats    `json:"cpu"`
+	Memory     jobMemoryStats `json:"memory"`
+	IO         jobIOStats     `json:"io"`
+}
+
+type jobProcesses struct {
+	Active     uint32 `json:"active"`
+	Total      uint32 `json:"total"`
+	Terminated uint32 `json:"terminated"`
+}
+
+type jobCPUStats struct {
+	TotalKernelSeconds      float64 `json:"total_kernel_seconds"`
+	TotalUserSeconds        float64 `json:"total_user_seconds"`
+	ThisPeriodKernelSeconds float64 `json:"this_period_kernel_seconds"`
+	ThisPeriodUserSeconds   float64 `json:"this_period_user_seconds"`
+}
+
+// jobMemoryStats sums the memory counters of the processes in the job, which can't be read from the job itself
+type jobMemoryStats struct {
+	WorkingSetBytes  uint64 `json:"working_set_bytes"`
+	PrivateBytes     uint64 `json:"private_bytes"`
+	PagefileBytes    uint64 `json:"pagefile_bytes"`
+	PageFaults       uint32 `json:"page_faults"`
+	PeakProcessBytes uint64 `json:"peak_process_bytes"`
+	PeakJobBytes     uint64 `json:"peak_job_bytes"`
+}
+
+type jobIOStats struct {
+	ReadOperations  uint64 `json:"read_operations"`
+	WriteOperations uint64 `json:"write_operations"`
+	OtherOperations uint64 `json:"other_operations"`
+	ReadBytes       uint64 `json:"read_bytes"`
+	WrittenBytes    uint64 `json:"written_bytes"`
+	OtherBytes      uint64 `json:"other_bytes"`
+}
+
+// printStats writes a JSON snapshot of the accounting of the job object with the given name
+func printStats(w io.Writer, name string) error {
+	job, err := win32.OpenJobObject(name)
+	if err != nil {
+		return err
+	}
+	defer job.Close()
+	acct, err := job.Accounting()
+	if err != nil {
+		return err
+	}
+	ids, err := job.ProcessIDs()
+	if err != nil {
+		return errors.Wrapf(err, "unable to list the processes of container %s", name)
+	}
+	peakProcess, peakJob, err := job.PeakMemoryUsed()
+	if err != nil {
+		return err
+	}
+	stats := jobStats{
+		Name:       name,
+		Time:       time.Now().UTC(),
+		ProcessIDs: ids,
+		Processes: jobProcesses{
+			Active:     acct.Basic.ActiveProcesses,
+			Total:      acct.Basic.TotalProcesses,
+			Terminated: acct.Basic.TotalTerminatedProcesses,
+		},
+		CPU: jobCPUStats{
+			TotalKernelSeconds:      acct.Basic.TotalKernelTime.Seconds(),
+			TotalUserSeconds:        acct.Basic.TotalUserTime.Seconds(),
+			ThisPeriodKernelSeconds: acct.Basic.ThisPeriodTotalKernelTime.Seconds(),
+			ThisPeriodUserSeconds:   acct.Basic.ThisPeriodTotalUserTime.Seconds(),
+		},
+		Memory: jobMemoryStats{
+			PageFaults:       acct.Basic.TotalPageFaultCount,
+			PeakProcessBytes: peakProcess,
+			PeakJobBytes:     peakJob,
+		},
+		IO: jobIOStats{
+			ReadOperations:  acct.IO.ReadOperationCount,
+			WriteOperations: acct.IO.WriteOperationCount,
+			OtherOperations: acct.IO.OtherOperationCount,
+			ReadBytes:       acct.IO.ReadTransferCount,
+			WrittenBytes:    acct.IO.WriteTransferCount,
+			OtherBytes:      acct.IO.OtherTransferCount,
+		},
+	}
+	if stats.ProcessIDs == nil {
+		stats.ProcessIDs = []uint32{}
+	}
+	for _, id := range ids {
+		meminfo, err := win32.ProcessMemoryInfoByPID(id)
+		if err != nil {
+			// the process exited since the processes were listed
+			continue
+		}
+		stats.Memory.WorkingSetBytes += meminfo.WorkingSetSize
+		stats.Memory.PrivateBytes += meminfo.PrivateUsage
+		stats.Memory.PagefileBytes += meminfo.PagefileUsage
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(stats)
+}
@@ -4,8 +4,11 @@ package main
 
 import (
 	"fmt"
+	"io/ioutil"
 	"os"
+	"os/exec"
 	"os/signal"
+	"strconv"
 	"time"
 )
 
@@ -68,6 +71,14 @@ func realMain() int {
 		go eatDiskIO(exitCh, doneCh)
 	case "netio":
 		go eatNetIO(exitCh, doneCh)
+	case "spawn":
+		// start a child that outlives this process unless it is killed with the job, then exit
+		child := exec.Command(os.Args[0], "wait_nosig", getArgDuration(2, 10*time.Second).String())
+		dieOnError(child.Start())
+		if len(os.Args) > 3 {
+			dieOnError(ioutil.WriteFile(os.Args[3], []byte(strconv.Itoa(child.Process.Pid)), 0644))
+		}
+		return 0
 	case "env":
 		for _, env := range os.Environ() {
 			fmt.Println(env)
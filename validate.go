@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+
+	"github.com/pkg/errors"
+
+	"github.com/jet/damon/container"
+	"github.com/jet/damon/win32"
+)
+
+// ValidateFlag is the first argument that makes damon check the configuration in its environment and print it,
+// instead of starting a process
+const ValidateFlag = "--validate"
+
+// validateEnvironment loads the configuration from the environment, checks that its limits can be met
+// by this machine and writes the resolved configuration to w as JSON. It returns the problems found
+func validateEnvironment(w io.Writer) []error {
+	var problems []error
+	cfg, err := LoadContainerConfigFromEnvironment()
+	if err != nil {
+		problems = append(problems, err)
+	}
+	if cfg.ShutdownTimeout, err = ShutdownTimeout(); err != nil {
+		problems = append(problems, err)
+	}
+	if _, err = WorkingDir(); err != nil {
+		problems = append(problems, err)
+	}
+	if _, err = MetricsNamespace(); err != nil {
+		problems = append(problems, err)
+	}
+	if _, err = CPUSmoothing(); err != nil {
+		problems = append(problems, err)
+	}
+	if _, err = MetricsFileInterval(); err != nil {
+		problems = append(problems, err)
+	}
+	if err = cfg.Validate(); err != nil {
+		if errs, ok := err.(container.ConfigErrors); ok {
+			problems = append(problems, errs...)
+		} else {
+			problems = append(problems, err)
+		}
+	}
+	resources := win32.GetSystemResources()
+	problems = append(problems, checkLimits(cfg, resources)...)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err = enc.Encode(configStatus{
+		Container: cfg,
+		System:    resources,
+	}); err != nil {
+		problems = append(problems, errors.Wrapf(err, "unable to write the configuration"))
+	}
+	return problems
+}
+
+// checkLimits returns the limits of cfg that exceed the memory and CPU of the machine, on top of Config.Validate.
+// Resources that couldn't be determined aren't checked
+func checkLimits(cfg container.Config, resources win32.SystemResources) []error {
+	var problems []error
+	// Config.Validate already reports a strict CPU limit
+	if !cfg.StrictCPULimit {
+		if err := cfg.CheckCPULimit(resources.CPUTotalTicks); err != nil {
+			problems = append(problems, err)
+		}
+	}
+	if physicalMB := resources.MemoryTotalPhysicalKB / 1024; physicalMB > 0 {
+		if cfg.EnforceMemory && float64(cfg.MemoryMBLimit) > physicalMB {
+			problems = append(problems, errors.Errorf("memory limit of %d MB exceeds the %.0f MB of physical memory", cfg.MemoryMBLimit, physicalMB))
+		}
+		if float64(cfg.MaxWorkingSetMB) > physicalMB {
+			problems = append(problems, errors.Errorf("maximum working set of %d MB exceeds the %.0f MB of physical memory", cfg.MaxWorkingSetMB, physicalMB))
+		}
+	}
+	return problems
+}
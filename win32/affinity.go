@@ -0,0 +1,68 @@
+package win32
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// AffinityMask is a bit vector in which each bit represents a logical processor
+type AffinityMask uint32
+
+// MaxAffinityCores is the number of logical processors that an AffinityMask can represent
+const MaxAffinityCores = 32
+
+// Cores returns the indexes of the logical processors set in the mask, in ascending order
+func (m AffinityMask) Cores() []int {
+	var cores []int
+	for i := 0; i < MaxAffinityCores; i++ {
+		if m&(1<<uint(i)) != 0 {
+			cores = append(cores, i)
+		}
+	}
+	return cores
+}
+
+// CoresToAffinityMask returns a mask with the bit set for each logical processor index.
+// Indexes outside of [0,MaxAffinityCores) are ignored
+func CoresToAffinityMask(cores []int) AffinityMask {
+	var m AffinityMask
+	for _, c := range cores {
+		if c >= 0 && c < MaxAffinityCores {
+			m |= 1 << uint(c)
+		}
+	}
+	return m
+}
+
+// ParseCoreList parses a list of logical processor indexes and ranges, such as "0-3,6".
+// The cores are returned in the order they are listed. An empty list has no cores
+func ParseCoreList(s string) ([]int, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+	var cores []int
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		lo, hi := part, part
+		if i := strings.Index(part, "-"); i >= 0 {
+			lo, hi = part[:i], part[i+1:]
+		}
+		first, err := strconv.Atoi(strings.TrimSpace(lo))
+		if err != nil {
+			return nil, errors.Wrapf(err, "win32: invalid core '%s' in core list '%s'", part, s)
+		}
+		last, err := strconv.Atoi(strings.TrimSpace(hi))
+		if err != nil {
+			return nil, errors.Wrapf(err, "win32: invalid core '%s' in core list '%s'", part, s)
+		}
+		if first < 0 || last < first {
+			return nil, errors.Errorf("win32: invalid core range '%s' in core list '%s'", part, s)
+		}
+		for c := first; c <= last; c++ {
+			cores = append(cores, c)
+		}
+	}
+	return cores, nil
+}
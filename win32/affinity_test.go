@@ -0,0 +1,60 @@
+package win32
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestAffinityMaskCores(t *testing.T) {
+	tests := []struct {
+		mask  AffinityMask
+		cores []int
+	}{
+		{mask: 0, cores: nil},
+		{mask: 0x1, cores: []int{0}},
+		{mask: 0x5, cores: []int{0, 2}},
+		{mask: 0xF0, cores: []int{4, 5, 6, 7}},
+		{mask: 0x80000001, cores: []int{0, 31}},
+	}
+	for _, test := range tests {
+		if cores := test.mask.Cores(); !reflect.DeepEqual(cores, test.cores) {
+			t.Errorf("AffinityMask(%b).Cores() = %v; expected %v", test.mask, cores, test.cores)
+		}
+		if mask := CoresToAffinityMask(test.cores); mask != test.mask {
+			t.Errorf("CoresToAffinityMask(%v) = %b; expected %b", test.cores, mask, test.mask)
+		}
+	}
+}
+
+func TestCoresToAffinityMaskIgnoresInvalid(t *testing.T) {
+	if mask := CoresToAffinityMask([]int{-1, 1, 1, 32, 64}); mask != 0x2 {
+		t.Errorf("CoresToAffinityMask = %b; expected %b", mask, 0x2)
+	}
+}
+
+func TestParseCoreList(t *testing.T) {
+	tests := []struct {
+		list  string
+		cores []int
+		valid bool
+	}{
+		{list: "", cores: nil, valid: true},
+		{list: "2", cores: []int{2}, valid: true},
+		{list: "0-3,6", cores: []int{0, 1, 2, 3, 6}, valid: true},
+		{list: " 4 - 5 , 1 ", cores: []int{4, 5, 1}, valid: true},
+		{list: "3-1", valid: false},
+		{list: "-1", valid: false},
+		{list: "a", valid: false},
+		{list: "1,,2", valid: false},
+	}
+	for _, test := range tests {
+		cores, err := ParseCoreList(test.list)
+		if valid := err == nil; valid != test.valid {
+			t.Errorf("ParseCoreList('%s') err=%v; expected valid=%t", test.list, err, test.valid)
+			continue
+		}
+		if err == nil && !reflect.DeepEqual(cores, test.cores) {
+			t.Errorf("ParseCoreList('%s') = %v; expected %v", test.list, cores, test.cores)
+		}
+	}
+}
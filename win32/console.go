@@ -0,0 +1,42 @@
+// +build windows
+
+package win32
+
+import (
+	"github.com/pkg/errors"
+)
+
+// CodePageUTF8 is the UTF-8 code page identifier
+const CodePageUTF8 uint32 = 65001
+
+// ConsoleCodePages are the input and output code pages of the console
+type ConsoleCodePages struct {
+	Input  uint32
+	Output uint32
+}
+
+// GetConsoleCodePages returns the code pages of the console attached to this process.
+// It fails when this process has no console
+func GetConsoleCodePages() (ConsoleCodePages, error) {
+	in, err := getConsoleCP()
+	if err != nil {
+		return ConsoleCodePages{}, errors.Wrapf(err, "win32: GetConsoleCP failed")
+	}
+	out, err := getConsoleOutputCP()
+	if err != nil {
+		return ConsoleCodePages{}, errors.Wrapf(err, "win32: GetConsoleOutputCP failed")
+	}
+	return ConsoleCodePages{Input: in, Output: out}, nil
+}
+
+// SetConsoleCodePages sets the code pages of the console attached to this process.
+// Child processes that share the console use the same code pages
+func SetConsoleCodePages(cp ConsoleCodePages) error {
+	if err := setConsoleCP(cp.Input); err != nil {
+		return errors.Wrapf(err, "win32: SetConsoleCP(%d) failed", cp.Input)
+	}
+	if err := setConsoleOutputCP(cp.Output); err != nil {
+		return errors.Wrapf(err, "win32: SetConsoleOutputCP(%d) failed", cp.Output)
+	}
+	return nil
+}
@@ -0,0 +1,48 @@
+// +build windows
+
+package win32
+
+var (
+	procGetConsoleCP       = kernel32DLL.NewProc("GetConsoleCP")
+	procGetConsoleOutputCP = kernel32DLL.NewProc("GetConsoleOutputCP")
+	procSetConsoleCP       = kernel32DLL.NewProc("SetConsoleCP")
+	procSetConsoleOutputCP = kernel32DLL.NewProc("SetConsoleOutputCP")
+)
+
+// UINT WINAPI GetConsoleCP(void);
+// https://docs.microsoft.com/en-us/windows/console/getconsolecp
+func getConsoleCP() (uint32, error) {
+	ret, _, errno := procGetConsoleCP.Call()
+	if err := testReturnCodeNonZero(ret, errno); err != nil {
+		return 0, err
+	}
+	return uint32(ret), nil
+}
+
+// UINT WINAPI GetConsoleOutputCP(void);
+// https://docs.microsoft.com/en-us/windows/console/getconsoleoutputcp
+func getConsoleOutputCP() (uint32, error) {
+	ret, _, errno := procGetConsoleOutputCP.Call()
+	if err := testReturnCodeNonZero(ret, errno); err != nil {
+		return 0, err
+	}
+	return uint32(ret), nil
+}
+
+// BOOL WINAPI SetConsoleCP(
+//   _In_ UINT wCodePageID
+// );
+// https://docs.microsoft.com/en-us/windows/console/setconsolecp
+func setConsoleCP(codePage uint32) error {
+	ret, _, errno := procSetConsoleCP.Call(uintptr(codePage))
+	return testReturnCodeNonZero(ret, errno)
+}
+
+// BOOL WINAPI SetConsoleOutputCP(
+//   _In_ UINT wCodePageID
+// );
+// https://docs.microsoft.com/en-us/windows/console/setconsoleoutputcp
+func setConsoleOutputCP(codePage uint32) error {
+	ret, _, errno := procSetConsoleOutputCP.Call(uintptr(codePage))
+	return testReturnCodeNonZero(ret, errno)
+}
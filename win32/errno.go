@@ -0,0 +1,42 @@
+// +build windows
+
+package win32
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// CallError is a failed Windows API call. It reads like
+// "win32: SetInformationJobObject failed: [1450] Insufficient system resources exist to complete the requested service."
+// The underlying syscall.Errno can be compared with errors.Is, or retrieved with errors.As or github.com/pkg/errors.Cause
+type CallError struct {
+	// Func is the name of the Windows API function that failed
+	Func string
+	// Errno is the error code returned by GetLastError
+	Errno syscall.Errno
+}
+
+func (e *CallError) Error() string {
+	return fmt.Sprintf("win32: %s failed: [%d] %s", e.Func, uint32(e.Errno), e.Errno.Error())
+}
+
+// Unwrap returns the underlying syscall.Errno
+func (e *CallError) Unwrap() error {
+	return e.Errno
+}
+
+// Cause returns the underlying syscall.Errno, for github.com/pkg/errors.Cause
+func (e *CallError) Cause() error {
+	return e.Errno
+}
+
+// callError wraps the error returned by the Windows API function fn in a CallError.
+// An errno of 0 means that the function failed without setting the last error, which is reported as EINVAL
+func callError(fn string, err error) error {
+	errno, ok := errnoToError(err).(syscall.Errno)
+	if !ok {
+		return err
+	}
+	return &CallError{Func: fn, Errno: errno}
+}
@@ -0,0 +1,37 @@
+// +build windows
+
+package win32
+
+import (
+	"errors"
+	"strings"
+	"syscall"
+	"testing"
+
+	pkgerrors "github.com/pkg/errors"
+)
+
+func TestCallError(t *testing.T) {
+	errInvalidHandle := syscall.Errno(6) // ERROR_INVALID_HANDLE
+	err := setInformationJobObject(syscall.InvalidHandle, _JobObjectExtendedLimitInformation, nil, 0)
+	var callErr *CallError
+	if !errors.As(err, &callErr) {
+		t.Fatalf("setInformationJobObject() = %#v; expected a *CallError", err)
+	}
+	if callErr.Func != "SetInformationJobObject" {
+		t.Errorf("Func = %s; expected SetInformationJobObject", callErr.Func)
+	}
+	if !strings.HasPrefix(err.Error(), "win32: SetInformationJobObject failed: [") {
+		t.Errorf("unexpected message: %s", err)
+	}
+	wrapped := pkgerrors.Wrapf(err, "unable to set limits")
+	if pkgerrors.Cause(wrapped) != callErr.Errno {
+		t.Errorf("Cause(%v) = %v; expected the errno", wrapped, pkgerrors.Cause(wrapped))
+	}
+	if callErr.Errno == errInvalidHandle && !errors.Is(err, errInvalidHandle) {
+		t.Errorf("errors.Is(%v, ERROR_INVALID_HANDLE) = false", err)
+	}
+	if err = callError("GetLastError", syscall.Errno(0)); !errors.Is(err, syscall.EINVAL) {
+		t.Errorf("callError(0) = %v; expected EINVAL", err)
+	}
+}
@@ -151,6 +151,80 @@ func GetTCPTableIP6OwnerPID(order bool, inc TCPTableInclude) ([]TCPOwnerConnecti
 	return table, nil
 }
 
+// UDPOwnerConnection is a UDP endpoint along with the ID of the process that owns it.
+// UDP is connectionless so only the local side of the endpoint is known
+type UDPOwnerConnection struct {
+	LocalAddress net.IP
+	LocalPort    uint16
+	LocalScopeID uint32
+	PID          int
+}
+
+// GetUDPTableIP4OwnerPID returns the IPv4 UDP endpoints and their owning processes
+func GetUDPTableIP4OwnerPID(order bool) ([]UDPOwnerConnection, error) {
+	buf, err := getExtendedUdpTable(order, _AF_INET, _UDP_TABLE_OWNER_PID)
+	if err != nil {
+		return nil, errors.Wrapf(err, "win32: GetUDPTableIP4OwnerPID: getExtendedUdpTable failed")
+	}
+	var table []UDPOwnerConnection
+	pTable := (*_MIB_UDPTABLE_OWNER_PID)(unsafe.Pointer(&buf[0]))
+	for i := uint32(0); i < pTable.dwNumEntries; i++ {
+		pRow := (*_MIB_UDPROW_OWNER_PID)(unsafe.Pointer(uintptr(unsafe.Pointer(&pTable.table[0])) + uintptr(i)*unsafe.Sizeof(pTable.table[0])))
+		row := UDPOwnerConnection{
+			LocalAddress: net.IP(pRow.dwLocalAddr[:]),
+			LocalPort:    dwToPort(pRow.dwLocalPort),
+			PID:          int(pRow.dwOwningPid),
+		}
+		table = append(table, row)
+	}
+	return table, nil
+}
+
+// GetUDPTableIP6OwnerPID returns the IPv6 UDP endpoints and their owning processes
+func GetUDPTableIP6OwnerPID(order bool) ([]UDPOwnerConnection, error) {
+	buf, err := getExtendedUdpTable(order, _AF_INET6, _UDP_TABLE_OWNER_PID)
+	if err != nil {
+		return nil, errors.Wrapf(err, "win32: GetUDPTableIP6OwnerPID: getExtendedUdpTable failed")
+	}
+	var table []UDPOwnerConnection
+	pTable := (*_MIB_UDP6TABLE_OWNER_PID)(unsafe.Pointer(&buf[0]))
+	for i := uint32(0); i < pTable.dwNumEntries; i++ {
+		pRow := (*_MIB_UDP6ROW_OWNER_PID)(unsafe.Pointer(uintptr(unsafe.Pointer(&pTable.table[0])) + uintptr(i)*unsafe.Sizeof(pTable.table[0])))
+		row := UDPOwnerConnection{
+			LocalAddress: net.IP(pRow.ucLocalAddr[:]),
+			LocalPort:    dwToPort(pRow.dwLocalPort),
+			LocalScopeID: pRow.dwLocalScopeId,
+			PID:          int(pRow.dwOwningPid),
+		}
+		table = append(table, row)
+	}
+	return table, nil
+}
+
+// CountConnectionsByPID counts the IPv4 and IPv6 TCP connections of each of the given processes by state.
+// Each table is read once, regardless of the number of processes
+func CountConnectionsByPID(pids []int) (map[int]map[TCPState]int, error) {
+	counts := make(map[int]map[TCPState]int, len(pids))
+	for _, pid := range pids {
+		counts[pid] = make(map[TCPState]int)
+	}
+	for _, get := range []func(bool, TCPTableInclude) ([]TCPOwnerConnection, error){
+		GetTCPTableIP4OwnerPID,
+		GetTCPTableIP6OwnerPID,
+	} {
+		table, err := get(false, TCPTableAll)
+		if err != nil {
+			return nil, errors.Wrapf(err, "win32: CountConnectionsByPID failed")
+		}
+		for _, row := range table {
+			if c, ok := counts[row.PID]; ok {
+				c[row.State]++
+			}
+		}
+	}
+	return counts, nil
+}
+
 func GetTCPTableIP4OwnerModule(order bool, inc TCPTableInclude) ([]TCPOwnerModuleConnection, error) {
 	var tblClass = _TCP_TABLE_OWNER_MODULE_ALL
 	switch inc {
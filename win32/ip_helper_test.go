@@ -2,7 +2,11 @@
 
 package win32
 
-import "testing"
+import (
+	"net"
+	"os"
+	"testing"
+)
 
 func TestTCPTableeOwnerPID(t *testing.T) {
 	table, err := GetTCPTableIP4OwnerPID(true, TCPTableAll)
@@ -59,3 +63,53 @@ func TestTCP6TableOwnerModule(t *testing.T) {
 		}
 	}
 }
+
+func TestCountConnectionsByPID(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	pid := os.Getpid()
+	counts, err := CountConnectionsByPID([]int{pid})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Logf("%d: %v", pid, counts[pid])
+	if counts[pid][TcpListen] < 1 {
+		t.Fatalf("expected the listening socket of pid %d to be counted: %v", pid, counts[pid])
+	}
+}
+
+func TestUDPTableOwnerPID(t *testing.T) {
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	port := uint16(conn.LocalAddr().(*net.UDPAddr).Port)
+	table, err := GetUDPTableIP4OwnerPID(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for i, row := range table {
+		t.Logf("%d: %d: %v:%d", i, row.PID, row.LocalAddress, row.LocalPort)
+		if row.PID == os.Getpid() && row.LocalPort == port {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatalf("expected udp endpoint 127.0.0.1:%d of pid %d in table", port, os.Getpid())
+	}
+}
+
+func TestUDP6TableOwnerPID(t *testing.T) {
+	table, err := GetUDPTableIP6OwnerPID(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, row := range table {
+		t.Logf("%d: %d: [%v]:%d", i, row.PID, row.LocalAddress, row.LocalPort)
+	}
+}
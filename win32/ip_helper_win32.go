@@ -10,6 +10,7 @@ import (
 
 var (
 	procGetExtendedTcpTable         = iphlpapiDLL.NewProc("GetExtendedTcpTable")
+	procGetExtendedUdpTable         = iphlpapiDLL.NewProc("GetExtendedUdpTable")
 	procGetOwnerModuleFromTcpEntry  = iphlpapiDLL.NewProc("GetOwnerModuleFromTcpEntry")
 	procGetOwnerModuleFromTcp6Entry = iphlpapiDLL.NewProc("GetOwnerModuleFromTcp6Entry")
 )
@@ -179,6 +180,59 @@ const (
 	_TCP_TABLE_OWNER_MODULE_ALL
 )
 
+// typedef struct _MIB_UDPROW_OWNER_PID {
+//   DWORD dwLocalAddr;
+//   DWORD dwLocalPort;
+//   DWORD dwOwningPid;
+// } MIB_UDPROW_OWNER_PID, *PMIB_UDPROW_OWNER_PID;
+// https://docs.microsoft.com/en-us/windows/desktop/api/udpmib/ns-udpmib-_mib_udprow_owner_pid
+type _MIB_UDPROW_OWNER_PID struct {
+	dwLocalAddr [4]byte // [4] bytes makes it easier to create an net.IP
+	dwLocalPort uint32
+	dwOwningPid uint32
+}
+
+// typedef struct _MIB_UDPTABLE_OWNER_PID {
+//   DWORD                dwNumEntries;
+//   MIB_UDPROW_OWNER_PID table[ANY_SIZE];
+// } MIB_UDPTABLE_OWNER_PID, *PMIB_UDPTABLE_OWNER_PID;
+// https://docs.microsoft.com/en-us/windows/desktop/api/udpmib/ns-udpmib-_mib_udptable_owner_pid
+type _MIB_UDPTABLE_OWNER_PID struct {
+	dwNumEntries uint32
+	table        [1]_MIB_UDPROW_OWNER_PID
+}
+
+// typedef struct _MIB_UDP6ROW_OWNER_PID {
+// 	UCHAR ucLocalAddr[16];
+// 	DWORD dwLocalScopeId;
+// 	DWORD dwLocalPort;
+// 	DWORD dwOwningPid;
+// } MIB_UDP6ROW_OWNER_PID, *PMIB_UDP6ROW_OWNER_PID;
+// https://docs.microsoft.com/en-us/windows/desktop/api/udpmib/ns-udpmib-_mib_udp6row_owner_pid
+type _MIB_UDP6ROW_OWNER_PID struct {
+	ucLocalAddr    [16]byte
+	dwLocalScopeId uint32
+	dwLocalPort    uint32
+	dwOwningPid    uint32
+}
+
+// typedef struct _MIB_UDP6TABLE_OWNER_PID {
+// 	DWORD                 dwNumEntries;
+// 	MIB_UDP6ROW_OWNER_PID table[ANY_SIZE];
+// } MIB_UDP6TABLE_OWNER_PID, *PMIB_UDP6TABLE_OWNER_PID;
+// https://docs.microsoft.com/en-us/windows/desktop/api/udpmib/ns-udpmib-_mib_udp6table_owner_pid
+type _MIB_UDP6TABLE_OWNER_PID struct {
+	dwNumEntries uint32
+	table        [1]_MIB_UDP6ROW_OWNER_PID
+}
+
+const (
+	// do not reorder
+	_UDP_TABLE_BASIC uint32 = iota
+	_UDP_TABLE_OWNER_PID
+	_UDP_TABLE_OWNER_MODULE
+)
+
 // typedef enum {
 //     MIB_TCP_STATE_CLOSED     =  1,
 //     MIB_TCP_STATE_LISTEN     =  2,
@@ -250,6 +304,40 @@ func getExtendedTcpTable(order bool, ulAf uint32, tableClass uint32) ([]byte, er
 	}
 }
 
+// DWORD GetExtendedUdpTable(
+// 	PVOID           pUdpTable,
+// 	PDWORD          pdwSize,
+// 	BOOL            bOrder,
+// 	ULONG           ulAf,
+// 	UDP_TABLE_CLASS TableClass,
+// 	ULONG           Reserved
+// );
+// https://docs.microsoft.com/en-us/windows/desktop/api/iphlpapi/nf-iphlpapi-getextendedudptable
+func getExtendedUdpTable(order bool, ulAf uint32, tableClass uint32) ([]byte, error) {
+	var buffer []byte
+	var pUdpTable *byte
+	var dwSize uint32
+	for {
+		ret, _, errno := procGetExtendedUdpTable.Call(
+			uintptr(unsafe.Pointer(pUdpTable)),
+			uintptr(unsafe.Pointer(&dwSize)),
+			uintptr(toBOOL(order)),
+			uintptr(ulAf),
+			uintptr(tableClass),
+			uintptr(uint32(0)),
+		)
+		if ret != NO_ERROR {
+			if syscall.Errno(ret) == syscall.ERROR_INSUFFICIENT_BUFFER {
+				buffer = make([]byte, int(dwSize))
+				pUdpTable = &buffer[0]
+				continue
+			}
+			return nil, errnoToError(errno)
+		}
+		return buffer, nil
+	}
+}
+
 const (
 	TCPIP_OWNER_MODULE_INFO_BASIC = 0
 )
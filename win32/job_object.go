@@ -5,17 +5,63 @@ package win32
 import (
 	"bytes"
 	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
+
+	"github.com/pkg/errors"
 )
 
 const DefaultMessageTimeout = 1 * time.Minute
 
 type JobObject struct {
+	// Labels describe what the job runs, such as the nomad job and task names, since the job name may be opaque.
+	// They are added to the errors logged by the job to tell jobs apart when several run on the same host
+	Labels map[string]string
+
 	hJob        syscall.Handle
 	hCompletion syscall.Handle
+	// notifyErr is why the job has no completion port, and so no notifications
+	notifyErr error
+	// notifyCh buffers the notifications read from the completion port by a dedicated goroutine
+	notifyCh   chan queuedNotification
+	notifyOnce sync.Once
+	// notifyBufferSize is how many notifications notifyCh buffers
+	notifyBufferSize int
+	// stopCh is closed when the notifications are no longer read, so that the goroutine reading them returns
+	stopCh   chan struct{}
+	stopOnce sync.Once
+	// mu is held to use hJob, and locked by Close, so that the handle isn't closed, or reused, while it is used
+	mu     sync.RWMutex
+	closed int32
+}
+
+// DefaultNotificationBufferSize is how many notifications a job object buffers until PollNotifications reads them,
+// unless another size is given to CreateBufferedJobObject.
+// The completion port keeps queuing notifications once the buffer is full
+const DefaultNotificationBufferSize = 64
+
+// queuedNotification is a notification, or the error reading it, read from the completion port
+type queuedNotification struct {
+	info *JobObjectNotification
+	err  error
 }
 
+// ErrNotificationsUnavailable is returned by PollNotifications when the job object has no IO completion port to receive notifications on
+var ErrNotificationsUnavailable = errors.New("win32: job object notifications unavailable")
+
+// ErrJobObjectClosed is returned by PollNotifications, and the other methods that use the job, once the job object is closed
+var ErrJobObjectClosed = errors.New("win32: job object closed")
+
+// ErrJobObjectExists is returned by CreateJobObject when a job object with the same name already exists.
+// The existing job may still hold processes from a previous run, see ReopenJobObject to manage it
+var ErrJobObjectExists = errors.New("win32: job object already exists")
+
+// createIoCompletionPort is replaced in tests to simulate a resource-constrained host
+var createIoCompletionPort = syscall.CreateIoCompletionPort
+
 type JobObjectNotification struct {
 	Code               JobObjectMsgCode
 	ProcessID          int
@@ -106,45 +152,257 @@ func (j *JobObject) Assign(p *Process) error {
 		return err
 	}
 	defer CloseHandleLogErr(hProc, "win32: failed to close process handle")
-	return assignProcessToJobObject(j.hJob, hProc)
+	return j.withHandle(func(hJob syscall.Handle) error {
+		return assignProcessToJobObject(hJob, hProc)
+	})
 }
 
+// Close closes the job handle once the calls using it have returned.
+// The calls made afterwards return ErrJobObjectClosed
 func (j *JobObject) Close() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if atomic.LoadInt32(&j.closed) == 1 {
+		return ErrJobObjectClosed
+	}
+	atomic.StoreInt32(&j.closed, 1)
+	j.StopNotifications()
 	if j.hCompletion != 0 {
 		defer syscall.Close(j.hCompletion)
 	}
 	return syscall.Close(j.hJob)
 }
 
+// withHandle calls fn with the job handle, or returns ErrJobObjectClosed once the job is closed.
+// Close waits for fn to return
+func (j *JobObject) withHandle(fn func(hJob syscall.Handle) error) error {
+	j.mu.RLock()
+	defer j.mu.RUnlock()
+	if atomic.LoadInt32(&j.closed) == 1 {
+		return ErrJobObjectClosed
+	}
+	return fn(j.hJob)
+}
+
+// Terminate kills every process in the job with the given exit code,
+// including the descendants that the job's processes left behind
+func (j *JobObject) Terminate(exitCode uint32) error {
+	if err := j.withHandle(func(hJob syscall.Handle) error {
+		return terminateJobObject(hJob, exitCode)
+	}); err != nil {
+		return errors.Wrapf(err, "win32: TerminateJobObject failed")
+	}
+	return nil
+}
+
+// labeledJobInfoSetter is implemented by the setters that log their failures, so that the logs carry the labels of the job
+type labeledJobInfoSetter interface {
+	setJobInfo(hJob syscall.Handle, labels map[string]string) error
+}
+
 func (j *JobObject) SetInformation(info JobObjectInformationSetter) error {
-	return info.SetJobInfo(j.hJob)
+	return j.withHandle(func(hJob syscall.Handle) error {
+		if s, ok := info.(labeledJobInfoSetter); ok {
+			return s.setJobInfo(hJob, j.Labels)
+		}
+		return info.SetJobInfo(hJob)
+	})
 }
 
 func (j *JobObject) GetInformation(info JobObjectInformationGetter) error {
-	return info.GetJobInfo(j.hJob)
+	return j.withHandle(info.GetJobInfo)
+}
+
+// ProcessIDs returns the IDs of the processes currently assigned to the job
+func (j *JobObject) ProcessIDs() ([]uint32, error) {
+	var pids []uint32
+	err := j.withHandle(func(hJob syscall.Handle) (err error) {
+		pids, err = queryBasicProcessIDList(hJob)
+		return err
+	})
+	return pids, err
+}
+
+// Accounting returns the CPU, page fault, process and IO counters of the job
+func (j *JobObject) Accounting() (JobObjectBasicAndIOAccounting, error) {
+	var info JobObjectBasicAndIOAccounting
+	if err := j.GetInformation(&info); err != nil {
+		return info, errors.Wrapf(err, "win32: unable to query job accounting")
+	}
+	return info, nil
 }
 
+// PeakMemoryUsed returns the most committed memory used by any process of the job, and by the whole job
+func (j *JobObject) PeakMemoryUsed() (process uint64, job uint64, err error) {
+	var info *_JOBOBJECT_EXTENDED_LIMIT_INFORMATION
+	err = j.withHandle(func(hJob syscall.Handle) (err error) {
+		info, err = queryExtendedLimitInformation(hJob)
+		return err
+	})
+	if err != nil {
+		return 0, 0, errors.Wrapf(err, "win32: unable to query job memory usage")
+	}
+	return uint64(info.PeakProcessMemoryUsed), uint64(info.PeakJobMemoryUsed), nil
+}
+
+// PollNotifications blocks until the next job object notification.
+// The notifications are read from the completion port as they come and buffered, so a slow caller doesn't hold them up.
+// It returns an error wrapping ErrNotificationsUnavailable when the job has no completion port,
+// and ErrJobObjectClosed once the job is closed
 func (j *JobObject) PollNotifications() (*JobObjectNotification, error) {
 	if j.hCompletion != 0 {
-		return getQueuedCompletionStatus(j.hJob, j.hCompletion)
+		j.notifyOnce.Do(func() {
+			j.notifyCh = make(chan queuedNotification, j.notifyBufferSize)
+			go j.readNotifications()
+		})
+		n, ok := <-j.notifyCh
+		if !ok {
+			return nil, ErrJobObjectClosed
+		}
+		return n.info, n.err
+	}
+	if j.notifyErr != nil {
+		return nil, errors.Wrapf(ErrNotificationsUnavailable, "%v", j.notifyErr)
 	}
-	return nil, nil
+	return nil, ErrNotificationsUnavailable
 }
 
+// StopNotifications tells the job that its notifications are no longer read, e.g. after PollNotifications kept failing.
+// The notifications buffered or read afterwards are dropped, and PollNotifications returns ErrJobObjectClosed once they're gone
+func (j *JobObject) StopNotifications() {
+	if j.stopCh == nil {
+		return
+	}
+	j.stopOnce.Do(func() {
+		close(j.stopCh)
+		// wake readNotifications up, which otherwise waits for the next notification.
+		// The packet has no completion key, so it isn't mistaken for a notification
+		LogError(syscall.PostQueuedCompletionStatus(j.hCompletion, 0, 0, nil), "win32: unable to stop reading the job notifications")
+	})
+}
+
+// readNotifications reads the notifications from the completion port into notifyCh until the job is closed
+// or its notifications are stopped
+func (j *JobObject) readNotifications() {
+	defer close(j.notifyCh)
+	for {
+		info, err := getQueuedCompletionStatus(j.hJob, j.hCompletion)
+		select {
+		case <-j.stopCh:
+			return
+		default:
+		}
+		if err != nil && atomic.LoadInt32(&j.closed) == 1 {
+			return
+		}
+		select {
+		case j.notifyCh <- queuedNotification{info: info, err: err}:
+		case <-j.stopCh:
+			return
+		}
+	}
+}
+
+// NotificationsAvailable returns true when the job object has an IO completion port to receive notifications on
+func (j *JobObject) NotificationsAvailable() bool {
+	return j.hCompletion != 0
+}
+
+// CreateJobObject creates a job object with the given name and an IO completion port to receive its notifications on.
+// When the completion port can't be created or assigned, the job is still returned so that limits can be applied,
+// but PollNotifications returns ErrNotificationsUnavailable
 func CreateJobObject(name string) (*JobObject, error) {
+	return CreateLabeledJobObject(name, nil)
+}
+
+// CreateLabeledJobObject creates a job object like CreateJobObject, with the given labels
+func CreateLabeledJobObject(name string, labels map[string]string) (*JobObject, error) {
+	return CreateBufferedJobObject(name, labels, DefaultNotificationBufferSize)
+}
+
+// CreateBufferedJobObject creates a job object like CreateLabeledJobObject,
+// which buffers up to bufferSize notifications until PollNotifications reads them.
+// A bufferSize of 0 or less uses DefaultNotificationBufferSize
+func CreateBufferedJobObject(name string, labels map[string]string, bufferSize int) (*JobObject, error) {
 	hJob, err := createJobObject(nil, name)
+	if err == syscall.ERROR_ALREADY_EXISTS {
+		CloseHandleLogErr(hJob, "win32: failed to close existing job object")
+		return nil, errors.Wrapf(ErrJobObjectExists, "win32: failed to create job object %s", name)
+	}
 	if err != nil {
-		return nil, err
+		return nil, errors.Wrapf(err, "win32: failed to create job object %s", name)
 	}
-	hCompletionPort, err := syscall.CreateIoCompletionPort(syscall.InvalidHandle, 0, 0, 1)
+	return withCompletionPort(&JobObject{hJob: hJob, Labels: labels, notifyBufferSize: bufferSize}, name), nil
+}
+
+// withCompletionPort associates a new IO completion port with the job,
+// leaving the job without one when it fails
+func withCompletionPort(j *JobObject, name string) *JobObject {
+	hCompletionPort, err := createIoCompletionPort(syscall.InvalidHandle, 0, 0, 1)
 	if err != nil {
-		syscall.Close(hJob)
-		return nil, err
+		j.notifyErr = errors.Wrapf(err, "win32: failed to create IO completion port for job %s", name)
+		j.logError(j.notifyErr, "win32: job object notifications are unavailable")
+		return j
+	}
+	if err = assignJobIOCompletionPort(j.hJob, hCompletionPort); err != nil {
+		CloseHandleLogErr(hCompletionPort, "win32: failed to close IO completion port")
+		j.notifyErr = errors.Wrapf(err, "win32: failed to assign IO completion port to job %s", name)
+		j.logError(j.notifyErr, "win32: job object notifications are unavailable")
+		return j
 	}
-	if err = assignJobIOCompletionPort(hJob, hCompletionPort); err != nil {
-		syscall.Close(hJob)
-		syscall.Close(hCompletionPort)
-		return nil, err
+	j.hCompletion = hCompletionPort
+	j.stopCh = make(chan struct{})
+	if j.notifyBufferSize <= 0 {
+		j.notifyBufferSize = DefaultNotificationBufferSize
+	}
+	return j
+}
+
+// logError logs err like LogError, with the labels of the job appended to msg
+func (j *JobObject) logError(err error, msg string) {
+	logJobErrorf(err, j.Labels, "%s", msg)
+}
+
+// logJobErrorf logs err like LogErrorf, with the given job labels appended to the message
+func logJobErrorf(err error, labels map[string]string, format string, args ...interface{}) {
+	if err == nil {
+		return
+	}
+	if len(labels) == 0 {
+		LogErrorf(err, format, args...)
+		return
+	}
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, format, args...)
+	for _, k := range keys {
+		fmt.Fprintf(buf, " %s=%q", k, labels[k])
+	}
+	LogError(err, buf.String())
+}
+
+// OpenJobObject opens the existing job object with the given name to query it.
+// The job is opened without a completion port, so PollNotifications never returns a notification
+func OpenJobObject(name string) (*JobObject, error) {
+	hJob, err := openJobObject(_JOB_OBJECT_QUERY, false, name)
+	if err != nil {
+		return nil, errors.Wrapf(err, "win32: OpenJobObject %s failed", name)
+	}
+	return &JobObject{hJob: hJob}, nil
+}
+
+// ReopenJobObject opens the existing job object with the given name to manage it again, e.g. after damon restarted.
+// Its limits can be queried and changed, and its processes terminated.
+// A new completion port is associated with the job when possible. Windows doesn't allow replacing one
+// that is still associated, in which case PollNotifications returns ErrNotificationsUnavailable
+func ReopenJobObject(name string) (*JobObject, error) {
+	hJob, err := openJobObject(_JOB_OBJECT_QUERY|_JOB_OBJECT_SET_ATTRIBUTES|_JOB_OBJECT_TERMINATE, false, name)
+	if err != nil {
+		return nil, errors.Wrapf(err, "win32: ReopenJobObject %s failed", name)
 	}
-	return &JobObject{hJob: hJob, hCompletion: hCompletionPort}, nil
+	return withCompletionPort(&JobObject{hJob: hJob}, name), nil
 }
@@ -3,7 +3,6 @@
 package win32
 
 import (
-	"fmt"
 	"syscall"
 	"time"
 	"unsafe"
@@ -23,6 +22,10 @@ type BasicLimitInformation struct {
 	MinWorkingSetSize int64
 	MaxWorkingSetSize int64
 	ProcessorAffinity uint64
+
+	// LimitSchedulingClass applies SchedulingClass even when it is 0, the lowest class.
+	// Classes 1-9 are applied without it. GetJobInfo sets it when the job limits the scheduling class
+	LimitSchedulingClass bool
 }
 
 type PriorityClass uint32
@@ -49,7 +52,7 @@ func (i *BasicLimitInformation) info() _JOBOBJECT_BASIC_LIMIT_INFORMATION {
 		info.LimitFlags |= _JOB_OBJECT_LIMIT_PRIORITY_CLASS
 		info.PriorityClass = uint32(i.PriorityClass)
 	}
-	if i.SchedulingClass >= 1 && i.SchedulingClass <= 9 {
+	if i.SchedulingClass <= 9 && (i.SchedulingClass >= 1 || i.LimitSchedulingClass) {
 		info.SchedulingClass = uint32(i.SchedulingClass)
 		info.LimitFlags |= _JOB_OBJECT_LIMIT_SCHEDULING_CLASS
 	}
@@ -61,6 +64,10 @@ func (i *BasicLimitInformation) info() _JOBOBJECT_BASIC_LIMIT_INFORMATION {
 }
 
 func (i *BasicLimitInformation) SetJobInfo(hJob syscall.Handle) error {
+	return i.setJobInfo(hJob, nil)
+}
+
+func (i *BasicLimitInformation) setJobInfo(hJob syscall.Handle, labels map[string]string) error {
 	info := i.info()
 	ret, _, err := procSetInformationJobObject.Call(
 		uintptr(hJob),
@@ -69,8 +76,38 @@ func (i *BasicLimitInformation) SetJobInfo(hJob syscall.Handle) error {
 		uintptr(unsafe.Sizeof(info)),
 	)
 	if ret == 0 {
+		return jobInfoError(hJob, labels, _JobObjectBasicLimitInformation, unsafe.Sizeof(info), err)
+	}
+	return nil
+}
+
+// DefaultSchedulingClass is the scheduling class used by the system when a job doesn't set one
+const DefaultSchedulingClass uint = 5
+
+// GetJobInfo reads back the basic limits applied to the job.
+// When the job doesn't limit the scheduling class, SchedulingClass is set to DefaultSchedulingClass
+func (i *BasicLimitInformation) GetJobInfo(hJob syscall.Handle) error {
+	info, err := queryBasicLimitInformation(hJob)
+	if err != nil {
 		return err
 	}
+	*i = BasicLimitInformation{
+		SchedulingClass: DefaultSchedulingClass,
+	}
+	if info.LimitFlags&_JOB_OBJECT_LIMIT_WORKINGSET != 0 {
+		i.MinWorkingSetSize = int64(info.MinimumWorkingSetSize)
+		i.MaxWorkingSetSize = int64(info.MaximumWorkingSetSize)
+	}
+	if info.LimitFlags&_JOB_OBJECT_LIMIT_PRIORITY_CLASS != 0 {
+		i.PriorityClass = PriorityClass(info.PriorityClass)
+	}
+	if info.LimitFlags&_JOB_OBJECT_LIMIT_SCHEDULING_CLASS != 0 {
+		i.SchedulingClass = uint(info.SchedulingClass)
+		i.LimitSchedulingClass = true
+	}
+	if info.LimitFlags&_JOB_OBJECT_LIMIT_AFFINITY != 0 {
+		i.ProcessorAffinity = uint64(info.Affinity)
+	}
 	return nil
 }
 
@@ -88,9 +125,15 @@ type ExtendedLimitInformation struct {
 	SilentBreakawayOK  bool
 	JobMemoryLimit     uint64
 	ProcessMemoryLimit uint64
+	// DieOnUnhandledException terminates processes that crash instead of showing the Windows Error Reporting dialog
+	DieOnUnhandledException bool
 }
 
 func (i *ExtendedLimitInformation) SetJobInfo(hJob syscall.Handle) error {
+	return i.setJobInfo(hJob, nil)
+}
+
+func (i *ExtendedLimitInformation) setJobInfo(hJob syscall.Handle, labels map[string]string) error {
 	var info _JOBOBJECT_EXTENDED_LIMIT_INFORMATION
 	info.BasicLimitInformation = i.Basic.info()
 	if i.JobMemoryLimit > 0 {
@@ -110,6 +153,9 @@ func (i *ExtendedLimitInformation) SetJobInfo(hJob syscall.Handle) error {
 	if i.SilentBreakawayOK {
 		info.BasicLimitInformation.LimitFlags |= _JOB_OBJECT_LIMIT_SILENT_BREAKAWAY_OK
 	}
+	if i.DieOnUnhandledException {
+		info.BasicLimitInformation.LimitFlags |= _JOB_OBJECT_LIMIT_DIE_ON_UNHANDLED_EXCEPTION
+	}
 	ret, _, err := procSetInformationJobObject.Call(
 		uintptr(hJob),
 		uintptr(_JobObjectExtendedLimitInformation),
@@ -117,8 +163,50 @@ func (i *ExtendedLimitInformation) SetJobInfo(hJob syscall.Handle) error {
 		uintptr(unsafe.Sizeof(info)),
 	)
 	if ret == 0 {
+		return jobInfoError(hJob, labels, _JobObjectExtendedLimitInformation, unsafe.Sizeof(info), err)
+	}
+	return nil
+}
+
+// jobInfoError logs the arguments of a failed SetInformationJobObject call, which the returned error doesn't carry,
+// and the labels of the job
+func jobInfoError(hJob syscall.Handle, labels map[string]string, class uint32, size uintptr, err error) error {
+	logJobErrorf(err, labels, "win32: SetInformationJobObject failed for job %#x, info class %d, %d bytes", hJob, class, size)
+	return callError("SetInformationJobObject", err)
+}
+
+// AccountingPeriodReset ends the current accounting period of the job and starts a new one,
+// which resets the ThisPeriodTotalUserTime and ThisPeriodTotalKernelTime accounting counters.
+// The other limits set on the job are kept.
+type AccountingPeriodReset struct{}
+
+// unlimitedJobTime is the per-job user time limit used to start a new period without limiting the job
+const unlimitedJobTime int64 = 1<<63 - 1
+
+func (i *AccountingPeriodReset) SetJobInfo(hJob syscall.Handle) error {
+	return i.setJobInfo(hJob, nil)
+}
+
+func (i *AccountingPeriodReset) setJobInfo(hJob syscall.Handle, labels map[string]string) error {
+	info, err := queryExtendedLimitInformation(hJob)
+	if err != nil {
 		return err
 	}
+	// the period counters are reset when a per-job time limit is set without preserving the previous one
+	info.BasicLimitInformation.LimitFlags &^= _JOB_OBJECT_LIMIT_PRESERVE_JOB_TIME
+	if info.BasicLimitInformation.LimitFlags&_JOB_OBJECT_LIMIT_JOB_TIME == 0 {
+		info.BasicLimitInformation.LimitFlags |= _JOB_OBJECT_LIMIT_JOB_TIME
+		info.BasicLimitInformation.PerJobUserTimeLimit = unlimitedJobTime
+	}
+	ret, _, err := procSetInformationJobObject.Call(
+		uintptr(hJob),
+		uintptr(_JobObjectExtendedLimitInformation),
+		uintptr(unsafe.Pointer(info)),
+		uintptr(unsafe.Sizeof(*info)),
+	)
+	if ret == 0 {
+		return jobInfoError(hJob, labels, _JobObjectExtendedLimitInformation, unsafe.Sizeof(*info), err)
+	}
 	return nil
 }
 
@@ -138,12 +226,19 @@ type CPUMaxRateInformation struct {
 	HardCap bool
 }
 
+// MHzToWeight converts mhz to a CPU weight (1-9) relative to the total MHz of the machine
 func MHzToWeight(mhz uint64) uint {
 	if mhz == 0 {
 		return 0
 	}
-	sr := GetSystemResources()
-	r := float64(float64(mhz) / sr.CPUTotalTicks)
+	return mhzToWeight(mhz, GetSystemResources().CPUTotalTicks)
+}
+
+func mhzToWeight(mhz uint64, totalTicks float64) uint {
+	if mhz == 0 {
+		return 0
+	}
+	r := float64(float64(mhz) / totalTicks)
 	weight := uint(r * float64(MaxWeight))
 	if weight > MaxWeight {
 		return MaxWeight
@@ -154,12 +249,19 @@ func MHzToWeight(mhz uint64) uint {
 	return weight
 }
 
+// MHzToCPURate converts mhz to a CPU rate, in hundredths of a percent of the total MHz of the machine
 func MHzToCPURate(mhz uint64) uint {
 	if mhz == 0 {
 		return 0
 	}
-	sr := GetSystemResources()
-	r := float64(float64(mhz) / sr.CPUTotalTicks)
+	return mhzToCPURate(mhz, GetSystemResources().CPUTotalTicks)
+}
+
+func mhzToCPURate(mhz uint64, totalTicks float64) uint {
+	if mhz == 0 {
+		return 0
+	}
+	r := float64(float64(mhz) / totalTicks)
 	rate := uint(r * 10000.0)
 	if rate > MaxCPURate {
 		return MaxCPURate
@@ -171,6 +273,10 @@ func MHzToCPURate(mhz uint64) uint {
 }
 
 func (i *CPURateControlInformation) SetJobInfo(hJob syscall.Handle) error {
+	return i.setJobInfo(hJob, nil)
+}
+
+func (i *CPURateControlInformation) setJobInfo(hJob syscall.Handle, labels map[string]string) error {
 	var pInfo unsafe.Pointer
 	var size uintptr
 	if i.Rate != nil {
@@ -190,6 +296,7 @@ func (i *CPURateControlInformation) SetJobInfo(hJob syscall.Handle) error {
 		pInfo = unsafe.Pointer(&info)
 	} else if i.MinMax != nil {
 		var info _JOBOBJECT_CPU_RATE_CONTROL_INFORMATION_MINMAX
+		size = unsafe.Sizeof(info)
 		info.MinRate = uint16(i.MinMax.MinRate)
 		info.MaxRate = uint16(i.MinMax.MaxRate)
 		info.ControlFlags = JOB_OBJECT_CPU_RATE_CONTROL_ENABLE | JOB_OBJECT_CPU_RATE_CONTROL_MIN_MAX_RATE
@@ -202,8 +309,37 @@ func (i *CPURateControlInformation) SetJobInfo(hJob syscall.Handle) error {
 		uintptr(size),
 	)
 	if ret == 0 {
+		return jobInfoError(hJob, labels, _JobObjectCpuRateControlInformation, size, err)
+	}
+	return nil
+}
+
+// GetJobInfo reads back the CPU rate control applied to the job.
+// Rate, Weight and MinMax are all unset when CPU rate control isn't enabled
+func (i *CPURateControlInformation) GetJobInfo(hJob syscall.Handle) error {
+	info, err := queryCPURateControlInformation(hJob)
+	if err != nil {
 		return err
 	}
+	*i = CPURateControlInformation{
+		Notify: info.ControlFlags&JOB_OBJECT_CPU_RATE_CONTROL_NOTIFY != 0,
+	}
+	switch {
+	case info.ControlFlags&JOB_OBJECT_CPU_RATE_CONTROL_ENABLE == 0:
+	case info.ControlFlags&JOB_OBJECT_CPU_RATE_CONTROL_WEIGHT_BASED != 0:
+		i.Weight = uint(info.Rate)
+	case info.ControlFlags&JOB_OBJECT_CPU_RATE_CONTROL_MIN_MAX_RATE != 0:
+		// MinRate is the low word of the union and MaxRate the high word
+		i.MinMax = &CPURateMinMaxInformation{
+			MinRate: int(info.Rate & 0xFFFF),
+			MaxRate: int(info.Rate >> 16),
+		}
+	default:
+		i.Rate = &CPUMaxRateInformation{
+			Rate:    uint(info.Rate),
+			HardCap: info.ControlFlags&JOB_OBJECT_CPU_RATE_CONTROL_HARD_CAP != 0,
+		}
+	}
 	return nil
 }
 
@@ -225,26 +361,33 @@ type IORateControlInformation struct {
 }
 
 func (i *IORateControlInformation) SetJobInfo(hJob syscall.Handle) error {
+	return i.setJobInfo(hJob, nil)
+}
+
+func (i *IORateControlInformation) setJobInfo(hJob syscall.Handle, labels map[string]string) error {
+	info := _JOBOBJECT_IO_RATE_CONTROL_INFORMATION{
+		VolumeName: Text(i.VolumeName).WChars(),
+	}
 	// Enable
 	if i.MaxBandwidth > 0 || i.ReservedIOPS > 0 || i.MaxIOPS > 0 {
-		info := _JOBOBJECT_IO_RATE_CONTROL_INFORMATION{
-			MaxBandwidth:    i.MaxBandwidth,
-			ReservationIops: i.ReservedIOPS,
-			MaxIops:         i.MaxIOPS,
-			VolumeName:      Text(i.VolumeName).WChars(),
-			ControlFlags:    _JOB_OBJECT_IO_RATE_CONTROL_ENABLE,
-		}
-		return setIoRateControlInformationJobObject(hJob, info)
-	}
-	// Disable
-	return setIoRateControlInformationJobObject(hJob, _JOBOBJECT_IO_RATE_CONTROL_INFORMATION{
-		VolumeName:   Text(i.VolumeName).WChars(),
-		ControlFlags: 0,
-	})
+		info.MaxBandwidth = i.MaxBandwidth
+		info.ReservationIops = i.ReservedIOPS
+		info.MaxIops = i.MaxIOPS
+		info.BaseIoSize = i.BaseIOSize
+		info.ControlFlags = _JOB_OBJECT_IO_RATE_CONTROL_ENABLE
+	}
+	err := setIoRateControlInformationJobObject(hJob, info)
+	logJobErrorf(err, labels, "win32: SetIoRateControlInformationJobObject failed for job %#x, volume %q, max iops %d, max bandwidth %d, base size %d, flags %#x",
+		hJob, i.VolumeName, info.MaxIops, info.MaxBandwidth, info.BaseIoSize, info.ControlFlags)
+	return err
 }
 
 func GetIORateControlInformations(job *JobObject, volume string) ([]IORateControlInformation, error) {
-	is, err := queryIoRateControlInformationJobObject(job.hJob, volume)
+	var is []_JOBOBJECT_IO_RATE_CONTROL_INFORMATION
+	err := job.withHandle(func(hJob syscall.Handle) (err error) {
+		is, err = queryIoRateControlInformationJobObject(hJob, volume)
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -267,6 +410,10 @@ type NetRateControlInformation struct {
 }
 
 func (i *NetRateControlInformation) SetJobInfo(hJob syscall.Handle) error {
+	return i.setJobInfo(hJob, nil)
+}
+
+func (i *NetRateControlInformation) setJobInfo(hJob syscall.Handle, labels map[string]string) error {
 	var info _JOBOBJECT_NET_RATE_CONTROL_INFORMATION
 	if i.MaxBandwidth > 0 {
 		info.MaxBandwidth = i.MaxBandwidth
@@ -283,8 +430,89 @@ func (i *NetRateControlInformation) SetJobInfo(hJob syscall.Handle) error {
 		uintptr(unsafe.Sizeof(info)),
 	)
 	if ret == 0 {
+		return jobInfoError(hJob, labels, _JobObjectNetRateControlInformation, unsafe.Sizeof(info), err)
+	}
+	return nil
+}
+
+// UIRestrictions limits what the job's processes can do with the user interface.
+// Each flag set denies the processes access to that part of the UI
+type UIRestrictions struct {
+	// Desktop prevents creating and switching desktops
+	Desktop bool
+	// DisplaySettings prevents calling ChangeDisplaySettings
+	DisplaySettings bool
+	// ExitWindows prevents logging off, shutting down and restarting the system
+	ExitWindows bool
+	// GlobalAtoms gives the job its own global atom table
+	GlobalAtoms bool
+	// Handles prevents using USER handles owned by processes outside the job
+	Handles bool
+	// ReadClipboard prevents reading from the clipboard
+	ReadClipboard bool
+	// SystemParameters prevents changing system parameters with SystemParametersInfo
+	SystemParameters bool
+	// WriteClipboard prevents writing to the clipboard
+	WriteClipboard bool
+}
+
+func (i *UIRestrictions) SetJobInfo(hJob syscall.Handle) error {
+	return i.setJobInfo(hJob, nil)
+}
+
+func (i *UIRestrictions) setJobInfo(hJob syscall.Handle, labels map[string]string) error {
+	var info _JOBOBJECT_BASIC_UI_RESTRICTIONS
+	if i.Desktop {
+		info.UIRestrictionsClass |= _JOB_OBJECT_UILIMIT_DESKTOP
+	}
+	if i.DisplaySettings {
+		info.UIRestrictionsClass |= _JOB_OBJECT_UILIMIT_DISPLAYSETTINGS
+	}
+	if i.ExitWindows {
+		info.UIRestrictionsClass |= _JOB_OBJECT_UILIMIT_EXITWINDOWS
+	}
+	if i.GlobalAtoms {
+		info.UIRestrictionsClass |= _JOB_OBJECT_UILIMIT_GLOBALATOMS
+	}
+	if i.Handles {
+		info.UIRestrictionsClass |= _JOB_OBJECT_UILIMIT_HANDLES
+	}
+	if i.ReadClipboard {
+		info.UIRestrictionsClass |= _JOB_OBJECT_UILIMIT_READCLIPBOARD
+	}
+	if i.SystemParameters {
+		info.UIRestrictionsClass |= _JOB_OBJECT_UILIMIT_SYSTEMPARAMETERS
+	}
+	if i.WriteClipboard {
+		info.UIRestrictionsClass |= _JOB_OBJECT_UILIMIT_WRITECLIPBOARD
+	}
+	ret, _, err := procSetInformationJobObject.Call(
+		uintptr(hJob),
+		uintptr(_JobObjectBasicUIRestrictions),
+		uintptr(unsafe.Pointer(&info)),
+		uintptr(unsafe.Sizeof(info)),
+	)
+	if ret == 0 {
+		return jobInfoError(hJob, labels, _JobObjectBasicUIRestrictions, unsafe.Sizeof(info), err)
+	}
+	return nil
+}
+
+func (i *UIRestrictions) GetJobInfo(hJob syscall.Handle) error {
+	info, err := queryBasicUIRestrictions(hJob)
+	if err != nil {
 		return err
 	}
+	*i = UIRestrictions{
+		Desktop:          info.UIRestrictionsClass&_JOB_OBJECT_UILIMIT_DESKTOP != 0,
+		DisplaySettings:  info.UIRestrictionsClass&_JOB_OBJECT_UILIMIT_DISPLAYSETTINGS != 0,
+		ExitWindows:      info.UIRestrictionsClass&_JOB_OBJECT_UILIMIT_EXITWINDOWS != 0,
+		GlobalAtoms:      info.UIRestrictionsClass&_JOB_OBJECT_UILIMIT_GLOBALATOMS != 0,
+		Handles:          info.UIRestrictionsClass&_JOB_OBJECT_UILIMIT_HANDLES != 0,
+		ReadClipboard:    info.UIRestrictionsClass&_JOB_OBJECT_UILIMIT_READCLIPBOARD != 0,
+		SystemParameters: info.UIRestrictionsClass&_JOB_OBJECT_UILIMIT_SYSTEMPARAMETERS != 0,
+		WriteClipboard:   info.UIRestrictionsClass&_JOB_OBJECT_UILIMIT_WRITECLIPBOARD != 0,
+	}
 	return nil
 }
 
@@ -308,7 +536,7 @@ type NotificationMemoryLimit struct {
 	Bytes uint64
 }
 
-func (i *NotificationLimitInformation) SetJobInfo(hJob syscall.Handle) error {
+func (i *NotificationLimitInformation) info() _JOBOBJECT_NOTIFICATION_LIMIT_INFORMATION_2 {
 	var info _JOBOBJECT_NOTIFICATION_LIMIT_INFORMATION_2
 	if i.UserTimeLimit > 0 {
 		info.LimitFlags |= _JOB_OBJECT_LIMIT_JOB_TIME
@@ -341,11 +569,19 @@ func (i *NotificationLimitInformation) SetJobInfo(hJob syscall.Handle) error {
 		info.IoReadBytesLimit = i.IOReadBytesLimit
 		info.LimitFlags |= _JOB_OBJECT_LIMIT_JOB_READ_BYTES
 	}
-	if i.IOReadBytesLimit > 0 {
+	if i.IOWriteBytesLimit > 0 {
 		info.IoWriteBytesLimit = i.IOWriteBytesLimit
 		info.LimitFlags |= _JOB_OBJECT_LIMIT_JOB_WRITE_BYTES
 	}
+	return info
+}
+
+func (i *NotificationLimitInformation) SetJobInfo(hJob syscall.Handle) error {
+	return i.setJobInfo(hJob, nil)
+}
 
+func (i *NotificationLimitInformation) setJobInfo(hJob syscall.Handle, labels map[string]string) error {
+	info := i.info()
 	ret, _, err := procSetInformationJobObject.Call(
 		uintptr(hJob),
 		uintptr(_JobObjectNotificationLimitInformation2),
@@ -353,8 +589,7 @@ func (i *NotificationLimitInformation) SetJobInfo(hJob syscall.Handle) error {
 		uintptr(unsafe.Sizeof(info)),
 	)
 	if ret == 0 {
-		fmt.Println("procSetInformationJobObject err", err)
-		return err
+		return jobInfoError(hJob, labels, _JobObjectNotificationLimitInformation2, unsafe.Sizeof(info), err)
 	}
 	return nil
 }
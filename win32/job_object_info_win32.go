@@ -63,6 +63,17 @@ const (
 	JOB_OBJECT_NET_RATE_CONTROL_VALID_FLAGS   = 0x7
 )
 
+const (
+	_JOB_OBJECT_UILIMIT_HANDLES          = 0x00000001
+	_JOB_OBJECT_UILIMIT_READCLIPBOARD    = 0x00000002
+	_JOB_OBJECT_UILIMIT_WRITECLIPBOARD   = 0x00000004
+	_JOB_OBJECT_UILIMIT_SYSTEMPARAMETERS = 0x00000008
+	_JOB_OBJECT_UILIMIT_DISPLAYSETTINGS  = 0x00000010
+	_JOB_OBJECT_UILIMIT_GLOBALATOMS      = 0x00000020
+	_JOB_OBJECT_UILIMIT_DESKTOP          = 0x00000040
+	_JOB_OBJECT_UILIMIT_EXITWINDOWS      = 0x00000080
+)
+
 const (
 	_JOB_OBJECT_IO_RATE_CONTROL_ENABLE = 0x1
 )
@@ -482,6 +493,29 @@ type _JOBOBJECT_ASSOCIATE_COMPLETION_PORT struct {
 	CompletionPort syscall.Handle
 }
 
+// typedef struct _JOBOBJECT_BASIC_UI_RESTRICTIONS {
+//   DWORD UIRestrictionsClass;
+// } JOBOBJECT_BASIC_UI_RESTRICTIONS, *PJOBOBJECT_BASIC_UI_RESTRICTIONS;
+// https://docs.microsoft.com/en-us/windows/desktop/api/winnt/ns-winnt-_jobobject_basic_ui_restrictions
+type _JOBOBJECT_BASIC_UI_RESTRICTIONS struct {
+	UIRestrictionsClass uint32
+}
+
+func queryBasicUIRestrictions(hJob syscall.Handle) (*_JOBOBJECT_BASIC_UI_RESTRICTIONS, error) {
+	var info _JOBOBJECT_BASIC_UI_RESTRICTIONS
+	ret, _, err := procQueryInformationJobObject.Call(
+		uintptr(hJob),
+		uintptr(_JobObjectBasicUIRestrictions),
+		uintptr(unsafe.Pointer(&info)),
+		uintptr(unsafe.Sizeof(info)),
+		uintptr(0),
+	)
+	if ret == 0 {
+		return nil, err
+	}
+	return &info, nil
+}
+
 // typedef struct JOBOBJECT_NET_RATE_CONTROL_INFORMATION {
 //   DWORD64                           MaxBandwidth;
 //   JOB_OBJECT_NET_RATE_CONTROL_FLAGS ControlFlags;
@@ -551,6 +585,97 @@ func queryBasicAndIOAccounting(hJob syscall.Handle) (*_JOBOBJECT_BASIC_AND_IO_AC
 	return &info, nil
 }
 
+func queryBasicLimitInformation(hJob syscall.Handle) (*_JOBOBJECT_BASIC_LIMIT_INFORMATION, error) {
+	var info _JOBOBJECT_BASIC_LIMIT_INFORMATION
+	ret, _, err := procQueryInformationJobObject.Call(
+		uintptr(hJob),
+		uintptr(_JobObjectBasicLimitInformation),
+		uintptr(unsafe.Pointer(&info)),
+		uintptr(unsafe.Sizeof(info)),
+		uintptr(0),
+	)
+	if ret == 0 {
+		return nil, err
+	}
+	return &info, nil
+}
+
+func queryExtendedLimitInformation(hJob syscall.Handle) (*_JOBOBJECT_EXTENDED_LIMIT_INFORMATION, error) {
+	var info _JOBOBJECT_EXTENDED_LIMIT_INFORMATION
+	ret, _, err := procQueryInformationJobObject.Call(
+		uintptr(hJob),
+		uintptr(_JobObjectExtendedLimitInformation),
+		uintptr(unsafe.Pointer(&info)),
+		uintptr(unsafe.Sizeof(info)),
+		uintptr(0),
+	)
+	if ret == 0 {
+		return nil, err
+	}
+	return &info, nil
+}
+
+func queryCPURateControlInformation(hJob syscall.Handle) (*_JOBOBJECT_CPU_RATE_CONTROL_INFORMATION, error) {
+	var info _JOBOBJECT_CPU_RATE_CONTROL_INFORMATION
+	ret, _, err := procQueryInformationJobObject.Call(
+		uintptr(hJob),
+		uintptr(_JobObjectCpuRateControlInformation),
+		uintptr(unsafe.Pointer(&info)),
+		uintptr(unsafe.Sizeof(info)),
+		uintptr(0),
+	)
+	if ret == 0 {
+		return nil, err
+	}
+	return &info, nil
+}
+
+// typedef struct _JOBOBJECT_BASIC_PROCESS_ID_LIST {
+//   DWORD     NumberOfAssignedProcesses;
+//   DWORD     NumberOfProcessIdsInList;
+//   ULONG_PTR ProcessIdList[1];
+// } JOBOBJECT_BASIC_PROCESS_ID_LIST, *PJOBOBJECT_BASIC_PROCESS_ID_LIST;
+// https://docs.microsoft.com/en-us/windows/desktop/api/winnt/ns-winnt-_jobobject_basic_process_id_list
+type _JOBOBJECT_BASIC_PROCESS_ID_LIST struct {
+	NumberOfAssignedProcesses uint32
+	NumberOfProcessIdsInList  uint32
+	ProcessIdList             [1]uintptr
+}
+
+func queryBasicProcessIDList(hJob syscall.Handle) ([]uint32, error) {
+	n := 64
+	for {
+		// the header is followed by n process ids
+		buf := make([]byte, unsafe.Sizeof(_JOBOBJECT_BASIC_PROCESS_ID_LIST{})+uintptr(n-1)*unsafe.Sizeof(uintptr(0)))
+		ret, _, err := procQueryInformationJobObject.Call(
+			uintptr(hJob),
+			uintptr(_JobObjectBasicProcessIdList),
+			uintptr(unsafe.Pointer(&buf[0])),
+			uintptr(len(buf)),
+			uintptr(0),
+		)
+		info := (*_JOBOBJECT_BASIC_PROCESS_ID_LIST)(unsafe.Pointer(&buf[0]))
+		if ret == 0 {
+			if errno, ok := err.(syscall.Errno); ok && uintptr(errno) == ERROR_MORE_DATA {
+				n *= 2
+				continue
+			}
+			return nil, err
+		}
+		if int(info.NumberOfAssignedProcesses) > n {
+			// processes were added between calls
+			n = int(info.NumberOfAssignedProcesses) * 2
+			continue
+		}
+		pids := make([]uint32, 0, info.NumberOfProcessIdsInList)
+		for i := uint32(0); i < info.NumberOfProcessIdsInList; i++ {
+			pid := *(*uintptr)(unsafe.Pointer(uintptr(unsafe.Pointer(&info.ProcessIdList[0])) + uintptr(i)*unsafe.Sizeof(info.ProcessIdList[0])))
+			pids = append(pids, uint32(pid))
+		}
+		return pids, nil
+	}
+}
+
 func queryJobObjectLimitViolationInformation(hJob syscall.Handle) (*_JOBOBJECT_LIMIT_VIOLATION_INFORMATION, error) {
 	var info _JOBOBJECT_LIMIT_VIOLATION_INFORMATION
 	ret, _, err := procQueryInformationJobObject.Call(
@@ -4,10 +4,16 @@ package win32
 
 import (
 	"bytes"
+	"fmt"
 	"os/exec"
 	"runtime"
+	"strings"
+	"syscall"
 	"testing"
 	"time"
+	"unsafe"
+
+	"github.com/pkg/errors"
 )
 
 func TestJobObject(t *testing.T) {
@@ -100,8 +106,8 @@ func TestJobObject(t *testing.T) {
 		LogTestError(t, proc.Kill())
 		t.Fatal(err)
 	}
-	t.Logf("ProcessAffinity [%b]", pa)
-	t.Logf("SystemAffinity  [%b]", sa)
+	t.Logf("ProcessAffinity [%b] %v", pa, pa.Cores())
+	t.Logf("SystemAffinity  [%b] %v", sa, sa.Cores())
 	if err := token.RunAs(func() {
 		if err := job.Assign(proc); err != nil {
 			LogTestError(t, proc.Kill())
@@ -173,3 +179,487 @@ func TestJobObject(t *testing.T) {
 	t.Log("stdout---\n", stdout.String(), "\n---")
 	t.Log("stderr---\n", stderr.String(), "\n---")
 }
+
+func TestJobObjectProcessIDs(t *testing.T) {
+	job, err := CreateJobObject("testjob-pids")
+	if err != nil {
+		t.Fatal("CreateJobObject", err)
+	}
+	defer job.Close()
+	if err = job.SetInformation(&ExtendedLimitInformation{
+		KillOnJobClose: true,
+	}); err != nil {
+		t.Fatal("ExtendedLimitInformation", err)
+	}
+	proc, err := CreateProcessWithToken(exec.Command(SetupTestExe(t), "wait_nosig", "10s"), nil)
+	if err != nil {
+		t.Fatal("CreateProcessWithToken", err)
+	}
+	if err = proc.StartSuspended(); err != nil {
+		t.Fatal("proc.StartSuspended", err)
+	}
+	defer func() {
+		LogTestError(t, proc.Kill())
+	}()
+	if err = job.Assign(proc); err != nil {
+		t.Fatal("job.Assign", err)
+	}
+	pids, err := job.ProcessIDs()
+	if err != nil {
+		t.Fatal("job.ProcessIDs", err)
+	}
+	if len(pids) != 1 || pids[0] != proc.Pid() {
+		t.Fatalf("job.ProcessIDs() = %v; expected [%d]", pids, proc.Pid())
+	}
+	opened, err := OpenJobObject("testjob-pids")
+	if err != nil {
+		t.Fatal("OpenJobObject", err)
+	}
+	defer opened.Close()
+	pids, err = opened.ProcessIDs()
+	if err != nil {
+		t.Fatal("opened.ProcessIDs", err)
+	}
+	if len(pids) != 1 || pids[0] != proc.Pid() {
+		t.Fatalf("opened.ProcessIDs() = %v; expected [%d]", pids, proc.Pid())
+	}
+	accounting, err := opened.Accounting()
+	if err != nil {
+		t.Fatal("opened.Accounting", err)
+	}
+	if accounting.Basic.ActiveProcesses != 1 || accounting.Basic.TotalProcesses != 1 {
+		t.Fatalf("opened.Accounting() = %+v; expected 1 active process", accounting.Basic)
+	}
+}
+
+func TestJobObjectWithoutCompletionPort(t *testing.T) {
+	defer func(fn func(syscall.Handle, syscall.Handle, uint32, uint32) (syscall.Handle, error)) {
+		createIoCompletionPort = fn
+	}(createIoCompletionPort)
+	createIoCompletionPort = func(syscall.Handle, syscall.Handle, uint32, uint32) (syscall.Handle, error) {
+		return 0, syscall.Errno(1450) // ERROR_NO_SYSTEM_RESOURCES
+	}
+	job, err := CreateJobObject("testjob-nocompletion")
+	if err != nil {
+		t.Fatal("CreateJobObject", err)
+	}
+	defer job.Close()
+	if job.NotificationsAvailable() {
+		t.Fatal("expected notifications to be unavailable")
+	}
+	if err = job.SetInformation(&ExtendedLimitInformation{
+		KillOnJobClose: true,
+	}); err != nil {
+		t.Fatal("ExtendedLimitInformation", err)
+	}
+	info, err := job.PollNotifications()
+	if errors.Cause(err) != ErrNotificationsUnavailable {
+		t.Fatalf("PollNotifications() = %v, %v; expected ErrNotificationsUnavailable", info, err)
+	}
+	t.Log(err)
+}
+
+func TestPollNotificationsAfterClose(t *testing.T) {
+	job, err := CreateJobObject("testjob-pollclose")
+	if err != nil {
+		t.Fatal("CreateJobObject", err)
+	}
+	if !job.NotificationsAvailable() {
+		t.Skip("notifications unavailable")
+	}
+	errCh := make(chan error, 1)
+	go func() {
+		for {
+			if _, err := job.PollNotifications(); err == ErrJobObjectClosed {
+				errCh <- err
+				return
+			}
+		}
+	}()
+	time.Sleep(100 * time.Millisecond)
+	LogTestError(t, job.Close())
+	select {
+	case <-errCh:
+	case <-time.After(5 * time.Second):
+		t.Fatal("PollNotifications didn't return ErrJobObjectClosed after Close")
+	}
+}
+
+func TestStopNotificationsWakesReader(t *testing.T) {
+	job, err := CreateBufferedJobObject("testjob-stopnotify", nil, 1)
+	if err != nil {
+		t.Fatal("CreateBufferedJobObject", err)
+	}
+	defer job.Close()
+	if !job.NotificationsAvailable() {
+		t.Skip("notifications unavailable")
+	}
+	if job.notifyBufferSize != 1 {
+		t.Fatalf("notifyBufferSize = %d; expected the size given at creation", job.notifyBufferSize)
+	}
+	errCh := make(chan error, 1)
+	go func() {
+		for {
+			if _, err := job.PollNotifications(); err == ErrJobObjectClosed {
+				errCh <- err
+				return
+			}
+		}
+	}()
+	time.Sleep(100 * time.Millisecond)
+	// the job has no process, so no notification wakes the reader up but StopNotifications
+	job.StopNotifications()
+	select {
+	case <-errCh:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the notifications reader didn't return after StopNotifications")
+	}
+}
+
+func TestJobObjectPeakMemoryUsed(t *testing.T) {
+	job, err := CreateJobObject("testjob-peakmemory")
+	if err != nil {
+		t.Fatal("CreateJobObject", err)
+	}
+	defer job.Close()
+	process, total, err := job.PeakMemoryUsed()
+	if err != nil {
+		t.Fatal("PeakMemoryUsed", err)
+	}
+	if process != 0 || total != 0 {
+		t.Fatalf("PeakMemoryUsed() = %d, %d; expected no memory used by an empty job", process, total)
+	}
+}
+
+func TestJobObjectTerminate(t *testing.T) {
+	job, err := CreateJobObject("testjob-terminate")
+	if err != nil {
+		t.Fatal("CreateJobObject", err)
+	}
+	defer job.Close()
+	proc, err := CreateProcessWithToken(exec.Command(SetupTestExe(t), "wait_nosig", "30s"), nil)
+	if err != nil {
+		t.Fatal("CreateProcessWithToken", err)
+	}
+	if err = proc.StartSuspended(); err != nil {
+		t.Fatal("proc.StartSuspended", err)
+	}
+	if err = job.Assign(proc); err != nil {
+		LogTestError(t, proc.Kill())
+		t.Fatal("job.Assign", err)
+	}
+	if err = proc.Resume(); err != nil {
+		LogTestError(t, proc.Kill())
+		t.Fatal("proc.Resume", err)
+	}
+	if err = job.Terminate(42); err != nil {
+		LogTestError(t, proc.Kill())
+		t.Fatal("job.Terminate", err)
+	}
+	result, err := proc.Wait(nil)
+	if err != nil {
+		t.Fatal("proc.Wait", err)
+	}
+	if result.ExitStatus != 42 {
+		t.Fatalf("exit status = %d; expected 42", result.ExitStatus)
+	}
+}
+
+func TestJobObjectUIRestrictions(t *testing.T) {
+	job, err := CreateJobObject("testjob-uirestrictions")
+	if err != nil {
+		t.Fatal("CreateJobObject", err)
+	}
+	defer job.Close()
+	expected := UIRestrictions{
+		Desktop:        true,
+		ExitWindows:    true,
+		GlobalAtoms:    true,
+		ReadClipboard:  true,
+		WriteClipboard: true,
+	}
+	if err = job.SetInformation(&expected); err != nil {
+		t.Fatal("SetInformation", err)
+	}
+	var actual UIRestrictions
+	if err = job.GetInformation(&actual); err != nil {
+		t.Fatal("GetInformation", err)
+	}
+	if actual != expected {
+		t.Fatalf("UIRestrictions = %+v; expected %+v", actual, expected)
+	}
+}
+
+func TestJobObjectDieOnUnhandledException(t *testing.T) {
+	job, err := CreateJobObject("testjob-dieonexception")
+	if err != nil {
+		t.Fatal("CreateJobObject", err)
+	}
+	defer job.Close()
+	if err = job.SetInformation(&ExtendedLimitInformation{
+		KillOnJobClose:          true,
+		DieOnUnhandledException: true,
+	}); err != nil {
+		t.Fatal("ExtendedLimitInformation", err)
+	}
+	info, err := queryExtendedLimitInformation(job.hJob)
+	if err != nil {
+		t.Fatal("queryExtendedLimitInformation", err)
+	}
+	if info.BasicLimitInformation.LimitFlags&_JOB_OBJECT_LIMIT_DIE_ON_UNHANDLED_EXCEPTION == 0 {
+		t.Fatalf("LimitFlags = %#x; expected JOB_OBJECT_LIMIT_DIE_ON_UNHANDLED_EXCEPTION", info.BasicLimitInformation.LimitFlags)
+	}
+	proc, err := CreateProcessWithToken(exec.Command(SetupTestExe(t), "err"), nil)
+	if err != nil {
+		t.Fatal("CreateProcessWithToken", err)
+	}
+	if err = proc.StartSuspended(); err != nil {
+		t.Fatal("proc.StartSuspended", err)
+	}
+	if err = job.Assign(proc); err != nil {
+		LogTestError(t, proc.Kill())
+		t.Fatal("job.Assign", err)
+	}
+	if err = proc.Resume(); err != nil {
+		LogTestError(t, proc.Kill())
+		t.Fatal("proc.Resume", err)
+	}
+	result, err := proc.Wait(nil)
+	if err != nil {
+		t.Fatal("proc.Wait", err)
+	}
+	if result.ExitStatus != 1 {
+		t.Fatalf("exit status = %d; expected 1", result.ExitStatus)
+	}
+}
+
+func TestReopenJobObject(t *testing.T) {
+	job, err := CreateJobObject("testjob-reopen")
+	if err != nil {
+		t.Fatal("CreateJobObject", err)
+	}
+	defer job.Close()
+	reopened, err := ReopenJobObject("testjob-reopen")
+	if err != nil {
+		t.Fatal("ReopenJobObject", err)
+	}
+	defer reopened.Close()
+	if err = reopened.SetInformation(&BasicLimitInformation{SchedulingClass: 3}); err != nil {
+		t.Fatal("SetInformation", err)
+	}
+	var bli BasicLimitInformation
+	if err = job.GetInformation(&bli); err != nil {
+		t.Fatal("GetInformation", err)
+	}
+	if bli.SchedulingClass != 3 {
+		t.Fatalf("SchedulingClass = %d; expected the limit set through the reopened job", bli.SchedulingClass)
+	}
+	if _, err = ReopenJobObject("testjob-reopen-missing"); err == nil {
+		t.Fatal("expected an error reopening a job that doesn't exist")
+	}
+}
+
+func TestCreateJobObjectExists(t *testing.T) {
+	job, err := CreateJobObject("testjob-exists")
+	if err != nil {
+		t.Fatal("CreateJobObject", err)
+	}
+	dup, err := CreateJobObject("testjob-exists")
+	if errors.Cause(err) != ErrJobObjectExists {
+		LogTestError(t, job.Close())
+		if dup != nil {
+			LogTestError(t, dup.Close())
+		}
+		t.Fatalf("CreateJobObject() = %v, %v; expected ErrJobObjectExists", dup, err)
+	}
+	// the name is free again once every handle to the job is closed
+	LogTestError(t, job.Close())
+	again, err := CreateJobObject("testjob-exists")
+	if err != nil {
+		t.Fatal("CreateJobObject after close", err)
+	}
+	LogTestError(t, again.Close())
+}
+
+func TestCreateJobObjectAfterFailedCall(t *testing.T) {
+	job, err := CreateJobObject("testjob-lasterror")
+	if err != nil {
+		t.Fatal("CreateJobObject", err)
+	}
+	defer job.Close()
+	// leaves ERROR_ALREADY_EXISTS as the last error of the thread
+	if _, err = CreateJobObject("testjob-lasterror"); errors.Cause(err) != ErrJobObjectExists {
+		t.Fatalf("CreateJobObject() = %v; expected ErrJobObjectExists", err)
+	}
+	for _, name := range []string{"testjob-lasterror-new", ""} {
+		hJob, err := createJobObject(nil, name)
+		if err != nil {
+			t.Fatalf("createJobObject(%q) = %v; expected a new job", name, err)
+		}
+		if hJob == 0 || hJob == syscall.InvalidHandle {
+			t.Fatalf("createJobObject(%q) returned an invalid handle", name)
+		}
+		LogTestError(t, syscall.CloseHandle(hJob))
+	}
+}
+
+type errorRecorder struct {
+	noopLogger
+	msgs []string
+}
+
+func (r *errorRecorder) Error(err error, msg string) {
+	r.msgs = append(r.msgs, msg)
+}
+
+func TestJobObjectLabels(t *testing.T) {
+	rec := &errorRecorder{}
+	SetLogger(rec)
+	defer SetLogger(noopLogger{})
+	defer func(fn func(syscall.Handle, syscall.Handle, uint32, uint32) (syscall.Handle, error)) {
+		createIoCompletionPort = fn
+	}(createIoCompletionPort)
+	createIoCompletionPort = func(syscall.Handle, syscall.Handle, uint32, uint32) (syscall.Handle, error) {
+		return 0, syscall.Errno(1450) // ERROR_NO_SYSTEM_RESOURCES
+	}
+	job, err := CreateLabeledJobObject("testjob-labels", map[string]string{
+		"nomad_task_name": "web",
+		"nomad_job_name":  "api",
+	})
+	if err != nil {
+		t.Fatal("CreateLabeledJobObject", err)
+	}
+	defer job.Close()
+	if job.Labels["nomad_task_name"] != "web" {
+		t.Fatalf("Labels = %v; expected the labels given at creation", job.Labels)
+	}
+	expected := `win32: job object notifications are unavailable nomad_job_name="api" nomad_task_name="web"`
+	if len(rec.msgs) != 1 || rec.msgs[0] != expected {
+		t.Fatalf("logged %q; expected %q", rec.msgs, expected)
+	}
+}
+
+func TestJobObjectClosed(t *testing.T) {
+	job, err := CreateJobObject("testjob-closed")
+	if err != nil {
+		t.Fatal("CreateJobObject", err)
+	}
+	if err = job.Close(); err != nil {
+		t.Fatal("Close", err)
+	}
+	if _, err = job.ProcessIDs(); err != ErrJobObjectClosed {
+		t.Errorf("ProcessIDs() = %v; expected ErrJobObjectClosed", err)
+	}
+	if err = job.SetInformation(&BasicLimitInformation{SchedulingClass: 3}); err != ErrJobObjectClosed {
+		t.Errorf("SetInformation() = %v; expected ErrJobObjectClosed", err)
+	}
+	if err = job.Terminate(1); errors.Cause(err) != ErrJobObjectClosed {
+		t.Errorf("Terminate() = %v; expected ErrJobObjectClosed", err)
+	}
+	if err = job.Close(); err != ErrJobObjectClosed {
+		t.Errorf("second Close() = %v; expected ErrJobObjectClosed", err)
+	}
+}
+
+func TestSetJobInfoLogsArguments(t *testing.T) {
+	rec := &errorRecorder{}
+	SetLogger(rec)
+	defer SetLogger(noopLogger{})
+	// a process handle isn't a job handle
+	hProc, err := syscall.GetCurrentProcess()
+	if err != nil {
+		t.Fatal(err)
+	}
+	info := &BasicLimitInformation{PriorityClass: NormalPriortyClass}
+	if err = info.SetJobInfo(hProc); err == nil {
+		t.Fatal("expected SetJobInfo to fail on a process handle")
+	}
+	expected := fmt.Sprintf("info class %d, %d bytes", _JobObjectBasicLimitInformation, unsafe.Sizeof(_JOBOBJECT_BASIC_LIMIT_INFORMATION{}))
+	if len(rec.msgs) != 1 || !strings.Contains(rec.msgs[0], expected) {
+		t.Fatalf("logged %q; expected the info class and size %q", rec.msgs, expected)
+	}
+}
+
+func TestSetInformationLogsLabels(t *testing.T) {
+	rec := &errorRecorder{}
+	SetLogger(rec)
+	defer SetLogger(noopLogger{})
+	hProc, err := syscall.GetCurrentProcess()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the job isn't closed, since its handle is the process pseudo handle
+	job := &JobObject{hJob: hProc, Labels: map[string]string{"nomad_task_name": "web"}}
+	if err = job.SetInformation(&BasicLimitInformation{PriorityClass: NormalPriortyClass}); err == nil {
+		t.Fatal("expected SetInformation to fail on a process handle")
+	}
+	if len(rec.msgs) != 1 || !strings.HasSuffix(rec.msgs[0], ` nomad_task_name="web"`) {
+		t.Fatalf("logged %q; expected the labels of the job", rec.msgs)
+	}
+}
+
+func TestBasicLimitInformationSchedulingClass(t *testing.T) {
+	tests := []struct {
+		info  BasicLimitInformation
+		limit bool
+	}{
+		{info: BasicLimitInformation{}, limit: false},
+		{info: BasicLimitInformation{LimitSchedulingClass: true}, limit: true},
+		{info: BasicLimitInformation{SchedulingClass: 3}, limit: true},
+		{info: BasicLimitInformation{SchedulingClass: 10, LimitSchedulingClass: true}, limit: false},
+	}
+	for _, test := range tests {
+		info := test.info.info()
+		if limit := info.LimitFlags&_JOB_OBJECT_LIMIT_SCHEDULING_CLASS != 0; limit != test.limit {
+			t.Errorf("%+v: scheduling class limited = %t; expected %t", test.info, limit, test.limit)
+		}
+		if test.limit && info.SchedulingClass != uint32(test.info.SchedulingClass) {
+			t.Errorf("%+v: SchedulingClass = %d; expected the class that was set", test.info, info.SchedulingClass)
+		}
+	}
+}
+
+func TestNotificationLimitInformationIOBytes(t *testing.T) {
+	both := _JOB_OBJECT_LIMIT_JOB_READ_BYTES | _JOB_OBJECT_LIMIT_JOB_WRITE_BYTES
+	tests := []struct {
+		info  NotificationLimitInformation
+		flags uint32
+	}{
+		{info: NotificationLimitInformation{IOReadBytesLimit: 1024}, flags: _JOB_OBJECT_LIMIT_JOB_READ_BYTES},
+		{info: NotificationLimitInformation{IOWriteBytesLimit: 2048}, flags: _JOB_OBJECT_LIMIT_JOB_WRITE_BYTES},
+		{info: NotificationLimitInformation{IOReadBytesLimit: 1024, IOWriteBytesLimit: 2048}, flags: both},
+	}
+	for _, test := range tests {
+		info := test.info.info()
+		if info.LimitFlags&both != test.flags {
+			t.Errorf("%+v: LimitFlags = %#x; expected %#x", test.info, info.LimitFlags&both, test.flags)
+		}
+		if info.IoReadBytesLimit != test.info.IOReadBytesLimit || info.IoWriteBytesLimit != test.info.IOWriteBytesLimit {
+			t.Errorf("%+v: read %d, write %d; expected the limits that were set", test.info, info.IoReadBytesLimit, info.IoWriteBytesLimit)
+		}
+	}
+}
+
+func TestMHzToCPURate(t *testing.T) {
+	tests := []struct {
+		mhz        uint64
+		totalTicks float64
+		rate       uint
+		weight     uint
+	}{
+		{mhz: 0, totalTicks: 10000, rate: 0, weight: 0},
+		{mhz: 2500, totalTicks: 10000, rate: 2500, weight: 2},
+		{mhz: 10000, totalTicks: 10000, rate: MaxCPURate, weight: MaxWeight},
+		{mhz: 20000, totalTicks: 10000, rate: MaxCPURate, weight: MaxWeight},
+		{mhz: 50, totalTicks: 30000, rate: 16, weight: MinWeight},
+		{mhz: 1, totalTicks: 30000, rate: MinCPURate, weight: MinWeight},
+	}
+	for _, test := range tests {
+		if rate := mhzToCPURate(test.mhz, test.totalTicks); rate != test.rate {
+			t.Errorf("mhzToCPURate(%d, %.0f) = %d; expected %d", test.mhz, test.totalTicks, rate, test.rate)
+		}
+		if weight := mhzToWeight(test.mhz, test.totalTicks); weight != test.weight {
+			t.Errorf("mhzToWeight(%d, %.0f) = %d; expected %d", test.mhz, test.totalTicks, weight, test.weight)
+		}
+	}
+}
@@ -10,7 +10,9 @@ import (
 
 var (
 	procCreateJobObjectW         = kernel32DLL.NewProc("CreateJobObjectW")
+	procOpenJobObjectW           = kernel32DLL.NewProc("OpenJobObjectW")
 	procAssignProcessToJobObject = kernel32DLL.NewProc("AssignProcessToJobObject")
+	procTerminateJobObject       = kernel32DLL.NewProc("TerminateJobObject")
 )
 
 // HANDLE WINAPI CreateJobObject(
@@ -19,12 +21,46 @@ var (
 // );
 //
 // See https://msdn.microsoft.com/en-us/library/windows/desktop/ms682409(v=vs.85).aspx
+//
+// When a job with the same name exists, the handle to it is returned along with ERROR_ALREADY_EXISTS.
+// The last error is only meaningful for a named job: the handle decides whether the call failed
 func createJobObject(attr *syscall.SecurityAttributes, name string) (syscall.Handle, error) {
 	ret, _, err := procCreateJobObjectW.Call(
 		uintptr(unsafe.Pointer(attr)),
 		uintptr(unsafe.Pointer(syscall.StringToUTF16Ptr(name))),
 	)
-	if err != syscall.Errno(0) {
+	if ret == 0 {
+		return 0, errnoToError(err)
+	}
+	if name != "" && err == syscall.ERROR_ALREADY_EXISTS {
+		return syscall.Handle(ret), err
+	}
+	return syscall.Handle(ret), nil
+}
+
+// Job object specific access rights
+// https://docs.microsoft.com/en-us/windows/desktop/procthread/job-object-security-and-access-rights
+const (
+	_JOB_OBJECT_ASSIGN_PROCESS          uint32 = 0x0001
+	_JOB_OBJECT_SET_ATTRIBUTES          uint32 = 0x0002
+	_JOB_OBJECT_QUERY                   uint32 = 0x0004
+	_JOB_OBJECT_TERMINATE               uint32 = 0x0008
+	_JOB_OBJECT_SET_SECURITY_ATTRIBUTES uint32 = 0x0010
+)
+
+// HANDLE WINAPI OpenJobObject(
+//   _In_ DWORD   dwDesiredAccess,
+//   _In_ BOOL    bInheritHandles,
+//   _In_ LPCTSTR lpName
+// );
+// https://docs.microsoft.com/en-us/windows/desktop/api/jobapi2/nf-jobapi2-openjobobjectw
+func openJobObject(dwDesiredAccess uint32, inherit bool, name string) (syscall.Handle, error) {
+	ret, _, err := procOpenJobObjectW.Call(
+		uintptr(dwDesiredAccess),
+		uintptr(toBOOL(inherit)),
+		uintptr(unsafe.Pointer(syscall.StringToUTF16Ptr(name))),
+	)
+	if ret == 0 {
 		return 0, err
 	}
 	return syscall.Handle(ret), nil
@@ -46,6 +82,22 @@ func assignProcessToJobObject(hJob syscall.Handle, hProcess syscall.Handle) erro
 	return nil
 }
 
+// BOOL WINAPI TerminateJobObject(
+//   _In_ HANDLE hJob,
+//   _In_ UINT   uExitCode
+// );
+// https://docs.microsoft.com/en-us/windows/desktop/api/jobapi2/nf-jobapi2-terminatejobobject
+func terminateJobObject(hJob syscall.Handle, uExitCode uint32) error {
+	ret, _, err := procTerminateJobObject.Call(
+		uintptr(hJob),
+		uintptr(uExitCode),
+	)
+	if ret == 0 {
+		return err
+	}
+	return nil
+}
+
 // BOOL WINAPI SetInformationJobObject(
 //   _In_ HANDLE             hJob,
 //   _In_ JOBOBJECTINFOCLASS JobObjectInfoClass,
@@ -61,7 +113,7 @@ func setInformationJobObject(hJob syscall.Handle, JobObjectInfoClass uint32, lpJ
 		uintptr(cbJobObjectInfoLength),
 	)
 	if ret == 0 {
-		return err
+		return jobInfoError(hJob, nil, JobObjectInfoClass, uintptr(cbJobObjectInfoLength), err)
 	}
 	return nil
 }
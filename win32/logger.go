@@ -1,6 +1,7 @@
 package win32
 
 import (
+	"fmt"
 	"sync"
 	"sync/atomic"
 )
@@ -50,6 +51,14 @@ func LogError(err error, msg string) {
 	}
 }
 
+// LogErrorf logs err like LogError, with a message formatted with the context of the failed call,
+// such as its arguments
+func LogErrorf(err error, format string, args ...interface{}) {
+	if err != nil {
+		logger().Error(err, fmt.Sprintf(format, args...))
+	}
+}
+
 type logWrapper struct {
 	logger Logger
 }
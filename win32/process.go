@@ -15,6 +15,7 @@ import (
 )
 
 const DefaultExitTimeout = time.Second * 30
+const DefaultKillGracePeriod = time.Second * 10
 
 // ErrProcessNotStarted is returned when an operation is performed
 // on a process before it has been started.
@@ -26,17 +27,47 @@ const (
 	ExitStatusUnknown    = 255
 )
 
+// ConsoleCtrlEvent is the console control event sent to a process
+// to request a graceful shutdown
+type ConsoleCtrlEvent int
+
+const (
+	// CtrlBreakEvent sends CTRL_BREAK_EVENT to the process group of the process (default)
+	CtrlBreakEvent ConsoleCtrlEvent = iota
+	// CtrlCEvent sends CTRL_C_EVENT. CTRL+C cannot be limited to a single process group,
+	// so the process is created in the console's process group and the event is sent to
+	// every process attached to the console, including the caller.
+	CtrlCEvent
+)
+
+func (e ConsoleCtrlEvent) String() string {
+	switch e {
+	case CtrlBreakEvent:
+		return "CTRL_BREAK_EVENT"
+	case CtrlCEvent:
+		return "CTRL_C_EVENT"
+	}
+	return fmt.Sprintf("ConsoleCtrlEvent(%d)", int(e))
+}
+
 // Process wraps exec.Cmd to provide some helper functions
 type Process struct {
 	Cmd         *exec.Cmd
 	ExitTimeout time.Duration
-	Token       *Token
-	mu          sync.RWMutex
-	suspended   bool
-	started     bool
-	ended       bool
-	startTime   time.Time
-	endTime     time.Time
+	// KillGracePeriod is how long to wait for the process to terminate after it has been killed
+	KillGracePeriod time.Duration
+	// ShutdownEvent is the console control event sent when a graceful exit is requested
+	ShutdownEvent ConsoleCtrlEvent
+	Token         *Token
+	mu            sync.RWMutex
+	suspended     bool
+	paused        bool
+	started       bool
+	ended         bool
+	startTime     time.Time
+	endTime       time.Time
+	// limitedMemoryInfo is set once PROCESS_VM_READ was denied to MemoryInfo
+	limitedMemoryInfo int32
 }
 
 // ProcessResult is the result of the process after it completed
@@ -85,8 +116,6 @@ func (p *Process) StartTime() time.Time {
 	return p.startTime
 }
 
-type AffinityMask uint32
-
 // AffinityMask returns the process affinity mask and system affinity mask
 func (p *Process) AffinityMask() (AffinityMask, AffinityMask, error) {
 	p.mu.RLock()
@@ -103,13 +132,108 @@ func (p *Process) AffinityMask() (AffinityMask, AffinityMask, error) {
 	return 0, 0, ErrProcessNotStarted
 }
 
+// SetAffinity pins the running process to the logical processors set in mask,
+// which must be a subset of the system affinity mask
+func (p *Process) SetAffinity(mask AffinityMask) error {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if !p.started {
+		return ErrProcessNotStarted
+	}
+	phProc, err := openProcess(_PROCESS_QUERY_INFORMATION|_PROCESS_SET_INFORMATION, false, p.Pid())
+	if err != nil {
+		return errors.Wrapf(err, "win32: unable to open process %d", p.Pid())
+	}
+	defer CloseHandleLogErr(*phProc, "win32: failed to close process handle")
+	_, sam, err := getProcessAffinityMask(*phProc)
+	if err != nil {
+		return errors.Wrapf(err, "win32: unable to get the affinity mask of process %d", p.Pid())
+	}
+	if mask == 0 || uint32(mask)&^sam != 0 {
+		return errors.Errorf("win32: affinity mask %#x is not a subset of the system affinity mask %#x", uint32(mask), sam)
+	}
+	if err = setProcessAffinityMask(*phProc, uint32(mask)); err != nil {
+		return errors.Wrapf(err, "win32: unable to set the affinity mask of process %d", p.Pid())
+	}
+	return nil
+}
+
+// ProcessTimes holds the timing information for a process
+type ProcessTimes struct {
+	// CreationTime is when the process was created
+	CreationTime time.Time
+	// ExitTime is when the process exited. It is the zero time while the process is running
+	ExitTime time.Time
+	// KernelTime is the amount of time the process has executed in kernel mode
+	KernelTime time.Duration
+	// UserTime is the amount of time the process has executed in user mode
+	UserTime time.Duration
+}
+
+// Times returns the creation time, exit time and CPU times of the process
+func (p *Process) Times() (ProcessTimes, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if !p.started {
+		return ProcessTimes{}, ErrProcessNotStarted
+	}
+	return p.times()
+}
+
+func (p *Process) times() (ProcessTimes, error) {
+	return processTimes(p.Pid())
+}
+
+// ProcessTimesByPID returns the creation time, exit time and CPU times of the process with the given ID,
+// e.g. of damon itself
+func ProcessTimesByPID(pid uint32) (ProcessTimes, error) {
+	pt, err := processTimes(pid)
+	return pt, errors.Wrapf(err, "win32: unable to get the times of process %d", pid)
+}
+
+func processTimes(pid uint32) (ProcessTimes, error) {
+	phProc, err := openProcess(_PROCESS_QUERY_LIMITED_INFORMATION, false, pid)
+	if err != nil {
+		return ProcessTimes{}, err
+	}
+	defer CloseHandleLogErr(*phProc, "win32: failed to close process handle")
+	creation, exit, kernel, user, err := getProcessTimes(*phProc)
+	if err != nil {
+		return ProcessTimes{}, err
+	}
+	pt := ProcessTimes{
+		CreationTime: time.Unix(0, creation.Nanoseconds()),
+		KernelTime:   filetimeToDuration(kernel),
+		UserTime:     filetimeToDuration(user),
+	}
+	if exit.Nanoseconds() > 0 {
+		pt.ExitTime = time.Unix(0, exit.Nanoseconds())
+	}
+	return pt, nil
+}
+
 func (p *Process) MemoryInfo() (ProcessMemoryInfo, error) {
-	phProc, err := openProcess(_PROCESS_QUERY_INFORMATION|_PROCESS_VM_READ, false, p.Pid())
+	phProc, err := p.openForMemoryInfo()
 	if err != nil {
 		return ProcessMemoryInfo{}, err
 	}
 	defer CloseHandleLogErr(*phProc, "win32: failed to close process handle")
-	minfo, err := getProcessMemoryInfo(*phProc)
+	return memoryInfo(*phProc)
+}
+
+// ProcessMemoryInfoByPID returns the memory counters of the process with the given ID,
+// e.g. for a process of a job that wasn't started by this process
+func ProcessMemoryInfoByPID(pid uint32) (ProcessMemoryInfo, error) {
+	phProc, err := openProcess(_PROCESS_QUERY_LIMITED_INFORMATION, false, pid)
+	if err != nil {
+		return ProcessMemoryInfo{}, errors.Wrapf(err, "win32: unable to open process %d", pid)
+	}
+	defer CloseHandleLogErr(*phProc, "win32: failed to close process handle")
+	return memoryInfo(*phProc)
+}
+
+func memoryInfo(hProc syscall.Handle) (ProcessMemoryInfo, error) {
+	minfo, err := getProcessMemoryInfo(hProc)
 	if err != nil {
 		return ProcessMemoryInfo{}, err
 	}
@@ -127,6 +251,21 @@ func (p *Process) MemoryInfo() (ProcessMemoryInfo, error) {
 	}, nil
 }
 
+// openForMemoryInfo opens the process to read its memory counters.
+// GetProcessMemoryInfo only needs PROCESS_VM_READ on old versions of Windows, so when it is denied,
+// e.g. for a low integrity process, the process is opened with PROCESS_QUERY_LIMITED_INFORMATION from then on
+func (p *Process) openForMemoryInfo() (*syscall.Handle, error) {
+	if atomic.LoadInt32(&p.limitedMemoryInfo) == 0 {
+		phProc, err := openProcess(_PROCESS_QUERY_INFORMATION|_PROCESS_VM_READ, false, p.Pid())
+		if err != syscall.ERROR_ACCESS_DENIED {
+			return phProc, err
+		}
+		atomic.StoreInt32(&p.limitedMemoryInfo, 1)
+		Logf("win32: reading the memory of process %d with limited access: %v", p.Pid(), err)
+	}
+	return openProcess(_PROCESS_QUERY_LIMITED_INFORMATION, false, p.Pid())
+}
+
 // StartSuspended starts the process with the main thread suspended
 // which is useful for creating a process that should be assigned
 // to a JobObject before running
@@ -140,11 +279,22 @@ func (p *Process) StartSuspended() error {
 }
 
 func (p *Process) start() error {
+	if p.ShutdownEvent == CtrlCEvent && p.Cmd.SysProcAttr != nil {
+		// processes in a new process group have CTRL+C disabled
+		p.Cmd.SysProcAttr.CreationFlags &^= syscall.CREATE_NEW_PROCESS_GROUP
+	}
 	if err := p.Cmd.Start(); err != nil {
 		return err
 	}
-	p.startTime = time.Now()
 	p.started = true
+	// use the creation time reported by windows so that
+	// the time spent suspended and constraining the process isn't counted
+	if pt, err := p.times(); err == nil {
+		p.startTime = pt.CreationTime
+	} else {
+		LogError(err, "win32: could not get process creation time")
+		p.startTime = time.Now()
+	}
 	return nil
 }
 
@@ -176,20 +326,7 @@ func (p *Process) Wait(exitCh <-chan struct{}) (*ProcessResult, error) {
 			// done before exit signal received
 			return
 		}
-		// try to exit gracefully
-		if err := generateConsoleCtrlEvent(syscall.CTRL_BREAK_EVENT, p.Pid()); err != nil {
-			// ctrl+break not sent, kill now
-			LogError(p.Cmd.Process.Kill(), "win32: could not kill process")
-			return
-		}
-		select {
-		case <-doneCh:
-			Logf("win32: command completed")
-			return
-		case <-time.After(p.ExitTimeout):
-			// give up -- send kill signal
-			LogError(p.Cmd.Process.Kill(), "win32: could not kill process")
-		}
+		LogError(p.ShutdownWithGrace(p.ExitTimeout, p.KillGracePeriod), "win32: process shutdown error")
 	}()
 	go func() {
 		defer close(doneCh)
@@ -218,6 +355,107 @@ func (p *Process) Wait(exitCh <-chan struct{}) (*ProcessResult, error) {
 	return res, nil
 }
 
+// ShutdownWithGrace asks the process to exit gracefully by sending the ShutdownEvent
+// and waits up to signalWait for it to exit. If it is still running after signalWait
+// the process is killed, and ShutdownWithGrace waits up to killWait for it to terminate.
+// returns an error if the process was not started or didn't terminate after being killed
+func (p *Process) ShutdownWithGrace(signalWait, killWait time.Duration) error {
+	p.mu.RLock()
+	started := p.started
+	p.mu.RUnlock()
+	if !started {
+		return ErrProcessNotStarted
+	}
+	phProc, err := openProcess(_SYNCHRONIZE, false, p.Pid())
+	if err != nil {
+		return errors.Wrapf(err, "win32: unable to open process %d", p.Pid())
+	}
+	defer CloseHandleLogErr(*phProc, "win32: failed to close process handle")
+	if err := p.sendShutdownEvent(); err != nil {
+		// console event not sent, kill now
+		LogError(err, "win32: could not send shutdown event")
+	} else {
+		exited, err := waitForProcessExit(*phProc, signalWait)
+		if err != nil {
+			return err
+		}
+		if exited {
+			return nil
+		}
+		Logf("win32: process %d did not exit within %v. killing process", p.Pid(), signalWait)
+	}
+	if err := p.Cmd.Process.Kill(); err != nil {
+		return errors.Wrapf(err, "win32: could not kill process")
+	}
+	exited, err := waitForProcessExit(*phProc, killWait)
+	if err != nil {
+		return err
+	}
+	if !exited {
+		return errors.Errorf("win32: process %d did not exit within %v of being killed", p.Pid(), killWait)
+	}
+	return nil
+}
+
+// waitForProcessExit returns true if the process exited before the timeout
+func waitForProcessExit(hProc syscall.Handle, timeout time.Duration) (bool, error) {
+	ev, err := syscall.WaitForSingleObject(hProc, uint32(timeout/time.Millisecond))
+	if err != nil {
+		return false, errors.Wrapf(err, "win32: WaitForSingleObject failed")
+	}
+	return ev == syscall.WAIT_OBJECT_0, nil
+}
+
+func (p *Process) sendShutdownEvent() error {
+	return p.SendConsoleCtrlEvent(p.ShutdownEvent)
+}
+
+// SendConsoleCtrlEvent sends the console control event to the process without waiting for it to exit.
+// CtrlCEvent is sent to every process attached to the console
+func (p *Process) SendConsoleCtrlEvent(e ConsoleCtrlEvent) error {
+	p.mu.RLock()
+	started := p.started
+	p.mu.RUnlock()
+	if !started {
+		return ErrProcessNotStarted
+	}
+	Logf("win32: sending %v", e)
+	if e == CtrlCEvent {
+		// counted before it is sent, since this process may receive it before generateConsoleCtrlEvent returns
+		atomic.AddInt32(&ctrlCSent, 1)
+		if err := generateConsoleCtrlEvent(syscall.CTRL_C_EVENT, 0); err != nil {
+			atomic.AddInt32(&ctrlCSent, -1)
+			return err
+		}
+		return nil
+	}
+	return generateConsoleCtrlEvent(syscall.CTRL_BREAK_EVENT, p.Pid())
+}
+
+// AllocConsole gives this process a new console, e.g. when it runs as a service, which has none.
+// The processes it starts afterwards share the console, so that they can be sent console control events
+func AllocConsole() error {
+	return errors.Wrapf(allocConsole(), "win32: unable to allocate a console")
+}
+
+// ctrlCSent counts the CTRL_C_EVENTs sent by SendConsoleCtrlEvent that this process hasn't consumed yet
+var ctrlCSent int32
+
+// ConsumeSentCtrlC returns true when this process sent a CTRL_C_EVENT that it hasn't consumed yet, and consumes it.
+// CTRL_C_EVENT is also delivered to the sender, which can't tell it apart from a Ctrl+C typed in the console:
+// call it on each interrupt to ignore the ones the process sent itself
+func ConsumeSentCtrlC() bool {
+	for {
+		n := atomic.LoadInt32(&ctrlCSent)
+		if n <= 0 {
+			return false
+		}
+		if atomic.CompareAndSwapInt32(&ctrlCSent, n, n-1) {
+			return true
+		}
+	}
+}
+
 func getExitCode(state *os.ProcessState, err error) int {
 	if state == nil {
 		return ExitStatusUnknown
@@ -247,10 +485,33 @@ func (p *Process) Pid() uint32 {
 	return 0
 }
 
-// Resume will resume the process created with suspend=true
+// Suspend pauses every thread of the running process until Resume is called
+func (p *Process) Suspend() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.started {
+		return ErrProcessNotStarted
+	}
+	if p.paused {
+		return nil
+	}
+	if err := suspendProcessThreads(p.Pid()); err != nil {
+		return err
+	}
+	p.paused = true
+	return nil
+}
+
+// Resume will resume the process created with suspend=true, or paused by Suspend
 func (p *Process) Resume() error {
 	p.mu.Lock()
 	defer p.mu.Unlock()
+	if p.paused {
+		if err := resumeProcessThreads(p.Pid()); err != nil {
+			return err
+		}
+		p.paused = false
+	}
 	if p.suspended {
 		phThread, err := openProcessMainThreadForResume(p.Pid())
 		if err != nil {
@@ -265,6 +526,17 @@ func (p *Process) Resume() error {
 	return nil
 }
 
+// MainThreadSuspended returns true while the main thread of the process is suspended,
+// e.g. when it was started suspended and resuming it didn't reach it
+func (p *Process) MainThreadSuspended() (bool, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if !p.started {
+		return false, ErrProcessNotStarted
+	}
+	return mainThreadSuspended(p.Pid())
+}
+
 // Kill the running process
 func (p *Process) Kill() error {
 	p.mu.RLock()
@@ -276,8 +548,9 @@ func (p *Process) Kill() error {
 // which is used to limit the access rights of the command
 func CreateProcessWithToken(command *exec.Cmd, token *Token) (*Process, error) {
 	cmd := &Process{
-		Cmd:         command,
-		ExitTimeout: DefaultExitTimeout,
+		Cmd:             command,
+		ExitTimeout:     DefaultExitTimeout,
+		KillGracePeriod: DefaultKillGracePeriod,
 	}
 	if command.SysProcAttr == nil {
 		command.SysProcAttr = &syscall.SysProcAttr{
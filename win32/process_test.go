@@ -7,9 +7,12 @@ import (
 	"context"
 	"os"
 	"os/exec"
+	"os/signal"
 	"strings"
+	"syscall"
 	"testing"
 	"time"
+	"unsafe"
 )
 
 func SkipIfDocker(t *testing.T) {
@@ -114,3 +117,256 @@ func TestRunProcessWaitNoSignal(t *testing.T) {
 		t.Fatalf("out: expected '%s', actual '%s'", exp, out)
 	}
 }
+
+func TestProcessTimes(t *testing.T) {
+	cmd := exec.Command(SetupTestExe(t))
+	proc, err := CreateProcessWithToken(cmd, nil)
+	if err != nil {
+		t.Fatal("CreateProcessWithToken", err)
+	}
+	t0 := time.Now()
+	if err = proc.StartSuspended(); err != nil {
+		t.Fatal("proc.StartSuspended()", err)
+	}
+	t1 := time.Now()
+	time.Sleep(500 * time.Millisecond)
+	times, err := proc.Times()
+	if err != nil {
+		t.Fatal("proc.Times()", err)
+	}
+	// FILETIME has a coarser resolution than time.Now
+	if times.CreationTime.Before(t0.Add(-time.Second)) || times.CreationTime.After(t1) {
+		t.Fatalf("CreationTime %v is not between %v and %v", times.CreationTime, t0, t1)
+	}
+	if !times.ExitTime.IsZero() {
+		t.Fatalf("ExitTime should be zero while the process is running: %v", times.ExitTime)
+	}
+	if st := proc.StartTime(); !st.Equal(times.CreationTime) {
+		t.Fatalf("StartTime %v should be the process CreationTime %v", st, times.CreationTime)
+	}
+	if err = proc.Resume(); err != nil {
+		t.Fatal("proc.Resume()", err)
+	}
+	if _, err = proc.Wait(nil); err != nil {
+		t.Fatal("proc.Wait()", err)
+	}
+}
+
+func TestProcessMainThreadID(t *testing.T) {
+	// the go runtime starts several threads, so the test process is always multi-threaded
+	pid := uint32(os.Getpid())
+	tids, err := processThreadIDs(pid)
+	if err != nil {
+		t.Fatal("processThreadIDs", err)
+	}
+	if len(tids) < 2 {
+		t.Fatalf("processThreadIDs() = %v; expected the threads of the go runtime", tids)
+	}
+	mainTID, err := processMainThreadID(pid)
+	if err != nil {
+		t.Fatal("processMainThreadID", err)
+	}
+	created := make(map[uint32]int64)
+	for _, tid := range tids {
+		phThread, err := openThread(_THREAD_QUERY_LIMITED_INFORMATION, false, tid)
+		if err != nil {
+			continue
+		}
+		creation, _, _, _, err := getThreadTimes(*phThread)
+		LogTestError(t, syscall.CloseHandle(*phThread))
+		if err == nil {
+			created[tid] = creation.Nanoseconds()
+		}
+	}
+	mainCreated, ok := created[mainTID]
+	if !ok {
+		t.Fatalf("main thread %d is not one of %v", mainTID, tids)
+	}
+	for tid, ns := range created {
+		if ns < mainCreated {
+			t.Errorf("thread %d was created before the main thread %d", tid, mainTID)
+		}
+	}
+}
+
+func TestThreadEntryResult(t *testing.T) {
+	errInvalidHandle := syscall.Errno(6) // ERROR_INVALID_HANDLE
+	if ok, err := threadEntryResult(1, syscall.Errno(0)); !ok || err != nil {
+		t.Errorf("threadEntryResult(TRUE) = %v, %v; expected true, nil", ok, err)
+	}
+	if ok, err := threadEntryResult(0, syscall.ERROR_NO_MORE_FILES); ok || err != nil {
+		t.Errorf("threadEntryResult(ERROR_NO_MORE_FILES) = %v, %v; expected the end of the iteration", ok, err)
+	}
+	if ok, err := threadEntryResult(0, errInvalidHandle); ok || err != errInvalidHandle {
+		t.Errorf("threadEntryResult(ERROR_INVALID_HANDLE) = %v, %v; expected the error", ok, err)
+	}
+	var te32 _THREADENTRY32
+	te32.dwSize = uint32(unsafe.Sizeof(te32))
+	if ok, err := thread32First(syscall.InvalidHandle, &te32); ok || err == nil {
+		t.Errorf("thread32First(InvalidHandle) = %v, %v; expected an error", ok, err)
+	}
+}
+
+func TestProcessSetAffinity(t *testing.T) {
+	cmd := exec.Command(SetupTestExe(t))
+	proc, err := CreateProcessWithToken(cmd, nil)
+	if err != nil {
+		t.Fatal("CreateProcessWithToken", err)
+	}
+	if err = proc.SetAffinity(1); err != ErrProcessNotStarted {
+		t.Fatalf("SetAffinity before start = %v; expected ErrProcessNotStarted", err)
+	}
+	if err = proc.StartSuspended(); err != nil {
+		t.Fatal("proc.StartSuspended()", err)
+	}
+	defer func() {
+		LogTestError(t, proc.Resume())
+		_, err := proc.Wait(nil)
+		LogTestError(t, err)
+	}()
+	_, sam, err := proc.AffinityMask()
+	if err != nil {
+		t.Fatal("proc.AffinityMask()", err)
+	}
+	// the lowest processor of the system
+	mask := sam & -sam
+	if err = proc.SetAffinity(mask); err != nil {
+		t.Fatal("proc.SetAffinity()", err)
+	}
+	pam, _, err := proc.AffinityMask()
+	if err != nil {
+		t.Fatal("proc.AffinityMask()", err)
+	}
+	if pam != mask {
+		t.Fatalf("AffinityMask() = %#x; expected %#x", pam, mask)
+	}
+	if ^sam != 0 {
+		if err = proc.SetAffinity(^sam); err == nil {
+			t.Fatalf("expected an error setting the processors missing from the system mask %#x", sam)
+		}
+	}
+}
+
+func TestProcessSuspend(t *testing.T) {
+	cmd := exec.Command(SetupTestExe(t), "cpu")
+	proc, err := CreateProcessWithToken(cmd, nil)
+	if err != nil {
+		t.Fatal("CreateProcessWithToken", err)
+	}
+	if err = proc.Suspend(); err != ErrProcessNotStarted {
+		t.Fatalf("Suspend before start = %v; expected ErrProcessNotStarted", err)
+	}
+	if err = proc.Start(); err != nil {
+		t.Fatal("proc.Start()", err)
+	}
+	defer func() {
+		LogTestError(t, proc.Kill())
+		_, err := proc.Wait(nil)
+		LogTestError(t, err)
+	}()
+	cpuTime := func() time.Duration {
+		times, err := proc.Times()
+		if err != nil {
+			t.Fatal("proc.Times()", err)
+		}
+		return times.KernelTime + times.UserTime
+	}
+	time.Sleep(500 * time.Millisecond)
+	if err = proc.Suspend(); err != nil {
+		t.Fatal("proc.Suspend()", err)
+	}
+	paused := cpuTime()
+	time.Sleep(500 * time.Millisecond)
+	if d := cpuTime(); d != paused {
+		t.Fatalf("the suspended process used %v of CPU", d-paused)
+	}
+	if err = proc.Resume(); err != nil {
+		t.Fatal("proc.Resume()", err)
+	}
+	time.Sleep(500 * time.Millisecond)
+	if d := cpuTime(); d <= paused {
+		t.Fatal("the resumed process didn't use any CPU")
+	}
+}
+
+func TestProcessMemoryInfoLimitedAccess(t *testing.T) {
+	cmd := exec.Command(SetupTestExe(t))
+	proc, err := CreateProcessWithToken(cmd, nil)
+	if err != nil {
+		t.Fatal("CreateProcessWithToken", err)
+	}
+	if err = proc.StartSuspended(); err != nil {
+		t.Fatal("proc.StartSuspended()", err)
+	}
+	defer func() {
+		LogTestError(t, proc.Resume())
+		_, err := proc.Wait(nil)
+		LogTestError(t, err)
+	}()
+	full, err := proc.MemoryInfo()
+	if err != nil {
+		t.Fatal("proc.MemoryInfo()", err)
+	}
+	// as if PROCESS_VM_READ had been denied
+	proc.limitedMemoryInfo = 1
+	limited, err := proc.MemoryInfo()
+	if err != nil {
+		t.Fatal("proc.MemoryInfo() with limited access", err)
+	}
+	if limited.WorkingSetSize == 0 || limited.PrivateUsage == 0 {
+		t.Fatalf("MemoryInfo() with limited access = %+v; expected the counters of %+v", limited, full)
+	}
+}
+
+func TestProcessMemoryInfoByPID(t *testing.T) {
+	meminfo, err := ProcessMemoryInfoByPID(uint32(os.Getpid()))
+	if err != nil {
+		t.Fatal("ProcessMemoryInfoByPID", err)
+	}
+	if meminfo.WorkingSetSize == 0 || meminfo.PrivateUsage == 0 {
+		t.Fatalf("ProcessMemoryInfoByPID() = %+v; expected the memory of the test process", meminfo)
+	}
+}
+
+func TestShutdownCtrlC(t *testing.T) {
+	SkipIfDocker(t)
+	// the test process shares the console, so it receives the CTRL_C_EVENT too
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, os.Interrupt)
+	defer signal.Stop(sigCh)
+	buf := &bytes.Buffer{}
+	cmd := exec.Command(SetupTestExe(t), "wait", "30s")
+	cmd.Stdout = buf
+	proc, err := CreateProcessWithToken(cmd, nil)
+	if err != nil {
+		t.Fatal("CreateProcessWithToken", err)
+	}
+	proc.ShutdownEvent = CtrlCEvent
+	if err = proc.Start(); err != nil {
+		t.Fatal("proc.Start()", err)
+	}
+	// give the process time to install its handler
+	time.Sleep(500 * time.Millisecond)
+	if err = proc.ShutdownWithGrace(10*time.Second, time.Second); err != nil {
+		t.Fatal("proc.ShutdownWithGrace()", err)
+	}
+	res, err := proc.Wait(nil)
+	if err != nil {
+		t.Fatal("proc.Wait()", err)
+	}
+	// the process prints its exit code when it exits on its own rather than being killed
+	if out := strings.TrimSpace(buf.String()); out != "rc 1" || res.ExitStatus != 1 {
+		t.Fatalf("expected the process to exit on its own - rc %d, out '%s'", res.ExitStatus, out)
+	}
+	select {
+	case <-sigCh:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the test process to receive the CTRL_C_EVENT")
+	}
+	if !ConsumeSentCtrlC() {
+		t.Fatal("expected the CTRL_C_EVENT to be recognized as sent by this process")
+	}
+	if ConsumeSentCtrlC() {
+		t.Fatal("expected the CTRL_C_EVENT to be consumed once")
+	}
+}
@@ -4,15 +4,18 @@ package win32
 
 import (
 	"syscall"
+	"time"
 	"unsafe"
 )
 
 var (
 	procGenerateConsoleCtrlEvent = kernel32DLL.NewProc("GenerateConsoleCtrlEvent")
+	procAllocConsole             = kernel32DLL.NewProc("AllocConsole")
 	procGetProcessAffinityMask   = kernel32DLL.NewProc("GetProcessAffinityMask")
 	procSetProcessAffinityMask   = kernel32DLL.NewProc("SetProcessAffinityMask")
 	procOpenProcess              = kernel32DLL.NewProc("OpenProcess")
 	procGetProcessMemoryInfo     = psapiDLL.NewProc("GetProcessMemoryInfo")
+	procGetProcessTimes          = kernel32DLL.NewProc("GetProcessTimes")
 )
 
 // Process Acecss Rights
@@ -116,6 +119,13 @@ func generateConsoleCtrlEvent(dwCtrlEvent uint32, dwProcessGroupId uint32) error
 	return testReturnCodeNonZero(ret, errno)
 }
 
+// BOOL WINAPI AllocConsole(void);
+// https://docs.microsoft.com/en-us/windows/console/allocconsole
+func allocConsole() error {
+	ret, _, errno := procAllocConsole.Call()
+	return testReturnCodeNonZero(ret, errno)
+}
+
 // BOOL GetProcessAffinityMask(
 //   HANDLE     hProcess,
 //   PDWORD_PTR lpProcessAffinityMask,
@@ -123,8 +133,9 @@ func generateConsoleCtrlEvent(dwCtrlEvent uint32, dwProcessGroupId uint32) error
 // );
 // https://docs.microsoft.com/en-us/windows/desktop/api/winbase/nf-winbase-getprocessaffinitymask
 func getProcessAffinityMask(hProcess syscall.Handle) (uint32, uint32, error) {
-	var pam uint32
-	var sam uint32
+	// DWORD_PTR is pointer sized
+	var pam uintptr
+	var sam uintptr
 	ret, _, errno := procGetProcessAffinityMask.Call(
 		uintptr(hProcess),
 		uintptr(unsafe.Pointer(&pam)),
@@ -133,7 +144,7 @@ func getProcessAffinityMask(hProcess syscall.Handle) (uint32, uint32, error) {
 	if err := testReturnCodeNonZero(ret, errno); err != nil {
 		return 0, 0, err
 	}
-	return pam, sam, nil
+	return uint32(pam), uint32(sam), nil
 }
 
 // BOOL SetProcessAffinityMask(
@@ -141,10 +152,10 @@ func getProcessAffinityMask(hProcess syscall.Handle) (uint32, uint32, error) {
 //   DWORD_PTR dwProcessAffinityMask
 // );
 // https://docs.microsoft.com/en-us/windows/desktop/api/winbase/nf-winbase-setprocessaffinitymask
-func setProcessAffinityMask(hProcess syscall.Handle, sam uint32) error {
+func setProcessAffinityMask(hProcess syscall.Handle, pam uint32) error {
 	ret, _, errno := procSetProcessAffinityMask.Call(
 		uintptr(hProcess),
-		uintptr(unsafe.Pointer(&sam)),
+		uintptr(pam),
 	)
 	return testReturnCodeNonZero(ret, errno)
 }
@@ -196,3 +207,28 @@ func getProcessMemoryInfo(hProc syscall.Handle) (*_PROCESS_MEMORY_COUNTERS_EX, e
 	}
 	return &info, nil
 }
+
+// BOOL GetProcessTimes(
+//   HANDLE     hProcess,
+//   LPFILETIME lpCreationTime,
+//   LPFILETIME lpExitTime,
+//   LPFILETIME lpKernelTime,
+//   LPFILETIME lpUserTime
+// );
+// https://docs.microsoft.com/en-us/windows/desktop/api/processthreadsapi/nf-processthreadsapi-getprocesstimes
+func getProcessTimes(hProc syscall.Handle) (creation, exit, kernel, user syscall.Filetime, err error) {
+	ret, _, errno := procGetProcessTimes.Call(
+		uintptr(hProc),
+		uintptr(unsafe.Pointer(&creation)),
+		uintptr(unsafe.Pointer(&exit)),
+		uintptr(unsafe.Pointer(&kernel)),
+		uintptr(unsafe.Pointer(&user)),
+	)
+	err = testReturnCodeNonZero(ret, errno)
+	return
+}
+
+// filetimeToDuration converts a FILETIME holding an amount of time in 100ns ticks to a duration
+func filetimeToDuration(ft syscall.Filetime) time.Duration {
+	return time.Duration(uint64(ft.HighDateTime)<<32|uint64(ft.LowDateTime)) * 100
+}
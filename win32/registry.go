@@ -6,6 +6,7 @@ import (
 	"encoding/binary"
 	"fmt"
 	"strings"
+	"syscall"
 
 	"github.com/pkg/errors"
 )
@@ -78,5 +79,40 @@ func (k *RegistryKey) ReadDWORDValue(name string) (uint32, error) {
 	case _REG_DWORD_BIG_ENDIAN:
 		return (binary.BigEndian.Uint32(kv)), nil
 	}
-	return 0, errors.Wrapf(err, "value is not a DWORD")
+	return 0, errors.Errorf("win32: %s\\%s is not a DWORD", k, name)
+}
+
+// ReadQWORDValue reads a QWORD value out of the registry key
+// It will return an error if the value doesn't exist
+// or if it is not a REG_QWORD
+func (k *RegistryKey) ReadQWORDValue(name string) (uint64, error) {
+	kv, kt, err := k.ReadValue(name)
+	if err != nil {
+		return 0, err
+	}
+	if kt != _REG_QWORD || len(kv) < 8 {
+		return 0, errors.Errorf("win32: %s\\%s is not a QWORD", k, name)
+	}
+	return binary.LittleEndian.Uint64(kv), nil
+}
+
+// ReadStringValue reads a string value out of the registry key
+// It will return an error if the value doesn't exist
+// or if it is not one of the expected types:
+// - REG_SZ
+// - REG_EXPAND_SZ (environment variables are not expanded)
+func (k *RegistryKey) ReadStringValue(name string) (string, error) {
+	kv, kt, err := k.ReadValue(name)
+	if err != nil {
+		return "", err
+	}
+	if kt != _REG_SZ && kt != _REG_EXPAND_SZ {
+		return "", errors.Errorf("win32: %s\\%s is not a string", k, name)
+	}
+	u := make([]uint16, len(kv)/2)
+	for i := range u {
+		u[i] = binary.LittleEndian.Uint16(kv[i*2:])
+	}
+	// the terminating nul may be missing, or followed by garbage
+	return syscall.UTF16ToString(u), nil
 }
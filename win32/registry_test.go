@@ -2,7 +2,10 @@
 
 package win32
 
-import "testing"
+import (
+	"strings"
+	"testing"
+)
 
 func TestRegistryKeyRead(t *testing.T) {
 	val := "CurrentMajorVersionNumber"
@@ -45,3 +48,40 @@ func TestRegistryKeyBadRootKey(t *testing.T) {
 		t.Fatal("expected error")
 	}
 }
+
+func TestRegistryKeyReadString(t *testing.T) {
+	val := "ProductName"
+	key, err := OpenRegistryKey("HKEY_LOCAL_MACHINE", `SOFTWARE\Microsoft\Windows NT\CurrentVersion`, RegistryKeyPermissions{Read: true})
+	if err != nil {
+		t.Fatal("OpenRegistryKey", err)
+	}
+	defer key.Close()
+	s, err := key.ReadStringValue(val)
+	if err != nil {
+		t.Fatalf("ReadStringValue('%s') %v", val, err)
+	}
+	if !strings.Contains(s, "Windows") {
+		t.Fatalf("%v['%s'] = '%s'; expected it to contain 'Windows'", key, val, s)
+	}
+	t.Logf("%v['%s'] = '%s'", key, val, s)
+	if _, err = key.ReadStringValue("CurrentMajorVersionNumber"); err == nil {
+		t.Fatal("expected ReadStringValue to fail on a DWORD")
+	}
+}
+
+func TestRegistryKeyReadQWORD(t *testing.T) {
+	val := "InstallTime"
+	key, err := OpenRegistryKey("HKEY_LOCAL_MACHINE", `SOFTWARE\Microsoft\Windows NT\CurrentVersion`, RegistryKeyPermissions{Read: true})
+	if err != nil {
+		t.Fatal("OpenRegistryKey", err)
+	}
+	defer key.Close()
+	qw, err := key.ReadQWORDValue(val)
+	if err != nil {
+		t.Fatalf("ReadQWORDValue('%s') %v", val, err)
+	}
+	t.Logf("%v['%s'] = 0x%x", key, val, qw)
+	if _, err = key.ReadQWORDValue("SystemRoot"); err == nil {
+		t.Fatal("expected ReadQWORDValue to fail on a string")
+	}
+}
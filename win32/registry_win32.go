@@ -38,7 +38,7 @@ func readRegValue(hKey HKEY, valueName string) ([]byte, uint32, error) {
 	var Type uint32
 	for {
 		var Data = make([]byte, cbData)
-		ret, _, err := procRegQueryValueExW.Call(
+		ret, _, _ := procRegQueryValueExW.Call(
 			uintptr(hKey),
 			uintptr(unsafe.Pointer(lpValueName)),
 			uintptr(0),
@@ -46,11 +46,12 @@ func readRegValue(hKey HKEY, valueName string) ([]byte, uint32, error) {
 			uintptr(unsafe.Pointer(&Data[0])),
 			uintptr(unsafe.Pointer(&cbData)),
 		)
-		if err == syscall.ERROR_MORE_DATA {
+		// the status is returned rather than set as the last error
+		if syscall.Errno(ret) == syscall.ERROR_MORE_DATA {
 			continue
 		}
-		if ret != 0 {
-			return nil, 0, err
+		if ret != ERROR_SUCCESS {
+			return nil, 0, syscall.Errno(ret)
 		}
 		return Data[0:cbData], Type, nil
 	}
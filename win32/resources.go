@@ -5,6 +5,7 @@ package win32
 import (
 	"fmt"
 	"math"
+	"strings"
 	"sync"
 
 	"github.com/pkg/errors"
@@ -16,12 +17,14 @@ type SystemResources struct {
 	CPUTotalTicks         float64
 	MemoryTotalPhysicalKB float64
 	MemoryTotalVirtualKB  float64
+	// CPUModelName is the processor brand string, empty when it can't be read
+	CPUModelName string
 }
 
 var (
-	systemResources SystemResources
-
-	onceInit sync.Once
+	systemResources       SystemResources
+	systemResourcesLoaded bool
+	systemResourcesLock   sync.Mutex
 )
 
 func getNumCores() (int, error) {
@@ -32,41 +35,69 @@ func getNumCores() (int, error) {
 	return int(si.dwNumberOfProcessors), nil
 }
 
+// GetSystemResources returns the CPU and memory of the machine. They are read once and cached,
+// unless they are refreshed or set with RefreshSystemResources and SetSystemResources.
+// It panics when they can't be read the first time
 func GetSystemResources() SystemResources {
-	var err error
-	onceInit.Do(func() {
-		var cpuNumCores int
-		cpuNumCores, err = getNumCores()
-		if err != nil {
-			err = fmt.Errorf("Unable to determine the number of CPU cores available: %v", err)
-			return
-		}
-		var mhz uint32
-		mhz, err = getProcessorMHz()
-		if err != nil {
-			err = fmt.Errorf("Unable to obtain CPU MHz: %v", err)
-			return
-		}
-		var mem *_MEMORYSTATUSEX
-		mem, err = globalMemoryStatusEx()
+	systemResourcesLock.Lock()
+	defer systemResourcesLock.Unlock()
+	if !systemResourcesLoaded {
+		sr, err := readSystemResources()
 		if err != nil {
-			err = fmt.Errorf("Unable to obtain total system memory: %v", err)
-			return
-		}
-		systemResources = SystemResources{
-			MemoryTotalPhysicalKB: float64(mem.ullTotalPhys) / float64(1024),
-			MemoryTotalVirtualKB:  float64(mem.ullTotalVirtual) / float64(1024),
-			CPUMhzPercore:         float64(mhz),
-			CPUTotalTicks:         math.Floor(float64(cpuNumCores) * float64(mhz)),
-			CPUNumCores:           cpuNumCores,
+			panic(err)
 		}
-	})
-	if err != nil {
-		panic(err)
+		systemResources = sr
+		systemResourcesLoaded = true
 	}
 	return systemResources
 }
 
+// RefreshSystemResources reads the CPU and memory of the machine again, e.g. after the CPU frequency changed,
+// and returns them. The cached resources are kept when they can't be read
+func RefreshSystemResources() (SystemResources, error) {
+	sr, err := readSystemResources()
+	if err != nil {
+		return SystemResources{}, err
+	}
+	SetSystemResources(sr)
+	return sr, nil
+}
+
+// SetSystemResources overrides the resources returned by GetSystemResources,
+// e.g. to test the CPU limit conversions with a known machine
+func SetSystemResources(sr SystemResources) {
+	systemResourcesLock.Lock()
+	defer systemResourcesLock.Unlock()
+	systemResources = sr
+	systemResourcesLoaded = true
+}
+
+func readSystemResources() (SystemResources, error) {
+	cpuNumCores, err := getNumCores()
+	if err != nil {
+		return SystemResources{}, fmt.Errorf("Unable to determine the number of CPU cores available: %v", err)
+	}
+	mhz, err := getProcessorMHz()
+	if err != nil {
+		return SystemResources{}, fmt.Errorf("Unable to obtain CPU MHz: %v", err)
+	}
+	mem, err := globalMemoryStatusEx()
+	if err != nil {
+		return SystemResources{}, fmt.Errorf("Unable to obtain total system memory: %v", err)
+	}
+	// the model name is informational, so it isn't worth failing over
+	model, merr := getProcessorModelName()
+	LogError(merr, "Unable to obtain CPU model name")
+	return SystemResources{
+		MemoryTotalPhysicalKB: float64(mem.ullTotalPhys) / float64(1024),
+		MemoryTotalVirtualKB:  float64(mem.ullTotalVirtual) / float64(1024),
+		CPUMhzPercore:         float64(mhz),
+		CPUTotalTicks:         math.Floor(float64(cpuNumCores) * float64(mhz)),
+		CPUNumCores:           cpuNumCores,
+		CPUModelName:          model,
+	}, nil
+}
+
 func getProcessorMHz() (uint32, error) {
 	subKey := `HARDWARE\DESCRIPTION\System\CentralProcessor\0`
 	key, err := OpenRegistryKey("HKLM", subKey, RegistryKeyPermissions{Read: true})
@@ -80,3 +111,18 @@ func getProcessorMHz() (uint32, error) {
 	}
 	return mhz, nil
 }
+
+func getProcessorModelName() (string, error) {
+	subKey := `HARDWARE\DESCRIPTION\System\CentralProcessor\0`
+	key, err := OpenRegistryKey("HKLM", subKey, RegistryKeyPermissions{Read: true})
+	if err != nil {
+		return "", errors.Wrapf(err, "getProcessorModelName: could not open HKLM:%s", subKey)
+	}
+	defer CloseLogErr(key, fmt.Sprintf("getProcessorModelName: could not close key HKLM:%s", subKey))
+	name, err := key.ReadStringValue("ProcessorNameString")
+	if err != nil {
+		return "", errors.Wrapf(err, "getProcessorModelName: could not read ProcessorNameString of HKLM:%s", subKey)
+	}
+	// the brand string is padded with spaces on some processors
+	return strings.TrimSpace(name), nil
+}
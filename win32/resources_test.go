@@ -12,6 +12,17 @@ func TestReadMHz(t *testing.T) {
 	t.Logf("MHz = %d", mhz)
 }
 
+func TestReadModelName(t *testing.T) {
+	name, err := getProcessorModelName()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name == "" {
+		t.Fatal("expected a CPU model name")
+	}
+	t.Logf("model = '%s'", name)
+}
+
 func TestGetSystemInfo(t *testing.T) {
 	si, err := getSystemInfo()
 	if err != nil {
@@ -42,3 +53,30 @@ func TestGetResources(t *testing.T) {
 	t.Logf("Total Physical Memory MiB = %.2f", res.MemoryTotalPhysicalKB/1024.0)
 	t.Logf("Total Virtual Memory MiB = %.2f", res.MemoryTotalVirtualKB/1024.0)
 }
+
+func TestSetSystemResources(t *testing.T) {
+	defer func() {
+		if _, err := RefreshSystemResources(); err != nil {
+			t.Fatal(err)
+		}
+	}()
+	SetSystemResources(SystemResources{
+		CPUNumCores:   4,
+		CPUMhzPercore: 2500,
+		CPUTotalTicks: 10000,
+	})
+	if res := GetSystemResources(); res.CPUTotalTicks != 10000 {
+		t.Fatalf("CPUTotalTicks = %.0f; expected the resources that were set", res.CPUTotalTicks)
+	}
+	// a quarter of the machine
+	if rate := MHzToCPURate(2500); rate != 2500 {
+		t.Fatalf("MHzToCPURate(2500) = %d; expected 2500", rate)
+	}
+	res, err := RefreshSystemResources()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.CPUNumCores == 0 || GetSystemResources() != res {
+		t.Fatalf("RefreshSystemResources() = %+v; expected the resources of this machine", res)
+	}
+}
@@ -12,9 +12,11 @@ import (
 var (
 	procOpenThread               = kernel32DLL.NewProc("OpenThread")
 	procResumeThread             = kernel32DLL.NewProc("ResumeThread")
+	procSuspendThread            = kernel32DLL.NewProc("SuspendThread")
 	procCreateToolhelp32Snapshot = kernel32DLL.NewProc("CreateToolhelp32Snapshot")
 	procThread32First            = kernel32DLL.NewProc("Thread32First")
 	procThread32Next             = kernel32DLL.NewProc("Thread32Next")
+	procGetThreadTimes           = kernel32DLL.NewProc("GetThreadTimes")
 )
 
 // HANDLE OpenThread(
@@ -50,6 +52,20 @@ func resumeThread(hThread syscall.Handle) error {
 	return nil
 }
 
+// DWORD SuspendThread(
+//   HANDLE hThread
+// );
+// https://docs.microsoft.com/en-us/windows/desktop/api/processthreadsapi/nf-processthreadsapi-suspendthread
+func suspendThread(hThread syscall.Handle) error {
+	ret, _, errno := procSuspendThread.Call(
+		uintptr(hThread),
+	)
+	if DWORD(ret) == DWORD_MAX {
+		return errnoToError(errno)
+	}
+	return nil
+}
+
 // HANDLE CreateToolhelp32Snapshot(
 //   DWORD dwFlags,
 //   DWORD th32ProcessID
@@ -117,6 +133,19 @@ const (
 
 const _THREAD_ALL_ACCESS uint32 = (_STANDARD_RIGHTS_REQUIRED | _SYNCHRONIZE | 0xFFFF)
 
+// threadEntryResult converts the result of Thread32First and Thread32Next.
+// It returns false and no error once there are no more threads in the snapshot,
+// and an error only when the call failed for another reason
+func threadEntryResult(ret uintptr, errno error) (bool, error) {
+	if BOOL(ret).boolean() {
+		return true, nil
+	}
+	if errno == syscall.ERROR_NO_MORE_FILES {
+		return false, nil
+	}
+	return false, errnoToError(errno)
+}
+
 // BOOL Thread32First(
 //   HANDLE          hSnapshot,
 //   LPTHREADENTRY32 lpte
@@ -127,10 +156,7 @@ func thread32First(hSnapshot syscall.Handle, lpte *_THREADENTRY32) (bool, error)
 		uintptr(hSnapshot),
 		uintptr(unsafe.Pointer(lpte)),
 	)
-	if errno == syscall.ERROR_NO_MORE_FILES {
-		return false, errnoToError(errno)
-	}
-	return BOOL(ret).boolean(), nil
+	return threadEntryResult(ret, errno)
 }
 
 // BOOL Thread32Next(
@@ -143,15 +169,31 @@ func thread32Next(hSnapshot syscall.Handle, lpte *_THREADENTRY32) (bool, error)
 		uintptr(hSnapshot),
 		uintptr(unsafe.Pointer(lpte)),
 	)
-	if errno == syscall.ERROR_NO_MORE_FILES {
-		return false, errnoToError(errno)
-	}
-	return BOOL(ret).boolean(), nil
+	return threadEntryResult(ret, errno)
 }
 
-// getProcessThreadHandle is a utility function that gets the first thread handle
-// of the given process id with the THREAD_RESUME access right
-func openProcessMainThreadForResume(pid uint32) (*syscall.Handle, error) {
+// BOOL GetThreadTimes(
+//   HANDLE     hThread,
+//   LPFILETIME lpCreationTime,
+//   LPFILETIME lpExitTime,
+//   LPFILETIME lpKernelTime,
+//   LPFILETIME lpUserTime
+// );
+// https://docs.microsoft.com/en-us/windows/desktop/api/processthreadsapi/nf-processthreadsapi-getthreadtimes
+func getThreadTimes(hThread syscall.Handle) (creation, exit, kernel, user syscall.Filetime, err error) {
+	ret, _, errno := procGetThreadTimes.Call(
+		uintptr(hThread),
+		uintptr(unsafe.Pointer(&creation)),
+		uintptr(unsafe.Pointer(&exit)),
+		uintptr(unsafe.Pointer(&kernel)),
+		uintptr(unsafe.Pointer(&user)),
+	)
+	err = testReturnCodeNonZero(ret, errno)
+	return
+}
+
+// processThreadIDs lists the IDs of the threads of the given process id
+func processThreadIDs(pid uint32) ([]uint32, error) {
 	phSnapshot, err := createToolhelp32Snapshot(_TH32CS_SNAPTHREAD, 0)
 	if err != nil {
 		return nil, errors.Wrapf(err, "win32: createToolhelp32Snapshot failed")
@@ -159,21 +201,151 @@ func openProcessMainThreadForResume(pid uint32) (*syscall.Handle, error) {
 	hSnapshot := *phSnapshot
 	defer syscall.CloseHandle(hSnapshot)
 
+	var tids []uint32
 	var te32 _THREADENTRY32
 	te32.dwSize = uint32(unsafe.Sizeof(te32))
 	ok, err := thread32First(hSnapshot, &te32)
-	for ok && err == nil {
+	for ok {
 		if te32.th32OwnerProcessID == pid {
-			break
+			tids = append(tids, te32.th32ThreadID)
 		}
 		ok, err = thread32Next(hSnapshot, &te32)
 	}
-	if te32.th32ThreadID != 0 {
-		phThread, err := openThread(_THREAD_SUSPEND_RESUME, false, te32.th32ThreadID)
+	if err != nil {
+		return nil, errors.Wrapf(err, "win32: unable to list the threads of process %d", pid)
+	}
+	return tids, nil
+}
+
+// processMainThreadID returns the ID of the oldest thread of the given process id.
+// The snapshot lists threads in no particular order, so the first thread of the process
+// isn't necessarily its main thread when it has several
+func processMainThreadID(pid uint32) (uint32, error) {
+	tids, err := processThreadIDs(pid)
+	if err != nil {
+		return 0, err
+	}
+	var mainTID uint32
+	var oldest int64
+	for _, tid := range tids {
+		phThread, err := openThread(_THREAD_QUERY_LIMITED_INFORMATION, false, tid)
 		if err != nil {
-			return nil, errors.Wrapf(err, "win32: openThread failed")
+			// the thread exited since the snapshot was taken
+			continue
+		}
+		creation, _, _, _, err := getThreadTimes(*phThread)
+		CloseHandleLogErr(*phThread, "win32: failed to close thread handle")
+		if err != nil {
+			continue
+		}
+		if ns := creation.Nanoseconds(); mainTID == 0 || ns < oldest {
+			mainTID = tid
+			oldest = ns
 		}
-		return phThread, nil
 	}
-	return nil, errors.Errorf("win32: no thread found")
+	if mainTID == 0 {
+		return 0, errors.Errorf("win32: no thread found")
+	}
+	return mainTID, nil
+}
+
+// openProcessMainThreadForResume opens the main thread of the given process id
+// with the THREAD_SUSPEND_RESUME access right
+func openProcessMainThreadForResume(pid uint32) (*syscall.Handle, error) {
+	tid, err := processMainThreadID(pid)
+	if err != nil {
+		return nil, err
+	}
+	phThread, err := openThread(_THREAD_SUSPEND_RESUME, false, tid)
+	if err != nil {
+		return nil, errors.Wrapf(err, "win32: openThread failed")
+	}
+	return phThread, nil
+}
+
+// threadSuspendCount returns the suspend count of the thread, which is 0 while it may run.
+// Windows only reports the count when changing it, so the thread is suspended and resumed right away
+func threadSuspendCount(hThread syscall.Handle) (uint32, error) {
+	ret, _, errno := procSuspendThread.Call(
+		uintptr(hThread),
+	)
+	if DWORD(ret) == DWORD_MAX {
+		return 0, errnoToError(errno)
+	}
+	return uint32(ret), resumeThread(hThread)
+}
+
+// mainThreadSuspended returns true while the main thread of the given process id is suspended
+func mainThreadSuspended(pid uint32) (bool, error) {
+	phThread, err := openProcessMainThreadForResume(pid)
+	if err != nil {
+		return false, err
+	}
+	defer CloseHandleLogErr(*phThread, "win32: failed to close thread handle")
+	count, err := threadSuspendCount(*phThread)
+	if err != nil {
+		return false, errors.Wrapf(err, "win32: unable to get the suspend count of the main thread of process %d", pid)
+	}
+	return count > 0, nil
+}
+
+// threadSuspendResume opens the thread with the given id and calls fn on it
+func threadSuspendResume(tid uint32, fn func(hThread syscall.Handle) error) error {
+	phThread, err := openThread(_THREAD_SUSPEND_RESUME, false, tid)
+	if err != nil {
+		return errors.Wrapf(err, "win32: openThread %d failed", tid)
+	}
+	defer CloseHandleLogErr(*phThread, "win32: failed to close thread handle")
+	return fn(*phThread)
+}
+
+// suspendProcessThreads suspends every thread of the given process id.
+// Windows has no documented call to suspend a whole process, so the threads are listed from a snapshot.
+// A running thread may start new threads meanwhile, so snapshots are taken until one has no new thread.
+// When a thread can't be suspended, the threads already suspended are resumed
+func suspendProcessThreads(pid uint32) error {
+	suspended := make(map[uint32]bool)
+	for {
+		tids, err := processThreadIDs(pid)
+		if err != nil {
+			resumeThreads(suspended)
+			return err
+		}
+		found := false
+		for _, tid := range tids {
+			if suspended[tid] {
+				continue
+			}
+			found = true
+			if err = threadSuspendResume(tid, suspendThread); err != nil {
+				resumeThreads(suspended)
+				return errors.Wrapf(err, "win32: unable to suspend thread %d of process %d", tid, pid)
+			}
+			suspended[tid] = true
+		}
+		if !found {
+			return nil
+		}
+	}
+}
+
+// resumeThreads resumes the given threads, logging the errors
+func resumeThreads(tids map[uint32]bool) {
+	for tid := range tids {
+		LogError(threadSuspendResume(tid, resumeThread), "win32: failed to resume thread")
+	}
+}
+
+// resumeProcessThreads resumes every thread of the given process id once
+func resumeProcessThreads(pid uint32) error {
+	tids, err := processThreadIDs(pid)
+	if err != nil {
+		return err
+	}
+	for _, tid := range tids {
+		if err = threadSuspendResume(tid, resumeThread); err != nil {
+			return errors.Wrapf(err, "win32: unable to resume thread %d of process %d", tid, pid)
+		}
+	}
+	return nil
 }
@@ -98,7 +98,7 @@ func CurrentProcessToken() (*Token, error) {
 type UserLogin struct {
 	Domain   string
 	Username string
-	Password Password
+	Password Password `json:"-"`
 }
 
 // Password abstracts how the UTF-16 / ANSI representation of the password is stored
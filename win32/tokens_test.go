@@ -3,7 +3,9 @@
 package win32
 
 import (
+	"encoding/json"
 	"os"
+	"strings"
 	"testing"
 )
 
@@ -87,3 +89,17 @@ func TestCreateBatchUserToken(t *testing.T) {
 		t.Error("restricted.TokenType is Impersonation; should be TokenTypePrimary")
 	}
 }
+
+func TestUserLoginJSONOmitsPassword(t *testing.T) {
+	b, err := json.Marshal(UserLogin{
+		Domain:   "domain",
+		Username: "user",
+		Password: UnsafePasswordString("___SECRET___"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(b), "___SECRET___") {
+		t.Fatalf("password was serialized: %s", b)
+	}
+}
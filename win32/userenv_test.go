@@ -0,0 +1,41 @@
+// +build windows
+
+package win32
+
+import (
+	"reflect"
+	"syscall"
+	"testing"
+	"unicode/utf16"
+	"unsafe"
+)
+
+func makeEnvironmentBlock(entries ...[]uint16) []uint16 {
+	var block []uint16
+	for _, e := range entries {
+		block = append(block, e...)
+		block = append(block, 0)
+	}
+	return append(block, 0)
+}
+
+func TestReadEnvironmentBlock(t *testing.T) {
+	block := makeEnvironmentBlock(
+		utf16.Encode([]rune("=C:=C:\\damon")),
+		utf16.Encode([]rune("PATH=C:\\Windows")),
+		utf16.Encode([]rune("MALFORMED")),
+		append(utf16.Encode([]rune("BAD_SURROGATE=")), 0xD800, 'x'),
+		utf16.Encode([]rune("EMOJI=\U0001F600")),
+		utf16.Encode([]rune("EMPTY=")),
+	)
+	envs := readEnvironmentBlock(syscall.Handle(unsafe.Pointer(&block[0])))
+	expected := []string{
+		"=C:=C:\\damon",
+		"PATH=C:\\Windows",
+		"EMOJI=\U0001F600",
+		"EMPTY=",
+	}
+	if !reflect.DeepEqual(envs, expected) {
+		t.Fatalf("expected %q but got %q", expected, envs)
+	}
+}
@@ -3,7 +3,9 @@
 package win32
 
 import (
+	"strings"
 	"syscall"
+	"unicode"
 	"unicode/utf16"
 	"unsafe"
 )
@@ -44,6 +46,8 @@ func destroyEnvironmentBlock(lpEnvironment syscall.Handle) error {
 // readEnvironmentBlock reads the environment block into a golang string-array
 // The environment block is an array of null-terminated Unicode (UTF-16) strings.
 // The list ends with two nulls (\0\0).
+// Entries that are not valid UTF-16 or are not in KEY=VALUE form are dropped
+// with a logged warning, so they can be safely assigned to exec.Cmd.Env
 func readEnvironmentBlock(lpEnvironment syscall.Handle) []string {
 	var envs []string
 	var nulls int
@@ -53,7 +57,9 @@ func readEnvironmentBlock(lpEnvironment syscall.Handle) []string {
 		if u == 0 {
 			nulls++
 			if len(env) > 0 {
-				envs = append(envs, string(utf16.Decode(env)))
+				if e, ok := decodeEnvironmentEntry(env); ok {
+					envs = append(envs, e)
+				}
 				env = nil
 				continue
 			}
@@ -66,3 +72,52 @@ func readEnvironmentBlock(lpEnvironment syscall.Handle) []string {
 	}
 	return envs
 }
+
+// decodeEnvironmentEntry decodes a single UTF-16 environment entry
+// returning false if the entry is malformed
+func decodeEnvironmentEntry(env []uint16) (string, bool) {
+	if !isValidUTF16(env) {
+		Logf("win32: dropping environment entry with invalid UTF-16 surrogate pairs: %s", envKey(string(utf16.Decode(env))))
+		return "", false
+	}
+	e := string(utf16.Decode(env))
+	if !isValidEnvironmentEntry(e) {
+		Logf("win32: dropping malformed environment entry: %s", envKey(e))
+		return "", false
+	}
+	return e, true
+}
+
+// isValidUTF16 returns false if the string contains unpaired surrogates
+func isValidUTF16(s []uint16) bool {
+	for i := 0; i < len(s); i++ {
+		if !utf16.IsSurrogate(rune(s[i])) {
+			continue
+		}
+		if i+1 >= len(s) || utf16.DecodeRune(rune(s[i]), rune(s[i+1])) == unicode.ReplacementChar {
+			return false
+		}
+		i++
+	}
+	return true
+}
+
+// isValidEnvironmentEntry checks that the entry is in KEY=VALUE form.
+// Windows stores per-drive working directories as hidden variables
+// such as "=C:=C:\dir", so a leading '=' is treated as part of the key
+func isValidEnvironmentEntry(env string) bool {
+	if len(env) < 2 {
+		return false
+	}
+	return strings.IndexByte(env[1:], '=') >= 0
+}
+
+// envKey returns the key portion of the entry so that values (which may be secrets) aren't logged
+func envKey(env string) string {
+	if len(env) > 1 {
+		if i := strings.IndexByte(env[1:], '='); i >= 0 {
+			return env[:i+1]
+		}
+	}
+	return env
+}